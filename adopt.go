@@ -0,0 +1,58 @@
+package pool
+
+import (
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// Adopt places a driver connection that was opened outside the pool under the
+// pool's management, which eases migrating code that handles its own
+// connections.  The connection is connected if it isn't already, and the
+// pool's charset and InitConnection are applied to it.  It is then checked out
+// to the caller like a connection returned by Get: it is subject to the
+// pool's request timeout, is destroyed on errors, expires after
+// MaxConnectionAge seconds from now and is verified when it is checked out
+// again after it has been released.  The driver connection keeps its own
+// address, credentials and dialer, so the pool's dial settings don't apply to
+// it.  Adopt fails with ErrPoolFull if the pool already has MaxConnections
+// open connections, and with ErrBudgetExhausted if the server's budget (see
+// Config.Budget) is used up.
+func (pool *Pool) Adopt(driverConn mysql.Conn) (*Conn, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.closed() {
+		return nil, ErrPoolClosed
+	}
+	if len(pool.openConnections) >= int(pool.config.MaxConnections) {
+		return nil, ErrPoolFull
+	}
+	if !pool.config.Budget.acquire(pool) {
+		return nil, ErrBudgetExhausted
+	}
+
+	conn := pool.newConn(driverConn)
+	conn.adopted = true
+	var err error
+	if driverConn.IsConnected() {
+		err = conn.prepareConnection()
+	} else {
+		err = conn.Connect()
+	}
+	if err != nil {
+		pool.config.Budget.release()
+		if driverConn.IsConnected() {
+			driverConn.Close()
+		}
+		return nil, err
+	}
+	pool.addConn(conn)
+	return conn, nil
+}
+
+// sideConn returns an unconnected driver connection to the same server as the
+// connection, for requests such as KILL QUERY that must be made out of band.
+func (conn *Conn) sideConn() mysql.Conn {
+	if conn.adopted {
+		return conn.Conn.Clone()
+	}
+	return conn.pool.newDriverConn(conn.address)
+}
@@ -0,0 +1,170 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Default fraction of connections retired by each rolling refresh
+const defaultRefreshFraction = 0.1
+
+// startBackground starts the background tasks enabled in the pool's
+// configuration.  They run until the pool is closed.
+func (pool *Pool) startBackground() {
+	if pool.config.RefreshInterval > 0 {
+		fraction := pool.config.RefreshFraction
+		if fraction <= 0 {
+			fraction = defaultRefreshFraction
+		}
+		go pool.every(time.Duration(pool.config.RefreshInterval)*time.Second, func() {
+			pool.refreshOldest(math.Min(fraction, 1))
+		})
+	}
+	if pool.config.MinIdleConnections > 0 {
+		go pool.keepMinIdle()
+	}
+	if pool.config.UnreadResultTimeout > 0 && pool.config.OnUnreadResult != nil {
+		maxUnread := time.Duration(pool.config.UnreadResultTimeout) * time.Second
+		go pool.every(maxUnread/2, func() {
+			pool.reportUnread(maxUnread)
+		})
+	}
+	if pool.config.HealthCheck != nil {
+		go pool.every(pool.config.HealthCheck.interval(), pool.checkHealth)
+	}
+	if pool.trackLeaks() {
+		threshold := time.Duration(pool.config.LeakWarningThreshold) * time.Second
+		go pool.every(threshold/2, func() {
+			pool.reportLeaks(threshold)
+		})
+	}
+	if len(pool.config.Addresses) > 1 {
+		interval := time.Duration(pool.config.FailoverProbeInterval) * time.Second
+		if interval == 0 {
+			interval = defaultFailoverProbeInterval
+		}
+		go pool.every(interval, pool.probeHosts)
+	}
+	if pool.config.KeepConnectionsAlive {
+		go pool.watchSuspend()
+	}
+	if pool.config.MaxIdleTime > 0 {
+		maxIdle := time.Duration(pool.config.MaxIdleTime) * time.Second
+		go pool.every(maxIdle/2, func() {
+			pool.reapIdle(maxIdle)
+		})
+	}
+}
+
+// every calls f at the given interval until the pool is stopped.
+func (pool *Pool) every(interval time.Duration, f func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f()
+		case <-pool.stop:
+			return
+		}
+	}
+}
+
+// refreshOldest retires the given fraction of the pool's open connections,
+// oldest first.  Idle connections are closed immediately and those in use are
+// closed when they are released.
+func (pool *Pool) refreshOldest(fraction float64) {
+	now := time.Now()
+	pool.mutex.Lock()
+	conns := pool.openByAge()
+	n := int(math.Ceil(fraction * float64(len(conns))))
+	for _, conn := range conns[:n] {
+		conn.retireBy(now)
+	}
+	pool.mutex.Unlock()
+	pool.reapExpired()
+}
+
+// reapIdle closes connections that have been idle for longer than maxIdle,
+// while keeping Config.MinIdleConnections idle ones.
+func (pool *Pool) reapIdle(maxIdle time.Duration) {
+	idle := pool.takeIdle()
+	live := idle[:0]
+	for i, conn := range idle {
+		if time.Since(time.Unix(0, atomic.LoadInt64(&conn.idleSince))) > maxIdle && len(live)+len(idle)-i > int(pool.config.MinIdleConnections) {
+			conn.destroy(DestroyedIdle)
+		} else {
+			live = append(live, conn)
+		}
+	}
+	if closed := len(idle) - len(live); closed > 0 {
+		pool.logDebug("Closed %d idle connections", closed)
+	}
+	pool.returnIdle(live)
+}
+
+// Interval at which the pool checks that it has the minimum number of idle
+// connections, in addition to whenever a connection is checked out or closed
+const minIdleCheckInterval = 5 * time.Second
+
+// Warmup opens connections until the pool has Config.MinIdleConnections idle
+// ones, or as many as MaxConnections and the server's budget allow.  The pool
+// does this in the background anyway; Warmup lets an application wait for it
+// before it starts serving requests.  It returns the first error encountered.
+func (pool *Pool) Warmup() error {
+	for {
+		pool.mutex.Lock()
+		if len(pool.idleConnections) >= int(pool.config.MinIdleConnections) ||
+			len(pool.openConnections) >= int(pool.config.MaxConnections) {
+			pool.mutex.Unlock()
+			return nil
+		}
+		conn, err := pool.createConn(context.Background())
+		if errors.Is(err, ErrBudgetExhausted) {
+			pool.mutex.Unlock()
+			return nil
+		}
+		if err != nil {
+			pool.mutex.Unlock()
+			return err
+		}
+		conn.setState(stateIdle)
+		ok := pool.handOff(conn)
+		pool.mutex.Unlock()
+		if !ok {
+			conn.destroy(DestroyedIdle)
+			return nil
+		}
+	}
+}
+
+// keepMinIdle tops up the pool's idle connections whenever it is woken by
+// wakeKeeper, and periodically in case opening connections failed, until the
+// pool is closed.
+func (pool *Pool) keepMinIdle() {
+	ticker := time.NewTicker(minIdleCheckInterval)
+	defer ticker.Stop()
+	for {
+		pool.Warmup()
+		select {
+		case <-pool.replenish:
+		case <-ticker.C:
+		case <-pool.stop:
+			return
+		}
+	}
+}
+
+// wakeKeeper asks the background task that maintains the minimum number of
+// idle connections to check on them.
+func (pool *Pool) wakeKeeper() {
+	if pool.config.MinIdleConnections > 0 {
+		select {
+		case pool.replenish <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package pool
+
+import (
+	"context"
+	"strconv"
+)
+
+type contextKey int
+
+const (
+	borrowIDKey contextKey = iota
+	tenantKey
+	sessionKey
+)
+
+// BorrowID returns the ID the pool assigned to this checkout of the
+// connection.  Every call to Get (and the functions built on it) hands out a
+// new ID, so log entries, trace spans and tagged queries can be correlated
+// with the exact checkout that produced them.
+func (conn *Conn) BorrowID() uint64 {
+	return conn.borrowID
+}
+
+// Annotate returns a copy of ctx that carries the connection's borrow ID, for
+// use by loggers and tracers further down the call chain.
+func (conn *Conn) Annotate(ctx context.Context) context.Context {
+	return context.WithValue(ctx, borrowIDKey, conn.borrowID)
+}
+
+// BorrowIDFromContext returns the borrow ID stored in ctx by Annotate, if any.
+func BorrowIDFromContext(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(borrowIDKey).(uint64)
+	return id, ok
+}
+
+// tag prefixes SQL with a comment holding the borrow ID if the pool is
+// configured to tag queries.
+func (conn *Conn) tag(sql string) string {
+	if !conn.pool.config.TagQueries {
+		return sql
+	}
+	return "/* borrow:" + strconv.FormatUint(conn.borrowID, 10) + " */ " + sql
+}
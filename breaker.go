@@ -0,0 +1,100 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Default time for which the circuit breaker stops connection attempts
+const defaultCircuitBackoff = 5 * time.Second
+
+// A CircuitOpenError is returned instead of opening a connection while the
+// pool's circuit breaker is open.  It holds the error of the last failed
+// attempt and the time until which no further attempts are made.
+type CircuitOpenError struct {
+	Err   error
+	Until time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s until %s: %v", ErrCircuitOpen, e.Until.Format(time.RFC3339), e.Err)
+}
+
+// Is reports whether target is ErrCircuitOpen.
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// Unwrap returns the error of the last failed connection attempt.
+func (e *CircuitOpenError) Unwrap() error {
+	return e.Err
+}
+
+// A breaker stops a pool from opening connections for a while once too many
+// attempts in a row have failed.
+type breaker struct {
+	mutex     sync.Mutex
+	threshold uint
+	backoff   time.Duration
+	failures  uint
+	lastErr   error
+	openUntil time.Time
+	probing   bool
+}
+
+// newBreaker creates the circuit breaker for a configuration.
+func newBreaker(config *Config) *breaker {
+	b := &breaker{
+		threshold: config.CircuitThreshold,
+		backoff:   time.Duration(config.CircuitBackoff) * time.Second,
+	}
+	if b.backoff == 0 {
+		b.backoff = defaultCircuitBackoff
+	}
+	return b
+}
+
+// allow returns a CircuitOpenError if a connection attempt may not be made.
+// Once the backoff has passed, a single attempt is allowed through as a probe.
+func (b *breaker) allow() error {
+	if b.threshold == 0 {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return &CircuitOpenError{b.lastErr, b.openUntil}
+	}
+	b.probing = true
+	return nil
+}
+
+// report records the outcome of a connection attempt, opening the breaker if
+// too many have failed in a row, in which case it returns true.  Attempts
+// abandoned by the caller aren't counted.
+func (b *breaker) report(err error) (opened bool) {
+	if b.threshold == 0 {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+	switch err {
+	case nil:
+		b.failures = 0
+	case context.Canceled, context.DeadlineExceeded:
+	default:
+		b.failures++
+		b.lastErr = err
+		if b.failures >= b.threshold {
+			b.openUntil = time.Now().Add(b.backoff)
+			opened = true
+		}
+	}
+	return
+}
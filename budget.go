@@ -0,0 +1,135 @@
+package pool
+
+import (
+	"sync"
+)
+
+// A ServerBudget caps the number of connections that several pools in the
+// same process may have open to one server between them, so that pools
+// sized for their own peaks can't together overload it.  Pools share a
+// budget by setting it as their Config.Budget.  When the budget is used up, a
+// pool that needs another connection first closes an idle connection of one
+// of the other pools sharing the budget, and if none has any, Get waits as it
+// does when the pool itself is full, until a connection of any of the pools
+// is closed.  Each pool is still limited to its own MaxConnections as well.
+// Connections removed from a pool with Conn.Detach no longer count.
+type ServerBudget struct {
+	mutex   sync.Mutex
+	max     int
+	open    int
+	pools   []*Pool // the pools sharing the budget
+	blocked []*Pool // pools that couldn't open a connection, to be woken
+}
+
+// NewServerBudget creates a budget that allows up to max connections open at
+// once across the pools that share it.
+func NewServerBudget(max int) *ServerBudget {
+	return &ServerBudget{max: max}
+}
+
+// Size returns the number of connections counted against the budget and the
+// most it allows.
+func (b *ServerBudget) Size() (open, max int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.open, b.max
+}
+
+// attach adds a pool to those sharing the budget.
+func (b *ServerBudget) attach(pool *Pool) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.pools = append(b.pools, pool)
+}
+
+// detach removes a pool that has been closed from those sharing the budget.
+func (b *ServerBudget) detach(pool *Pool) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, p := range b.pools {
+		if p == pool {
+			b.pools = append(b.pools[:i], b.pools[i+1:]...)
+			break
+		}
+	}
+}
+
+// acquire counts a new connection of the given pool against the budget, if
+// the budget allows it.  If not, the pool is woken once a connection has been
+// closed.  A nil budget allows any number of connections.
+func (b *ServerBudget) acquire(pool *Pool) bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.open < b.max {
+		b.open++
+		return true
+	}
+	for _, p := range b.blocked {
+		if p == pool {
+			return false
+		}
+	}
+	b.blocked = append(b.blocked, pool)
+	return false
+}
+
+// release frees the budget taken by a connection that has been closed, and
+// wakes the pools that are waiting for it, which run on their own goroutines
+// so that the caller may hold the lock of its own pool.
+func (b *ServerBudget) release() {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	b.open--
+	blocked := b.blocked
+	b.blocked = nil
+	b.mutex.Unlock()
+	for _, pool := range blocked {
+		go pool.refill()
+	}
+}
+
+// reclaim frees some of the budget by closing an idle connection of one of
+// the pools sharing it other than the given one, and reports whether it
+// found one.  The caller must not hold the lock of any pool.
+func (b *ServerBudget) reclaim(except *Pool) bool {
+	if b == nil {
+		return false
+	}
+	b.mutex.Lock()
+	pools := append([]*Pool(nil), b.pools...)
+	b.mutex.Unlock()
+	for _, pool := range pools {
+		if pool == except {
+			continue
+		}
+		pool.mutex.Lock()
+		conn := pool.popIdle()
+		pool.mutex.Unlock()
+		if conn != nil {
+			conn.destroy(DestroyedIdle)
+			return true
+		}
+	}
+	return false
+}
+
+// refill opens a connection for the callers waiting on the pool, if any, once
+// the server's budget may allow it.
+func (pool *Pool) refill() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if len(pool.openConnections) < int(pool.config.MaxConnections) {
+		pool.replaceConn()
+	}
+}
@@ -0,0 +1,52 @@
+package pool
+
+import (
+	"net/http"
+)
+
+// A Responder is a pooled connection bound to the context of an HTTP request.
+// If the client disconnects while a query is running, the query is killed on
+// the server and the operation fails with the context's error, so that no more
+// work is wasted on an abandoned request:
+//
+//	func handler(w http.ResponseWriter, r *http.Request) {
+//		conn, err := pool.NewResponder(db, r)
+//		if err != nil {
+//			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+//			return
+//		}
+//		defer conn.Release()
+//		rows, _, err := conn.Query("SELECT ...")
+//		...
+//	}
+type Responder struct {
+	*Conn
+}
+
+// NewResponder checks a connection out of the pool and binds it to the
+// request's context until it is released.  If the context carries a tenant ID
+// (see WithTenant), it is applied to the connection.
+func NewResponder(pool *Pool, req *http.Request) (*Responder, error) {
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.bind(req.Context()); err != nil {
+		conn.Release()
+		return nil, err
+	}
+	return &Responder{conn}, nil
+}
+
+// killQuery aborts the statement running on the connection by issuing KILL
+// QUERY from a separate, short-lived connection.
+func (conn *Conn) killQuery() error {
+	threadID := conn.Conn.ThreadId()
+	killer := conn.sideConn()
+	if err := killer.Connect(); err != nil {
+		return err
+	}
+	defer killer.Close()
+	_, _, err := killer.Query("KILL QUERY %d", threadID)
+	return err
+}
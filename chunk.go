@@ -0,0 +1,99 @@
+package pool
+
+import (
+	"fmt"
+	"github.com/ziutek/mymysql/mysql"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QueryInBatches executes a query whose SQL holds a single %s in place of an
+// IN list, such as "SELECT id, name FROM users WHERE id IN (%s)", once for
+// each chunk of at most chunkSize values, and returns the rows of all the
+// chunks together with the result of the last one.  This keeps huge IN lists
+// within max_allowed_packet and out of the optimizer's slow paths.  As with
+// Query, the SQL is a fmt format string, so any other % signs must be doubled.
+// Strings and byte slices are escaped and quoted, nil becomes NULL, and
+// numbers, booleans and times are formatted as literals; values of any other
+// type fail the query before it is sent.  Each chunk is a separate query with
+// its own request timeout, so the chunks don't see a single consistent
+// snapshot unless they are run in a transaction.
+func (conn *Conn) QueryInBatches(sqlTemplate string, values []interface{}, chunkSize int) (rows []mysql.Row, result mysql.Result, err error) {
+	if chunkSize <= 0 {
+		return nil, nil, ErrInvalidChunkSize
+	}
+	for start := 0; start < len(values); start += chunkSize {
+		end := start + chunkSize
+		if end > len(values) {
+			end = len(values)
+		}
+		var list string
+		if list, err = conn.sqlList(values[start:end]); err != nil {
+			return nil, nil, err
+		}
+		var chunk []mysql.Row
+		if chunk, result, err = conn.Query(sqlTemplate, list); err != nil {
+			return nil, nil, err
+		}
+		rows = append(rows, chunk...)
+	}
+	return
+}
+
+// sqlList formats values as a comma-separated list of SQL literals.
+func (conn *Conn) sqlList(values []interface{}) (string, error) {
+	var list strings.Builder
+	for i, value := range values {
+		if i > 0 {
+			list.WriteString(", ")
+		}
+		literal, err := conn.sqlLiteral(value)
+		if err != nil {
+			return "", err
+		}
+		list.WriteString(literal)
+	}
+	return list.String(), nil
+}
+
+// sqlLiteral formats a value as an SQL literal.  Values of string kinds and
+// byte slices are escaped and quoted, nil becomes NULL, times are quoted and
+// numbers and booleans are formatted as they are.  Values of other kinds are
+// rejected rather than formatted with fmt, as a String method could return
+// anything.
+func (conn *Conn) sqlLiteral(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "NULL", nil
+	case time.Time:
+		return v.Format("'2006-01-02 15:04:05.999999'"), nil
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String:
+		return conn.sqlString(v.String()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return conn.sqlString(string(v.Bytes())), nil
+		}
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); !math.IsInf(f, 0) && !math.IsNaN(f) {
+			return strconv.FormatFloat(f, 'g', -1, 64), nil
+		}
+	}
+	return "", fmt.Errorf("Can't use %T as an SQL literal", value)
+}
+
+// sqlString escapes and quotes a string as an SQL literal.
+func (conn *Conn) sqlString(s string) string {
+	return "'" + conn.Conn.Escape(s) + "'"
+}
@@ -0,0 +1,297 @@
+package pool
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Balancer chooses the replica a read-only query is sent to.
+type Balancer interface {
+	// Pick returns one of the given replicas, of which there is at least one.
+	Pick(replicas []*Pool) *Pool
+}
+
+// RoundRobin is a Balancer that uses the replicas in turn.
+type RoundRobin struct {
+	next uint64 // accessed atomically
+}
+
+// Pick returns the next replica in turn.
+func (b *RoundRobin) Pick(replicas []*Pool) *Pool {
+	n := atomic.AddUint64(&b.next, 1) - 1
+	return replicas[n%uint64(len(replicas))]
+}
+
+// LeastConnections is a Balancer that picks the replica with the fewest
+// connections in use, so that slow replicas get less of the load.
+type LeastConnections struct{}
+
+// Pick returns the replica with the fewest connections in use, the first one
+// of those tied.
+func (LeastConnections) Pick(replicas []*Pool) *Pool {
+	var best *Pool
+	fewest := 0
+	for _, replica := range replicas {
+		total, available := replica.Size()
+		if inUse := total - available; best == nil || inUse < fewest {
+			best, fewest = replica, inUse
+		}
+	}
+	return best
+}
+
+// Random is a Balancer that picks a replica at random.
+type Random struct{}
+
+// Pick returns a replica chosen at random.
+func (Random) Pick(replicas []*Pool) *Pool {
+	return replicas[rand.Intn(len(replicas))]
+}
+
+// ClusterConfig configures a ClusterPool.  The embedded Config holds the
+// settings shared by every node, apart from the address; Primary and Replicas
+// are the addresses of the nodes, using Config.Protocol.  Balancer chooses
+// between the replicas, RoundRobin by default.  ReadYourWritesWindow is the
+// number of seconds after a write in a session (see WithSession) for which
+// the session's reads go to the primary, counted from when the connection
+// used for the write is released.  It should be longer than the replicas
+// usually lag behind the primary; if zero, sessions have no effect.
+//
+// If AutoPromote is set, the cluster promotes a replica to primary (see
+// ClusterPool.Promote) when the primary fails its health checks, which are
+// turned on with the default settings if Config.HealthCheck isn't set.  As
+// promotion can't be undone, the primary must fail PromoteAfter health checks
+// in a row, 3 by default, and then a check over a new connection too, before
+// the first replica that is healthy is promoted.  OnPromote, if set, is called
+// after a replica has been promoted, manually or automatically, and is the
+// place to make the new primary's server writable if the cluster's tooling
+// doesn't do it.
+type ClusterConfig struct {
+	Config
+	Primary              string
+	Replicas             []string
+	Balancer             Balancer
+	ReadYourWritesWindow uint
+	AutoPromote          bool
+	PromoteAfter         uint
+	OnPromote            func(old, new *Pool)
+}
+
+// A ClusterPool splits reads and writes between the primary of a replicated
+// cluster and its replicas, keeping a pool for each node.  Writes go to the
+// primary and read-only queries to one of the replicas chosen by the
+// cluster's Balancer, or to the primary if there are no replicas.  Bear in
+// mind that replicas lag behind the primary, so a query that must see the
+// application's own writes should use GetPrimary, or be routed with a
+// session (see WithSession).  A replica can be promoted to primary while the
+// cluster is in use, for failing over without restarting the application.
+type ClusterPool struct {
+	mutex     sync.RWMutex // guards primary and replicas
+	primary   *Pool
+	replicas  []*Pool
+	balancer  Balancer
+	window    time.Duration
+	onPromote func(old, new *Pool)
+	stop      chan struct{}
+
+	// Used only by watchPrimary
+	promoteAfter     uint
+	primaryFailures  uint
+	primaryCheckedAt time.Time
+}
+
+// NewCluster creates a pool for each node of a cluster.  The nodes are named
+// after the configured name, with "primary" or "replica" and the replica's
+// number appended.
+func NewCluster(config ClusterConfig) (*ClusterPool, error) {
+	cluster := &ClusterPool{
+		balancer:  config.Balancer,
+		window:    time.Duration(config.ReadYourWritesWindow) * time.Second,
+		onPromote: config.OnPromote,
+		stop:      make(chan struct{}),
+
+		promoteAfter: config.PromoteAfter,
+	}
+	if cluster.promoteAfter == 0 {
+		cluster.promoteAfter = defaultPromoteAfter
+	}
+	if cluster.balancer == nil {
+		cluster.balancer = &RoundRobin{}
+	}
+	if config.AutoPromote && config.HealthCheck == nil {
+		config.HealthCheck = &HealthChecker{}
+	}
+	node := func(address, name string) (*Pool, error) {
+		if len(config.Name) > 0 {
+			name = config.Name + "-" + name
+		}
+		nodeConfig := config.With(WithAddress(config.Protocol, address), WithName(name))
+		nodeConfig.Addresses = nil
+		return New(nodeConfig)
+	}
+
+	var err error
+	if cluster.primary, err = node(config.Primary, "primary"); err != nil {
+		return nil, err
+	}
+	for i, address := range config.Replicas {
+		replica, err := node(address, "replica"+strconv.Itoa(i+1))
+		if err != nil {
+			cluster.Close()
+			return nil, err
+		}
+		cluster.replicas = append(cluster.replicas, replica)
+	}
+	if config.AutoPromote {
+		go cluster.watchPrimary(config.HealthCheck.interval())
+	}
+	return cluster, nil
+}
+
+// Primary returns the pool for the primary.
+func (cluster *ClusterPool) Primary() *Pool {
+	cluster.mutex.RLock()
+	defer cluster.mutex.RUnlock()
+	return cluster.primary
+}
+
+// Replicas returns the pools for the replicas.
+func (cluster *ClusterPool) Replicas() []*Pool {
+	cluster.mutex.RLock()
+	defer cluster.mutex.RUnlock()
+	return cluster.replicas
+}
+
+// GetPrimary retrieves a connection to the primary, for writes and for reads
+// that must not lag behind them.
+func (cluster *ClusterPool) GetPrimary() (*Conn, error) {
+	return cluster.Primary().Get()
+}
+
+// GetReplica retrieves a connection to a replica chosen by the cluster's
+// Balancer, or to the primary if there are no replicas.
+func (cluster *ClusterPool) GetReplica() (*Conn, error) {
+	return cluster.replica().Get()
+}
+
+// GetFor retrieves a connection on which to run the given SQL: one to a
+// replica if every statement in it is read-only, and one to the primary
+// otherwise.  Like Pool.GetFor, it prefers a connection on which the SQL has
+// already been prepared.
+func (cluster *ClusterPool) GetFor(sql string) (*Conn, error) {
+	pool, _ := cluster.route(context.Background(), sql)
+	return pool.GetFor(sql)
+}
+
+// GetPrimaryContext retrieves a connection to the primary like GetPrimary,
+// giving up waiting for one as soon as ctx is done.  As the connection may be
+// used for writes, it counts as a write in the session carried by ctx, if
+// any, so the session's reads go to the primary until a while after the
+// connection has been released.
+func (cluster *ClusterPool) GetPrimaryContext(ctx context.Context) (*Conn, error) {
+	s := sessionFromContext(ctx)
+	if s != nil {
+		s.wrote()
+	}
+	conn, err := cluster.Primary().GetContext(ctx)
+	if err == nil {
+		conn.session = s
+	}
+	return conn, err
+}
+
+// GetForContext retrieves a connection on which to run the given SQL like
+// GetFor, giving up waiting for one as soon as ctx is done.  If ctx carries a
+// session, SQL that writes is recorded in it, and read-only SQL is sent to
+// the primary rather than a replica if the session has written within the
+// cluster's ReadYourWritesWindow, so that it reads the session's own writes.
+func (cluster *ClusterPool) GetForContext(ctx context.Context, sql string) (*Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pool, writer := cluster.route(ctx, sql)
+	conn, err := pool.getFor(ctx, sql)
+	if err == nil {
+		conn.session = writer
+	}
+	return conn, err
+}
+
+// Close closes the pools of all the nodes, returning the first error.
+func (cluster *ClusterPool) Close() (err error) {
+	cluster.mutex.Lock()
+	defer cluster.mutex.Unlock()
+	select {
+	case <-cluster.stop:
+	default:
+		close(cluster.stop)
+	}
+	for _, pool := range append([]*Pool{cluster.primary}, cluster.replicas...) {
+		if closeErr := pool.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return
+}
+
+// replica returns the pool of the replica chosen by the balancer, or the
+// primary's if there are no replicas.
+func (cluster *ClusterPool) replica() *Pool {
+	cluster.mutex.RLock()
+	primary, replicas := cluster.primary, cluster.replicas
+	cluster.mutex.RUnlock()
+	if len(replicas) == 0 {
+		return primary
+	}
+	return cluster.balancer.Pick(replicas)
+}
+
+// route returns the pool that the given SQL should run on, taking account of
+// the session carried by ctx, if any.  If the SQL writes, that session is
+// returned as the writer, whose write is recorded again once the connection
+// has been released.
+func (cluster *ClusterPool) route(ctx context.Context, sql string) (pool *Pool, writer *session) {
+	s := sessionFromContext(ctx)
+	if !readOnly(sql) {
+		if s != nil {
+			s.wrote()
+		}
+		return cluster.Primary(), s
+	}
+	if s != nil && s.wroteWithin(cluster.window) {
+		return cluster.Primary(), nil
+	}
+	return cluster.replica(), nil
+}
+
+// readOnly reports whether sql consists only of statements that are safe to
+// send to a replica.  Anything it doesn't recognise is assumed to write, so
+// that it goes to the primary.
+func readOnly(sql string) bool {
+	statements := fingerprints(sql)
+	if len(statements) == 0 {
+		return false
+	}
+	for _, fingerprint := range statements {
+		words := strings.Fields(fingerprint)
+		switch words[0] {
+		case "select":
+			// Locking reads and SELECT ... INTO must run on the primary
+			for i, word := range words {
+				if word == "into" || word == "lock" ||
+					(word == "for" && i+1 < len(words) && (words[i+1] == "update" || words[i+1] == "share")) {
+					return false
+				}
+			}
+		case "show", "explain", "describe", "desc":
+		default:
+			return false
+		}
+	}
+	return true
+}
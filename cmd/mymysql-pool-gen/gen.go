@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"go/format"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// generate writes Go source with a typed wrapper for each query.
+func generate(pkg, source string, queries []*query) ([]byte, error) {
+	var buf bytes.Buffer
+	err := fileTemplate.Execute(&buf, struct {
+		Package string
+		Source  string
+		Imports []string
+		Queries []*query
+	}{pkg, source, imports(queries), queries})
+	if err != nil {
+		return nil, err
+	}
+	return format.Source(buf.Bytes())
+}
+
+// imports returns the packages used by the generated code, in order.
+func imports(queries []*query) []string {
+	used := map[string]bool{"github.com/mooncake0525/mymysql-pool": true}
+	for _, q := range queries {
+		if q.Kind == "exec" {
+			used["github.com/ziutek/mymysql/mysql"] = true
+		} else {
+			used["io"] = true
+		}
+		fields := append(append([]field{}, q.Params...), q.Columns...)
+		for _, f := range fields {
+			if strings.Contains(f.Type, "time.") {
+				used["time"] = true
+			}
+			if strings.Contains(f.Type, "mysql.") {
+				used["github.com/ziutek/mymysql/mysql"] = true
+			}
+		}
+	}
+	var paths []string
+	for path := range used {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// exported converts a snake_case or camelCase name into an exported Go name,
+// such as user_id into UserID.
+func exported(name string) string {
+	var out strings.Builder
+	for _, part := range strings.Split(name, "_") {
+		if len(part) == 0 {
+			continue
+		}
+		switch strings.ToLower(part) {
+		case "id", "url", "uuid", "ip", "json", "sql":
+			out.WriteString(strings.ToUpper(part))
+		default:
+			out.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return out.String()
+}
+
+// commentSQL formats SQL as an indented block in a doc comment.
+func commentSQL(sql string) string {
+	return "//\t" + strings.Replace(sql, "\n", "\n//\t", -1)
+}
+
+// unexported converts a name into an unexported Go name, such as user_id into
+// userID and id into id.
+func unexported(name string) string {
+	name = exported(name)
+	upper := 0
+	for upper < len(name) && unicode.IsUpper(rune(name[upper])) {
+		upper++
+	}
+	if upper > 1 && upper < len(name) {
+		// Keep the last capital of a leading initialism, as in IDValue
+		upper--
+	}
+	if upper == 0 {
+		upper = 1
+	}
+	return strings.ToLower(name[:upper]) + name[upper:]
+}
+
+var fileTemplate = template.Must(template.New("file").Funcs(template.FuncMap{
+	"commentSQL": commentSQL,
+	"exported":   exported,
+	"unexported": unexported,
+}).Parse(`// Code generated by mymysql-pool-gen from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+{{- range .Imports}}
+	"{{.}}"
+{{- end}}
+)
+{{range .Queries}}
+const {{unexported .Name}}SQL = {{printf "%q" .SQL}}
+{{if ne .Kind "exec"}}
+// {{.Name}}Row is a row returned by {{.Name}}.
+type {{.Name}}Row struct {
+{{- range .Columns}}
+	{{exported .Name}} {{.Type}}
+{{- end}}
+}
+{{end}}
+// {{.Name}} executes:
+//
+{{commentSQL .SQL}}
+func {{.Name}}(q pool.Querier{{range .Params}}, {{unexported .Name}} {{.Type}}{{end}}) (
+{{- if eq .Kind "one"}}*{{.Name}}Row, error{{else if eq .Kind "many"}}[]{{.Name}}Row, error{{else}}mysql.Result, error{{end}}) {
+	stmt, err := q.Prepare({{unexported .Name}}SQL)
+	if err != nil {
+		return nil, err
+	}
+	res, err := stmt.Run({{range $i, $p := .Params}}{{if $i}}, {{end}}{{unexported $p.Name}}{{end}})
+	if err != nil {
+		return nil, err
+	}
+{{- if eq .Kind "exec"}}
+	return res, nil
+{{- else}}
+	result := res.(*pool.Result)
+{{- if eq .Kind "one"}}
+	var row {{.Name}}Row
+	if err := result.Scan({{range $i, $c := .Columns}}{{if $i}}, {{end}}&row.{{exported $c.Name}}{{end}}); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err := result.End(); err != nil {
+		return nil, err
+	}
+	return &row, nil
+{{- else}}
+	var rows []{{.Name}}Row
+	for {
+		var row {{.Name}}Row
+		if err := result.Scan({{range $i, $c := .Columns}}{{if $i}}, {{end}}&row.{{exported $c.Name}}{{end}}); err != nil {
+			if err == io.EOF {
+				return rows, nil
+			}
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+{{- end}}
+{{- end}}
+}
+{{end}}`))
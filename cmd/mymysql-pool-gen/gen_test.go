@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const queriesSQL = `
+-- Users
+
+-- name: GetUser :one
+-- params: id int64
+-- columns: id int64, name string, created_at time.Time
+SELECT id, name, created_at
+FROM users WHERE id = ?;
+
+-- name: ListUsers :many
+-- columns: id int64, name string
+SELECT id, name FROM users;
+
+-- name: RenameUser :exec
+-- params: name string, id int64
+UPDATE users SET name = ? WHERE id = ?;
+`
+
+func TestParse(t *testing.T) {
+	queries, err := parse(strings.NewReader(queriesSQL))
+	if !assert.NoError(t, err) || !assert.Len(t, queries, 3) {
+		return
+	}
+	assert.Equal(t, &query{
+		Name:    "GetUser",
+		Kind:    "one",
+		SQL:     "SELECT id, name, created_at\nFROM users WHERE id = ?",
+		Params:  []field{{"id", "int64"}},
+		Columns: []field{{"id", "int64"}, {"name", "string"}, {"created_at", "time.Time"}},
+	}, queries[0])
+	assert.Equal(t, "many", queries[1].Kind)
+	assert.Nil(t, queries[2].Columns)
+
+	_, err = parse(strings.NewReader("-- name: Broken :one\nSELECT 1"))
+	assert.EqualError(t, err, "Query Broken returns rows but has no columns annotation")
+	_, err = parse(strings.NewReader("-- name: Broken :some\nSELECT 1"))
+	assert.EqualError(t, err, `Line 1: Unknown query kind ":some"`)
+}
+
+func TestGenerate(t *testing.T) {
+	queries, err := parse(strings.NewReader(queriesSQL))
+	if !assert.NoError(t, err) {
+		return
+	}
+	source, err := generate("models", "queries.sql", queries)
+	if !assert.NoError(t, err) {
+		return
+	}
+	code := string(source)
+	assert.Contains(t, code, "// Code generated by mymysql-pool-gen from queries.sql. DO NOT EDIT.")
+	assert.Contains(t, code, "\t\"time\"\n")
+	assert.Contains(t, code, "CreatedAt time.Time")
+	assert.Contains(t, code, "func GetUser(q pool.Querier, id int64) (*GetUserRow, error) {")
+	assert.Contains(t, code, "func ListUsers(q pool.Querier) ([]ListUsersRow, error) {")
+	assert.Contains(t, code, "func RenameUser(q pool.Querier, name string, id int64) (mysql.Result, error) {")
+	assert.Contains(t, code, "//\tSELECT id, name, created_at\n//\tFROM users WHERE id = ?\n")
+}
+
+func TestExported(t *testing.T) {
+	assert.Equal(t, "UserID", exported("user_id"))
+	assert.Equal(t, "CreatedAt", exported("createdAt"))
+	assert.Equal(t, "userID", unexported("user_id"))
+	assert.Equal(t, "id", unexported("id"))
+	assert.Equal(t, "idValue", unexported("id_value"))
+}
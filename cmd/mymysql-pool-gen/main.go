@@ -0,0 +1,58 @@
+// Command mymysql-pool-gen generates typed Go wrappers for the annotated SQL
+// statements in one or more files, in the style of sqlc.  Each statement
+// becomes a function that takes a pool.Querier (a *pool.Conn or a
+// *pool.Transaction) and the statement's parameters, prepares the statement
+// through the connection's statement cache and returns its rows as structs.
+// It is meant to be run by go generate:
+//
+//	//go:generate go run github.com/mooncake0525/mymysql-pool/cmd/mymysql-pool-gen queries.sql
+//
+// For each input file, such as queries.sql, it writes queries.sql.go in the
+// same directory.  See parse for the annotation format.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	pkg := flag.String("package", os.Getenv("GOPACKAGE"), "package name of the generated code (by default the package running go generate)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-package name] file.sql...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || len(*pkg) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	for _, path := range flag.Args() {
+		if err := generateFile(*pkg, path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			os.Exit(1)
+		}
+	}
+}
+
+// generateFile generates the wrappers for the statements in one SQL file.
+func generateFile(pkg, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	queries, err := parse(in)
+	if err != nil {
+		return err
+	}
+	source, err := generate(pkg, filepath.Base(path), queries)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path+".go", source, 0644)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A query is an annotated statement read from a SQL file.
+type query struct {
+	Name    string
+	Kind    string // one, many or exec
+	SQL     string
+	Params  []field
+	Columns []field
+}
+
+// A field is a named, typed parameter or result column.
+type field struct {
+	Name string
+	Type string
+}
+
+// parse reads the annotated statements in a SQL file.  Each statement is
+// preceded by comments giving its name and kind, and the types of its
+// parameters and result columns:
+//
+//	-- name: GetUser :one
+//	-- params: id int64
+//	-- columns: id int64, name string
+//	SELECT id, name FROM users WHERE id = ?;
+//
+// Other comments are ignored.
+func parse(r io.Reader) ([]*query, error) {
+	var queries []*query
+	var current *query
+	var sql []string
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		current.SQL = strings.TrimSuffix(strings.TrimSpace(strings.Join(sql, "\n")), ";")
+		if len(current.SQL) == 0 {
+			return fmt.Errorf("Query %s has no SQL", current.Name)
+		}
+		if current.Kind != "exec" && len(current.Columns) == 0 {
+			return fmt.Errorf("Query %s returns rows but has no columns annotation", current.Name)
+		}
+		queries = append(queries, current)
+		sql = nil
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "--") {
+			if len(line) > 0 && current == nil {
+				return nil, fmt.Errorf("Line %d: SQL before the first name annotation", lineNum)
+			}
+			sql = append(sql, scanner.Text())
+			continue
+		}
+
+		comment := strings.TrimSpace(strings.TrimPrefix(line, "--"))
+		key, value, ok := strings.Cut(comment, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		var err error
+		switch key {
+		case "name":
+			if err := finish(); err != nil {
+				return nil, err
+			}
+			current, err = parseName(value)
+		case "params":
+			if current != nil {
+				current.Params, err = parseFields(value)
+			}
+		case "columns":
+			if current != nil {
+				current.Columns, err = parseFields(value)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := finish(); err != nil {
+		return nil, err
+	}
+	return queries, nil
+}
+
+// parseName parses the value of a name annotation, such as "GetUser :one".
+func parseName(value string) (*query, error) {
+	parts := strings.Fields(value)
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], ":") {
+		return nil, fmt.Errorf("Expected name and kind, e.g. \"GetUser :one\", got %q", value)
+	}
+	q := &query{Name: parts[0], Kind: strings.TrimPrefix(parts[1], ":")}
+	switch q.Kind {
+	case "one", "many", "exec":
+		return q, nil
+	}
+	return nil, fmt.Errorf("Unknown query kind %q", parts[1])
+}
+
+// parseFields parses a comma-separated list of names and types, such as
+// "id int64, name string".
+func parseFields(value string) ([]field, error) {
+	var fields []field
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.Fields(item)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Expected name and type, got %q", strings.TrimSpace(item))
+		}
+		fields = append(fields, field{parts[0], parts[1]})
+	}
+	return fields, nil
+}
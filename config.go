@@ -0,0 +1,87 @@
+package pool
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Defaults that New applies to the fields of a configuration that are zero
+const (
+	DefaultProtocol       = "tcp"
+	DefaultAddress        = "localhost:3306"
+	DefaultMaxConnections = 10
+	DefaultConnectTimeout = 10 // seconds
+	DefaultRequestTimeout = 30 // seconds
+)
+
+// tenantVariablePattern matches the names allowed for Config.TenantVariable,
+// which is written into SET statements unquoted.
+var tenantVariablePattern = regexp.MustCompile(`^[A-Za-z0-9_$.]+$`)
+
+// Validate checks that the settings of a configuration make sense together,
+// returning the first problem it finds.  New calls it, once it has applied
+// the defaults, so that a bad configuration is reported when the pool is
+// created rather than when it first connects.  Fields that are zero are
+// taken to have their default values.
+func (config Config) Validate() error {
+	config = config.withDefaults()
+	if len(config.Collation) > 0 && len(config.Charset) == 0 {
+		return ErrCollationWithoutCharset
+	}
+	if config.Connector == nil {
+		switch config.Protocol {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			return ErrUnknownProtocol
+		}
+		if len(config.Address) == 0 && len(config.Addresses) == 0 {
+			return ErrNoAddress
+		}
+	}
+	if config.MinIdleConnections > config.MaxConnections {
+		return ErrMinIdleAboveMax
+	}
+	if config.Connector != nil && (config.SSH != nil || len(config.Proxy) > 0) {
+		return ErrConnectorWithTunnel
+	}
+	if len(config.Proxy) > 0 {
+		if config.SSH != nil {
+			return ErrProxyWithSSH
+		}
+		if _, err := parseProxyURL(config.Proxy); err != nil {
+			return err
+		}
+	}
+	if config.SSH != nil && (config.ReadTimeout > 0 || config.WriteTimeout > 0) {
+		return ErrTimeoutsWithSSH
+	}
+	if len(config.TenantVariable) > 0 && !tenantVariablePattern.MatchString(config.TenantVariable) {
+		return ErrInvalidTenantVariable
+	}
+	return nil
+}
+
+// withDefaults returns a copy of the configuration in which the fields that
+// are zero but must not be have their default values.
+func (config Config) withDefaults() Config {
+	if len(config.Protocol) == 0 {
+		config.Protocol = DefaultProtocol
+		if strings.HasPrefix(config.Address, "/") {
+			config.Protocol = "unix"
+		}
+	}
+	if len(config.Address) == 0 && len(config.Addresses) == 0 && config.Connector == nil &&
+		strings.HasPrefix(config.Protocol, "tcp") {
+		config.Address = DefaultAddress
+	}
+	if config.MaxConnections == 0 {
+		config.MaxConnections = DefaultMaxConnections
+	}
+	if config.ConnectTimeout == 0 {
+		config.ConnectTimeout = DefaultConnectTimeout
+	}
+	if config.RequestTimeout == 0 {
+		config.RequestTimeout = DefaultRequestTimeout
+	}
+	return config
+}
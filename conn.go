@@ -1,67 +1,450 @@
 package pool
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/ziutek/mymysql/mysql"
 	"io"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Pool-specific errors
 var (
+	ErrAcquireTimeout          = errors.New("Timeout reached while waiting for SQL connection")
+	ErrBatchTooLarge           = errors.New("Can't check out more connections than the pool allows")
+	ErrBudgetExhausted         = errors.New("Server's connection budget is used up by the pools sharing it")
+	ErrCircuitOpen             = errors.New("Not connecting to the server after repeated failures")
 	ErrCollationWithoutCharset = errors.New("Can't set collation without setting charset")
+	ErrConnClosed              = errors.New("Connection has already been released or destroyed")
+	ErrConcurrentUse           = errors.New("Connection is already being used by another goroutine")
+	ErrConnectorWithTunnel     = errors.New("Can't use a connector together with an SSH tunnel or proxy")
 	ErrConnectionNotInPool     = errors.New("Connection not associated with a pool")
+	ErrConnExpired             = errors.New("Connection reached its maximum age")
+	ErrConnsInUse              = errors.New("Connections were still in use when the pool was closed")
+	ErrDDLBlocked              = errors.New("Long-running transactions may hold metadata locks needed by the DDL statement")
+	ErrDryRun                  = errors.New("Statement can't be rolled back, so it isn't run in dry-run mode")
+	ErrIDRangeUnknown          = errors.New("Can't tell which IDs the INSERT generated for its rows")
+	ErrInvalidBatchSize        = errors.New("Batch size can't be negative")
+	ErrInvalidChunkSize        = errors.New("Chunk size must be positive")
+	ErrInvalidTenantVariable   = errors.New("Tenant variable name may only contain letters, digits, _, $ and .")
+	ErrMarkedBroken            = errors.New("Connection was marked broken")
+	ErrMinIdleAboveMax         = errors.New("Can't keep more idle connections than the pool may open")
+	ErrNoAddress               = errors.New("Address is required to connect to a Unix socket")
+	ErrNoCurrentRow            = errors.New("No row to scan; call Next first")
+	ErrNothingToUpdate         = errors.New("No columns to update")
+	ErrNotReplica              = errors.New("Pool is not a replica of the cluster")
+	ErrPlaceholderCount        = errors.New("Number of arguments doesn't match number of placeholders")
+	ErrPoolClosed              = errors.New("Pool has been closed")
+	ErrPoolExhausted           = errors.New("All of the pool's connections are in use")
+	ErrPoolFull                = errors.New("Pool already has its maximum number of connections")
+	ErrPoolRegistered          = errors.New("A pool is already registered under that name")
+	ErrProxyWithSSH            = errors.New("Can't use both a proxy and an SSH tunnel")
 	ErrRequestTimeout          = errors.New("Query took too long to execute")
+	ErrResultTooLarge          = errors.New("Result set exceeds the pool's size limits")
+	ErrScanColumnCount         = errors.New("Number of scan destinations doesn't match number of columns")
+	ErrStatementDenied         = errors.New("Statement rejected by the pool's statement guard")
+	ErrTimeoutsWithSSH         = errors.New("Can't use read or write timeouts with an SSH tunnel")
+	ErrUnknownPool             = errors.New("No pool registered under that name")
+	ErrUnknownProtocol         = errors.New("Protocol must be tcp, tcp4, tcp6 or unix")
+	ErrUnknownStmt             = errors.New("No statement registered under that name")
+	ErrUpdateWithoutWhere      = errors.New("Can't update without a WHERE condition")
 )
 
+// Connection states
+const (
+	stateIdle int32 = iota
+	stateInUse
+	stateDestroyed
+)
+
+// A ConnClosedError is returned instead of ErrConnClosed when the pool is in
+// debug mode.  It records where the connection was released or destroyed.
+type ConnClosedError struct {
+	Stack []byte
+}
+
+func (e *ConnClosedError) Error() string {
+	return fmt.Sprintf("%s; it was closed at:\n%s", ErrConnClosed, e.Stack)
+}
+
+// Is reports whether target is ErrConnClosed.
+func (e *ConnClosedError) Is(target error) bool {
+	return target == ErrConnClosed
+}
+
+// A ConcurrentUseError is returned when the pool is in debug mode and a
+// connection is used by two goroutines at once.  It records where the
+// operation that was already running was started.
+type ConcurrentUseError struct {
+	Stack []byte
+}
+
+func (e *ConcurrentUseError) Error() string {
+	return fmt.Sprintf("%s; the other operation was started at:\n%s", ErrConcurrentUse, e.Stack)
+}
+
+// Is reports whether target is ErrConcurrentUse.
+func (e *ConcurrentUseError) Is(target error) bool {
+	return target == ErrConcurrentUse
+}
+
+// A PoolError is returned when an operation of the pool fails, wrapping the
+// underlying error so that callers can branch on it with errors.Is and
+// errors.As.  Op is "get" when no connection became available in time,
+// "connect" when a connection couldn't be opened and "close" when the pool
+// had to close connections that were in use.  Pool is the pool's name, which
+// prefixes the error message if it is set.
+type PoolError struct {
+	Pool string
+	Op   string
+	Err  error
+}
+
+func (e *PoolError) Error() string {
+	if len(e.Pool) > 0 {
+		return fmt.Sprintf("Pool %s: %s", e.Pool, e.Err)
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *PoolError) Unwrap() error {
+	return e.Err
+}
+
+// An AcquireTimeoutError is returned, wrapped in a PoolError, when no
+// connection became available within the pool's acquire timeout because all
+// of them were in use.  It holds how long the caller waited and the size of
+// the pool at the time.
+type AcquireTimeoutError struct {
+	Waited    time.Duration
+	Total     int
+	Available int
+	Max       int
+}
+
+func (e *AcquireTimeoutError) Error() string {
+	return fmt.Sprintf("%s (total: %d, avail: %d, max: %d)", ErrAcquireTimeout, e.Total, e.Available, e.Max)
+}
+
+// Is reports whether target is ErrAcquireTimeout or ErrPoolExhausted.
+func (e *AcquireTimeoutError) Is(target error) bool {
+	return target == ErrAcquireTimeout || target == ErrPoolExhausted
+}
+
+// A ConnsInUseError is returned by Close, wrapped in a PoolError, when it had
+// to close connections that were still in use.
+type ConnsInUseError struct {
+	Count int
+}
+
+func (e *ConnsInUseError) Error() string {
+	return fmt.Sprintf("Closed %d connections that were still in use", e.Count)
+}
+
+// Is reports whether target is ErrConnsInUse.
+func (e *ConnsInUseError) Is(target error) bool {
+	return target == ErrConnsInUse
+}
+
+// A ConnExpiredError describes a connection that Get discarded because it had
+// reached its maximum age, or had been recycled, by the time it was checked
+// out.  It holds the connection's age and lifetime statistics.
+type ConnExpiredError struct {
+	Age   time.Duration
+	Stats ConnStats
+}
+
+func (e *ConnExpiredError) Error() string {
+	return fmt.Sprintf("%s after %s, %d borrows and %d requests", ErrConnExpired, e.Age, e.Stats.Borrows, e.Stats.Requests)
+}
+
+// Is reports whether target is ErrConnExpired.
+func (e *ConnExpiredError) Is(target error) bool {
+	return target == ErrConnExpired
+}
+
 // A Conn is a database connection that belongs to a pool.
 type Conn struct {
+	stats ConnStats // accessed atomically; kept first for alignment
 	mysql.Conn
-	pool       *Pool
-	statements map[string]*Stmt
-	expiryDate time.Time
+	pool         *Pool
+	statements   map[string]*Stmt
+	stmtClock    uint64 // counts uses of prepared statements, to find the least recently used one
+	expiresAt    int64
+	createdAt    time.Time
+	state        int32
+	closedStack  atomic.Value
+	sidecars     []*Conn
+	parent       *Conn    // the connection this one is a sidecar of
+	session      *session // the session whose write the connection is used for
+	borrowID     uint64
+	ctx          context.Context
+	database     string
+	useMutex     sync.Mutex
+	useStack     atomic.Value
+	historyMutex sync.Mutex // guards history and historyPos
+	history      []string
+	historyPos   int
+	tenant       bool
+	netConn      atomic.Value // *countingConn
+	idleSince    int64        // Unix nanoseconds, accessed atomically
+	unread       atomic.Value // *unreadResult
+	borrowed     atomic.Value // *borrowRecord
+	address      string
+	adopted      bool
+	masking      *Masking
+	dryRunTx     bool
+	timeout      time.Duration // overrides the pool's request timeout
+	broken       error         // set by MarkBroken
 }
 
-// Release replaces a connection into its pool.
+// Release replaces a connection into its pool.  Any result set that was left
+// unread on the connection is read and discarded first, or if that fails, the
+// connection is closed.  Release happens before the connection is next checked
+// out (see the package documentation), and the connection must not be used
+// once it has been released.
 func (conn *Conn) Release() error {
-	if conn.pool == nil {
+	conn.endWrite()
+	if atomic.LoadInt32(&conn.state) == stateDestroyed {
+		return conn.errClosed()
+	}
+	pool := conn.pool
+	if pool == nil {
 		return ErrConnectionNotInPool
 	}
-	if conn.pool.config.KeepConnectionsAlive {
+	if atomic.LoadInt32(&conn.state) != stateInUse {
+		return conn.errClosed()
+	}
+	conn.ctx = nil
+	if conn.parent != nil {
+		conn.parent.dropSidecar(conn)
+	}
+	conn.releaseSidecars()
+	if conn.broken != nil {
+		pool.logWarn("Closing connection marked broken: %v", conn.broken)
+		conn.destroyInUse(DestroyedBroken)
+		return nil
+	}
+	if conn.drainUnread() != nil || conn.endDryRun() != nil || conn.resetTenant() != nil {
+		conn.destroyInUse(DestroyedOnError)
+		return nil
+	}
+	conn.timeout = 0
+	if pool.config.OnRelease != nil {
+		pool.config.OnRelease(conn)
+		if atomic.LoadInt32(&conn.state) == stateDestroyed {
+			// A query made by the callback failed and destroyed the
+			// connection
+			return nil
+		}
+	}
+	if pool.config.KeepConnectionsAlive && !pool.closed() {
 		if conn.verify() {
-			select {
-			case conn.pool.idleConnections <- conn:
-			default:
-				// Destroy the connection if the idleConnections channel is full
-				conn.Destroy()
+			// Only one of two concurrent calls to Release gets to return
+			// the connection to the pool
+			if conn.changeState(stateInUse, stateIdle) {
+				pool.putIdle(conn)
 			}
 			return nil
 		}
 	}
-	conn.Destroy()
+	conn.destroyInUse(DestroyedOnRelease)
 	return nil
 }
 
-// Destroy closes the connection and removes it from its pool.  A connection
-// must NOT be used after it has been destroyed; doing so will cause a panic.
+// Destroy closes the connection and removes it from its pool.  Any use of the
+// connection after it has been destroyed fails with ErrConnClosed.
 func (conn *Conn) Destroy() {
+	conn.endWrite()
+	conn.destroy(DestroyedByCaller)
+}
+
+// endWrite records the write of the session the connection was checked out
+// for, if any, now that it is done, so that the session's reads go to the
+// primary for the full window after a write that took long.
+func (conn *Conn) endWrite() {
+	if conn.session != nil {
+		conn.session.wrote()
+		conn.session = nil
+	}
+}
+
+// MarkBroken marks the connection as unfit for reuse, for when the caller has
+// evidence the pool can't see, such as session state that a statement was
+// expected to leave behind and didn't.  The connection can still be used until
+// it is released, at which point it is destroyed instead of being returned to
+// the pool.  The reason is logged and can be retrieved with Broken, for
+// instance from the OnDestroy callback, which is called with DestroyedBroken.
+// If reason is nil, ErrMarkedBroken is used.
+func (conn *Conn) MarkBroken(reason error) {
+	if reason == nil {
+		reason = ErrMarkedBroken
+	}
+	conn.broken = reason
+}
+
+// Broken returns the reason given to MarkBroken, or nil if the connection
+// hasn't been marked broken.
+func (conn *Conn) Broken() error {
+	return conn.broken
+}
+
+// destroy closes the connection and removes it from its pool, recording the
+// reason in the pool's statistics.  It does nothing if the connection has
+// already been destroyed, so that a connection destroyed by two goroutines at
+// once is only counted once.
+func (conn *Conn) destroy(reason DestroyReason) {
+	for {
+		state := atomic.LoadInt32(&conn.state)
+		if state == stateDestroyed {
+			return
+		}
+		if conn.changeState(state, stateDestroyed) {
+			break
+		}
+	}
+	conn.teardown(reason)
+}
+
+// destroyInUse destroys the connection like destroy, but only if it is still
+// in use, so that a connection that a concurrent Release has already returned
+// to the pool is left alone.
+func (conn *Conn) destroyInUse(reason DestroyReason) {
+	if conn.changeState(stateInUse, stateDestroyed) {
+		conn.teardown(reason)
+	}
+}
+
+// teardown closes a connection that has just been destroyed and removes it
+// from its pool.
+func (conn *Conn) teardown(reason DestroyReason) {
+	conn.releaseSidecars()
 	if conn.Conn.IsConnected() {
 		conn.Conn.Close()
 	}
 
 	if conn.pool != nil {
 		pool := conn.pool
+		pool.logDebug("Closed connection: %s", reason)
+		if pool.config.OnDestroy != nil {
+			pool.config.OnDestroy(conn, reason)
+		}
 		pool.mutex.Lock()
 		defer pool.mutex.Unlock()
 		delete(pool.openConnections, conn)
+		pool.config.Budget.release()
+		pool.retireStats(conn)
+		pool.updateStats(func(stats *Stats) {
+			stats.Closed++
+			stats.Destroys[reason]++
+		})
 		conn.statements = map[string]*Stmt{}
 		conn.pool = nil
+		pool.replaceConn()
+	}
+}
 
-		if pool.numPending > 0 {
-			if newConn, err := pool.createConn(); err == nil {
-				pool.idleConnections <- newConn
-			}
+// Detach removes the connection from its pool for good and returns the
+// underlying driver connection, which then belongs to the caller.  It is meant
+// for long-lived dedicated uses, such as a replication stream or a session
+// holding LOCK TABLES, that shouldn't tie up a slot in the pool: the slot is
+// freed for a replacement.  Unless it was adopted, the driver connection
+// still dials through the pool when it reconnects, so an SSH tunnel it uses is
+// closed along with the pool, but its traffic is no longer counted in the
+// pool's statistics.  Any later use of the pooled connection fails with
+// ErrConnClosed.
+func (conn *Conn) Detach() (mysql.Conn, error) {
+	if err := conn.checkInUse(); err != nil {
+		return nil, err
+	}
+	if conn.pool == nil {
+		return nil, ErrConnectionNotInPool
+	}
+	if !conn.changeState(stateInUse, stateDestroyed) {
+		return nil, conn.errClosed()
+	}
+	conn.releaseSidecars()
+	conn.unread.Store((*unreadResult)(nil))
+	conn.ctx = nil
+
+	pool := conn.pool
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	delete(pool.openConnections, conn)
+	pool.config.Budget.release()
+	pool.retireStats(conn)
+	pool.updateStats(func(stats *Stats) {
+		stats.Detached++
+	})
+	conn.statements = map[string]*Stmt{}
+	if !conn.adopted {
+		// conn.dial needs conn.pool, which is about to go
+		conn.Conn.SetDialer(pool.dial)
+	}
+	conn.pool = nil
+	pool.replaceConn()
+	return conn.Conn, nil
+}
+
+// replaceConn opens a connection to replace one that has left the pool if
+// callers are waiting for one.  The caller must hold the pool's mutex.
+func (pool *Pool) replaceConn() {
+	if len(pool.waiters) > 0 && !pool.closed() {
+		if newConn, err := pool.createConn(context.Background()); err == nil {
+			newConn.setState(stateIdle)
+			pool.handOff(newConn)
+		}
+	}
+	pool.wakeKeeper()
+}
+
+// Sidecar borrows another connection from the pool for side queries that
+// belong to the same logical operation, such as EXPLAIN, KILL or metadata
+// lookups.  The sidecar is released automatically when this connection is
+// released or destroyed, although it may also be released earlier.  Like Get,
+// Sidecar waits for a free connection if the pool is exhausted.
+func (conn *Conn) Sidecar() (*Conn, error) {
+	if err := conn.checkInUse(); err != nil {
+		return nil, err
+	}
+	sidecar, err := conn.pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	sidecar.parent = conn
+	conn.sidecars = append(conn.sidecars, sidecar)
+	return sidecar, nil
+}
+
+// dropSidecar removes a sidecar that is being released early from the list,
+// so that releasing this connection doesn't release it again once it has been
+// checked out by someone else.
+func (conn *Conn) dropSidecar(sidecar *Conn) {
+	for i, s := range conn.sidecars {
+		if s == sidecar {
+			conn.sidecars = append(conn.sidecars[:i], conn.sidecars[i+1:]...)
+			break
+		}
+	}
+	sidecar.parent = nil
+}
+
+// releaseSidecars releases any sidecars that are still checked out.  Sidecars
+// released early have already been dropped from the list, and those that were
+// destroyed stay destroyed.
+func (conn *Conn) releaseSidecars() {
+	sidecars := conn.sidecars
+	conn.sidecars = nil
+	for _, sidecar := range sidecars {
+		sidecar.parent = nil
+		if atomic.LoadInt32(&sidecar.state) == stateInUse {
+			sidecar.Release()
 		}
 	}
 }
@@ -75,8 +458,11 @@ func (conn *Conn) Connect() error {
 	return conn.prepareConnection()
 }
 
-// Reconnect closes and reopens the connection.
+// Reconnect closes and reopens the connection.  Prepared statements do not
+// survive a reconnect, so the statement cache is cleared.  A database selected
+// with Use is selected again.
 func (conn *Conn) Reconnect() error {
+	conn.statements = map[string]*Stmt{}
 	if err := conn.Conn.Reconnect(); err != nil {
 		return err
 	}
@@ -89,51 +475,264 @@ func (conn *Conn) Reconnect() error {
 // a particular connection.  The time allowed for the statement to be prepared
 // is limited according to the pool's request timeout.
 func (conn *Conn) Prepare(sql string) (stmt mysql.Stmt, err error) {
-	var ok bool
-	if stmt, ok = conn.statements[sql]; !ok {
-		err = conn.withTimeout(func() error {
-			return conn.destroyOnError(func() error {
-				raw, e := conn.Conn.Prepare(sql)
-				if e == nil {
-					s := &Stmt{raw, conn, sql}
-					conn.statements[sql] = s
-					stmt = s
-				}
-				return e
-			})
+	if err = conn.checkInUse(); err != nil {
+		return
+	}
+	if s, ok := conn.statements[sql]; ok {
+		s.touch()
+		return s, nil
+	}
+	conn.stmtClock++
+	if err = conn.guard(sql, nil); err != nil {
+		return
+	}
+	if max := int(conn.pool.config.MaxCachedStatements); max > 0 {
+		for len(conn.statements) >= max {
+			var evicted bool
+			if evicted, err = conn.evictStmt(); err != nil || !evicted {
+				break
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	ctx := conn.Context()
+	err = conn.withTimeout(sql, func() error {
+		return conn.destroyOnError(func() error {
+			start := time.Now()
+			raw, e := conn.Conn.Prepare(sql)
+			conn.pool.traceStmt(ctx, StmtPrepare, sql, start, e)
+			if e == nil {
+				s := &Stmt{raw, conn, sql, conn.stmtClock}
+				conn.statements[sql] = s
+				stmt = s
+			}
+			return e
 		})
+	})
+	return
+}
+
+// evictStmt deletes the least recently used of the connection's cached
+// statements and reports whether there was one to delete.  A statement whose
+// result is still being read is skipped, as deleting it would cut the result
+// off, so the cache may briefly grow past its limit.  The statement leaves the
+// cache even if deleting it fails.
+func (conn *Conn) evictStmt() (bool, error) {
+	var busy string
+	if unread, _ := conn.unread.Load().(*unreadResult); unread != nil {
+		busy = unread.result.sql
+	}
+	var lru *Stmt
+	for _, s := range conn.statements {
+		if s.sql != busy && (lru == nil || s.lastUsed < lru.lastUsed) {
+			lru = s
+		}
+	}
+	if lru == nil {
+		return false, nil
 	}
+	conn.pool.logDebug("Evicting prepared statement: %s", Fingerprint(lru.sql))
+	err := lru.Delete()
+	delete(conn.statements, lru.sql)
+	return true, err
+}
 
-	return
+// Stmt returns the statement registered under the given name with
+// Pool.RegisterStmt, preparing it on this connection the first time it is used
+// and again after a reconnect.
+func (conn *Conn) Stmt(name string) (mysql.Stmt, error) {
+	if err := conn.checkInUse(); err != nil {
+		return nil, err
+	}
+	conn.pool.mutex.Lock()
+	sql, ok := conn.pool.namedStmts[name]
+	conn.pool.mutex.Unlock()
+	if !ok {
+		return nil, ErrUnknownStmt
+	}
+	return conn.Prepare(sql)
 }
 
 // withTimeout executes a function but allows only the given amount of time for it to complete.
-func (conn *Conn) withTimeout(f func() error) (err error) {
-	op := make(chan bool, 1)
+// The SQL (or a description of the operation) is passed to any callbacks.
+func (conn *Conn) withTimeout(sql string, f func() error) error {
+	return conn.withDeadline(sql, conn.startRequest(sql), f)
+}
+
+// withDeadline executes a function as part of a request that began at the given
+// time, allowing it only what remains of the request timeout.  If nothing
+// remains, the connection is closed without running the function.
+func (conn *Conn) withDeadline(sql string, start time.Time, f func() error) error {
+	if err := conn.checkInUse(); err != nil {
+		return err
+	}
+	unlock, err := conn.lockUse()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if conn.ctx != nil && conn.ctx.Err() != nil {
+		return conn.ctx.Err()
+	}
+	remaining := time.Until(start.Add(conn.requestTimeout()))
+	if remaining <= 0 {
+		conn.abort(nil, ErrRequestTimeout)
+		return ErrRequestTimeout
+	}
+	// f may destroy the connection, which detaches it from the pool
+	pool := conn.pool
+	op := make(chan error, 1)
 	go func() {
-		err = f()
-		op <- true
+		op <- f()
 	}()
-	select {
-	case <-op:
+	timeout := time.After(remaining)
+	var softTimeout <-chan time.Time
+	if pool.softTimeout > 0 && pool.config.OnSlowRequest != nil {
+		if soft := time.Until(start.Add(pool.softTimeout)); soft > 0 {
+			softTimeout = time.After(soft)
+		}
+	}
+	for {
+		select {
+		case err := <-op:
+			return err
+		case <-softTimeout:
+			// This runs on the caller's goroutine, so the stack shows where
+			// the slow request came from
+			softTimeout = nil
+			pool.config.OnSlowRequest(conn.Context(), sql, time.Since(start), debug.Stack())
+		case <-conn.done():
+			// The caller has given up, so abort the query on the server and
+			// wait for it to stop so that the connection remains usable
+			if conn.killQuery() == nil {
+				select {
+				case <-op:
+					return conn.ctx.Err()
+				case <-timeout:
+				}
+			}
+			conn.abort(op, conn.ctx.Err())
+			return conn.ctx.Err()
+		case <-timeout:
+			// close connection which also cancels the query on the DB server
+			conn.abort(op, ErrRequestTimeout)
+			pool.logWarn("Request timed out after %s: %s", time.Since(start), Fingerprint(sql))
+			return ErrRequestTimeout
+		}
+	}
+}
+
+// abort gives up on a request.  If the request is still running on another
+// goroutine, which reports on op, only the socket is closed, which makes the
+// request fail, and abort waits for it to, so that the driver is never used
+// by two goroutines at once; should the request have completed regardless,
+// the connection is marked broken with the given reason so that it isn't
+// reused.  Otherwise the connection is closed.
+//
+// With the thread-safe driver, the request may instead be waiting for the
+// driver's lock, held by a result that was left unread, which closing the
+// socket doesn't end and which the driver's Close would wait for too.  So
+// while such a result is outstanding, the socket is closed and nothing is
+// waited for.
+func (conn *Conn) abort(op <-chan error, reason error) {
+	if unread, _ := conn.unread.Load().(*unreadResult); threadSafeDriver && unread != nil {
+		conn.closeSocket()
 		return
-	case <-time.After(conn.pool.requestTimeout):
-		// close connection which also cancels the query on the DB server
-		conn.Close()
-		return ErrRequestTimeout
 	}
+	if op != nil && conn.closeSocket() {
+		<-op
+		if atomic.LoadInt32(&conn.state) != stateDestroyed {
+			conn.MarkBroken(reason)
+		}
+		return
+	}
+	conn.Close()
+}
+
+// lockUse marks the start of an operation on the connection and returns a
+// function that marks its end.  If the pool is configured to serialize use of
+// its connections, an operation waits for any other operation on the same
+// connection to finish.  In debug mode, it fails with a ConcurrentUseError
+// instead.
+func (conn *Conn) lockUse() (func(), error) {
+	config := &conn.pool.config
+	if config.Debug {
+		if !conn.useMutex.TryLock() {
+			stack, _ := conn.useStack.Load().([]byte)
+			return nil, &ConcurrentUseError{stack}
+		}
+		conn.useStack.Store(debug.Stack())
+	} else if config.SerializeConnUse {
+		conn.useMutex.Lock()
+	} else {
+		return func() {}, nil
+	}
+	return conn.useMutex.Unlock, nil
+}
+
+// SetRequestTimeout overrides the pool's request timeout for the requests made
+// on the connection until it is released, so that a slow analytical query can
+// be given longer than the pool allows, or a latency-sensitive one less,
+// without changing the limit for everything else.  A timeout of zero restores
+// the pool's.  As with the pool's timeout, the time a request takes includes
+// reading its result.
+func (conn *Conn) SetRequestTimeout(timeout time.Duration) {
+	conn.timeout = timeout
+}
+
+// requestTimeout returns the time allowed for a request on the connection.
+func (conn *Conn) requestTimeout() time.Duration {
+	if conn.timeout > 0 {
+		return conn.timeout
+	}
+	return conn.pool.requestTimeout
+}
+
+// Context returns the context the connection is bound to, such as the one
+// passed to Pool.Go or to a Context variant of a query method while it runs,
+// or context.Background if there is none.
+func (conn *Conn) Context() context.Context {
+	if conn.ctx == nil {
+		return context.Background()
+	}
+	return conn.ctx
+}
+
+// done returns a channel that is closed when the context the connection is
+// bound to is done, or nil if it isn't bound to one.
+func (conn *Conn) done() <-chan struct{} {
+	if conn.ctx == nil {
+		return nil
+	}
+	return conn.ctx.Done()
 }
 
 // destroyOnError destroys the connection if the given function returns an error
 // that is:
+//   - A protocol error, which is returned as a ProtocolError
 //   - A non-MySQL error other than io.EOF
 //   - A MySQL error with a code greater than 2000 (a client error)
 //   - A MySQL error that indicates a network failure
 //   - A MySQL error that indicates that the server has run out of memory, disk space, etc.
 //   - A MySQL error that indicates that the server is misconfigured, corrupt, or unstable
 func (conn *Conn) destroyOnError(f func() error) error {
+	if err := conn.checkInUse(); err != nil {
+		return err
+	}
+	pool := conn.pool
 	err := f()
 	if err != nil {
+		defer func() {
+			if pool != nil && atomic.LoadInt32(&conn.state) == stateDestroyed {
+				pool.logWarn("Closed connection after error: %v; recent statements:\n%s",
+					err, strings.Join(pool.redactHistory(conn.recentHistory()), "\n"))
+			}
+		}()
+		if isProtocolError(err) {
+			return conn.poison(err)
+		}
 		if mysqlErr, ok := err.(*mysql.Error); ok {
 			switch mysqlErr.Code {
 			case
@@ -179,14 +778,14 @@ func (conn *Conn) destroyOnError(f func() error) error {
 				1548, // Table is probably corrupted
 				1610, // Corrupted replication statement
 				1705: // Statement cache is full
-				conn.Destroy()
+				conn.destroy(DestroyedOnError)
 			default:
 				if mysqlErr.Code >= 2000 {
-					conn.Destroy()
+					conn.destroy(DestroyedOnError)
 				}
 			}
-		} else if err != io.EOF {
-			conn.Destroy()
+		} else if err != io.EOF && err != ErrResultTooLarge {
+			conn.destroy(DestroyedOnError)
 		}
 	}
 	return err
@@ -195,14 +794,24 @@ func (conn *Conn) destroyOnError(f func() error) error {
 // Query executes a query on a connection.
 // The execution time is limited according to the pool's request timeout.
 func (conn *Conn) Query(sql string, params ...interface{}) (rows []mysql.Row, result mysql.Result, err error) {
-	conn.withTimeout(func() error {
-		return conn.destroyOnError(func() error {
-			rows, result, err = conn.Conn.Query(sql, params...)
-			return err
+	if err = conn.guard(sql, params); err != nil {
+		return
+	}
+	pool := conn.pool
+	start := conn.startRequest(sql)
+	err = conn.withDeadline(sql, start, func() error {
+		return conn.destroyOnError(func() (e error) {
+			if result, e = conn.Conn.Start(conn.tag(sql), params...); e == nil {
+				rows, e = conn.getRows(result)
+			}
+			return
 		})
 	})
+	conn.traceOp(pool, "Conn.Query", sql, start, len(rows), err)
 	if err == nil {
-		result = &Result{result, conn}
+		pool.observeQuery(start)
+		result = &Result{result, conn, sql, start, conn.ctx}
+		conn.reportSlowQuery(sql, start)
 	}
 	return
 }
@@ -211,14 +820,24 @@ func (conn *Conn) Query(sql string, params ...interface{}) (rows []mysql.Row, re
 // the result set.  The execution time is limited according to the pool's
 // request timeout.
 func (conn *Conn) QueryFirst(sql string, params ...interface{}) (row mysql.Row, result mysql.Result, err error) {
-	conn.withTimeout(func() error {
-		return conn.destroyOnError(func() error {
-			row, result, err = conn.Conn.QueryFirst(sql, params...)
-			return err
+	if err = conn.guard(sql, params); err != nil {
+		return
+	}
+	pool := conn.pool
+	start := conn.startRequest(sql)
+	err = conn.withDeadline(sql, start, func() error {
+		return conn.destroyOnError(func() (e error) {
+			if row, result, e = conn.Conn.QueryFirst(conn.tag(sql), params...); e == nil {
+				conn.mask(result.Fields(), row)
+			}
+			return
 		})
 	})
+	conn.traceOp(pool, "Conn.QueryFirst", sql, start, rowCount(row), err)
 	if err == nil {
-		result = &Result{result, conn}
+		pool.observeQuery(start)
+		result = &Result{result, conn, sql, start, conn.ctx}
+		conn.reportSlowQuery(sql, start)
 	}
 	return
 }
@@ -227,53 +846,97 @@ func (conn *Conn) QueryFirst(sql string, params ...interface{}) (row mysql.Row,
 // the result set.  The execution time is limited according to the pool's
 // request timeout.
 func (conn *Conn) QueryLast(sql string, params ...interface{}) (row mysql.Row, result mysql.Result, err error) {
-	conn.withTimeout(func() error {
-		return conn.destroyOnError(func() error {
-			row, result, err = conn.Conn.QueryLast(sql, params...)
-			return err
+	if err = conn.guard(sql, params); err != nil {
+		return
+	}
+	pool := conn.pool
+	start := conn.startRequest(sql)
+	err = conn.withDeadline(sql, start, func() error {
+		return conn.destroyOnError(func() (e error) {
+			if row, result, e = conn.Conn.QueryLast(conn.tag(sql), params...); e == nil {
+				conn.mask(result.Fields(), row)
+			}
+			return
 		})
 	})
+	conn.traceOp(pool, "Conn.QueryLast", sql, start, rowCount(row), err)
 	if err == nil {
-		result = &Result{result, conn}
+		pool.observeQuery(start)
+		result = &Result{result, conn, sql, start, conn.ctx}
+		conn.reportSlowQuery(sql, start)
 	}
 	return
 }
 
-// Start initiates a new query.
+// Start initiates a new query.  The pool's request timeout covers both starting
+// the query and reading its result, so a result that is read slowly fails with
+// ErrRequestTimeout once the time is up.
 func (conn *Conn) Start(sql string, params ...interface{}) (result mysql.Result, err error) {
-	conn.withTimeout(func() error {
-		return conn.destroyOnError(func() error {
-			result, err = conn.Conn.Start(sql, params...)
-			return err
+	if err = conn.guard(sql, params); err != nil {
+		return
+	}
+	pool := conn.pool
+	start := conn.startRequest(sql)
+	err = conn.withDeadline(sql, start, func() error {
+		return conn.destroyOnError(func() (e error) {
+			result, e = conn.Conn.Start(conn.tag(sql), params...)
+			return
 		})
 	})
+	conn.traceOp(pool, "Conn.Start", sql, start, -1, err)
 	if err == nil {
-		result = &Result{result, conn}
+		pool.observeQuery(start)
+		r := &Result{result, conn, sql, start, conn.ctx}
+		r.trackUnread()
+		result = r
 	}
 	return
 }
 
 // Begin initiates a new transaction.
 func (conn *Conn) Begin() (trans mysql.Transaction, err error) {
-	conn.withTimeout(func() error {
-		return conn.destroyOnError(func() error {
-			trans, err = conn.Conn.Begin()
-			return err
+	if conn.pool.config.DryRun {
+		// The dry-run transaction stands in for the caller's
+		if err = conn.startDryRun(); err == nil {
+			trans = &Transaction{conn, nil}
+		}
+		return
+	}
+	pool := conn.pool
+	start := conn.startRequest("BEGIN")
+	err = conn.withDeadline("BEGIN", start, func() error {
+		return conn.destroyOnError(func() (e error) {
+			trans, e = beginTransaction(conn.Conn)
+			return
 		})
 	})
+	conn.traceOp(pool, "Conn.Begin", "BEGIN", start, -1, err)
 	if err == nil {
 		trans = &Transaction{conn, trans}
 	}
 	return
 }
 
-// Use selects the database on which queries are executed.
+// Ping checks whether the server is alive.
+// The execution time is limited according to the pool's request timeout.
+func (conn *Conn) Ping() error {
+	return conn.withTimeout("PING", func() error {
+		return conn.destroyOnError(conn.Conn.Ping)
+	})
+}
+
+// Use selects the database on which queries are executed.  The selection
+// survives a reconnect.
 func (conn *Conn) Use(dbname string) error {
-	return conn.withTimeout(func() error {
+	err := conn.withTimeout("USE "+dbname, func() error {
 		return conn.destroyOnError(func() error {
 			return conn.Conn.Use(dbname)
 		})
 	})
+	if err == nil {
+		conn.database = dbname
+	}
+	return err
 }
 
 func (conn *Conn) prepareConnection() error {
@@ -298,22 +961,134 @@ func (conn *Conn) prepareConnection() error {
 		}
 	}
 
+	// after a reconnect, restore the database the connection was using
+	if len(conn.database) > 0 {
+		if err := conn.Use(conn.database); err != nil {
+			return err
+		}
+	}
+
+	if conn.pool.config.InitConnection != nil {
+		return conn.pool.config.InitConnection(conn)
+	}
+
 	return nil
 }
 
 // Is the connection suitable for use?
 func (conn *Conn) verify() bool {
 	if !conn.IsConnected() {
-		conn.Destroy()
+		conn.destroy(DestroyedOnError)
+		return false
+	}
+	// Health checks aren't counted as requests in the connection's statistics
+	if conn.withDeadline("PING", time.Now(), func() error {
+		return conn.destroyOnError(conn.Conn.Ping)
+	}) != nil {
+		conn.destroy(DestroyedOnError)
+		return false
+	}
+	if conn.expired() {
+		conn.destroy(DestroyedExpired)
+		return false
+	}
+	return true
+}
+
+// expired returns true if the connection has passed its expiry date.
+func (conn *Conn) expired() bool {
+	expiresAt := atomic.LoadInt64(&conn.expiresAt)
+	return expiresAt != 0 && time.Now().UnixNano() >= expiresAt
+}
+
+// discardExpired destroys an idle connection that has expired and reports it.
+func (conn *Conn) discardExpired() {
+	pool := conn.pool
+	err := &ConnExpiredError{time.Since(conn.createdAt), conn.Stats()}
+	conn.destroy(DestroyedExpired)
+	pool.updateStats(func(stats *Stats) {
+		stats.ExpiredOnCheckout++
+	})
+	pool.logDebug("Discarded idle connection: %s", err)
+	if pool.config.OnExpired != nil {
+		pool.config.OnExpired(err)
+	}
+}
+
+// retireBy brings the connection's expiry date forward to the given time, if
+// it would otherwise expire later.
+func (conn *Conn) retireBy(t time.Time) {
+	if expiresAt := atomic.LoadInt64(&conn.expiresAt); expiresAt == 0 || t.UnixNano() < expiresAt {
+		atomic.StoreInt64(&conn.expiresAt, t.UnixNano())
+	}
+}
+
+// checkout marks an idle connection as in use, gives it a new borrow ID and
+// verifies it.  A connection that has expired is discarded instead.
+func (conn *Conn) checkout() bool {
+	conn.pool.wakeKeeper()
+	if conn.expired() {
+		conn.discardExpired()
 		return false
 	}
-	if conn.Ping() != nil {
-		conn.Destroy()
+	conn.setState(stateInUse)
+	conn.borrowID = atomic.AddUint64(&conn.pool.borrowCount, 1)
+	atomic.AddUint64(&conn.stats.Borrows, 1)
+	conn.recordBorrow()
+	if !conn.verify() {
 		return false
 	}
-	if conn.pool.connectionExpiry > 0 && time.Now().After(conn.expiryDate) {
-		conn.Destroy()
+	conn.pool.checkedOut(conn)
+	return true
+}
+
+// setState moves the connection into a new state.  In debug mode, the stack is
+// recorded whenever the connection leaves the in-use state.
+func (conn *Conn) setState(state int32) {
+	if state != stateInUse && conn.pool != nil && conn.pool.config.Debug {
+		conn.closedStack.Store(debug.Stack())
+	}
+	if state == stateIdle {
+		atomic.StoreInt64(&conn.idleSince, time.Now().UnixNano())
+	}
+	old := atomic.SwapInt32(&conn.state, state)
+	if conn.pool != nil && (old == stateInUse) != (state == stateInUse) {
+		conn.pool.countInUse(state == stateInUse)
+	}
+}
+
+// changeState moves the connection from the old state into a new one like
+// setState, provided that it is still in the old state, and reports whether
+// it was.  It settles races between goroutines releasing or destroying the
+// same connection.
+func (conn *Conn) changeState(old, state int32) bool {
+	if state == stateIdle {
+		atomic.StoreInt64(&conn.idleSince, time.Now().UnixNano())
+	}
+	if !atomic.CompareAndSwapInt32(&conn.state, old, state) {
 		return false
 	}
+	if state != stateInUse && conn.pool != nil && conn.pool.config.Debug {
+		conn.closedStack.Store(debug.Stack())
+	}
+	if conn.pool != nil && (old == stateInUse) != (state == stateInUse) {
+		conn.pool.countInUse(state == stateInUse)
+	}
 	return true
 }
+
+// checkInUse returns an error if the connection has been released or destroyed.
+func (conn *Conn) checkInUse() error {
+	if atomic.LoadInt32(&conn.state) != stateInUse {
+		return conn.errClosed()
+	}
+	return nil
+}
+
+// errClosed returns the error reported when a closed connection is used.
+func (conn *Conn) errClosed() error {
+	if stack, ok := conn.closedStack.Load().([]byte); ok {
+		return &ConnClosedError{stack}
+	}
+	return ErrConnClosed
+}
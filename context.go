@@ -0,0 +1,120 @@
+package pool
+
+import (
+	"context"
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// The Context variants of the query methods below behave like the plain ones,
+// but if ctx is done before the operation completes, the statement is killed
+// on the server and the context's error is returned.  ctx takes the place of
+// any context the connection is already bound to for the duration of the call.
+// Results returned by StartContext and RunContext remain tied to ctx while
+// they are read.
+
+// QueryContext executes a query on a connection, like Query.
+func (conn *Conn) QueryContext(ctx context.Context, sql string, params ...interface{}) (rows []mysql.Row, result mysql.Result, err error) {
+	err = conn.withContext(ctx, func() (e error) {
+		rows, result, e = conn.Query(sql, params...)
+		return
+	})
+	return
+}
+
+// QueryFirstContext executes a query on a connection, like QueryFirst.
+func (conn *Conn) QueryFirstContext(ctx context.Context, sql string, params ...interface{}) (row mysql.Row, result mysql.Result, err error) {
+	err = conn.withContext(ctx, func() (e error) {
+		row, result, e = conn.QueryFirst(sql, params...)
+		return
+	})
+	return
+}
+
+// QueryLastContext executes a query on a connection, like QueryLast.
+func (conn *Conn) QueryLastContext(ctx context.Context, sql string, params ...interface{}) (row mysql.Row, result mysql.Result, err error) {
+	err = conn.withContext(ctx, func() (e error) {
+		row, result, e = conn.QueryLast(sql, params...)
+		return
+	})
+	return
+}
+
+// StartContext initiates a new query, like Start.
+func (conn *Conn) StartContext(ctx context.Context, sql string, params ...interface{}) (result mysql.Result, err error) {
+	err = conn.withContext(ctx, func() (e error) {
+		result, e = conn.Start(sql, params...)
+		return
+	})
+	return
+}
+
+// PrepareContext returns a prepared statement for the given SQL, like Prepare.
+func (conn *Conn) PrepareContext(ctx context.Context, sql string) (stmt mysql.Stmt, err error) {
+	err = conn.withContext(ctx, func() (e error) {
+		stmt, e = conn.Prepare(sql)
+		return
+	})
+	return
+}
+
+// BeginContext initiates a new transaction, like Begin.
+func (conn *Conn) BeginContext(ctx context.Context) (trans mysql.Transaction, err error) {
+	err = conn.withContext(ctx, func() (e error) {
+		trans, e = conn.Begin()
+		return
+	})
+	return
+}
+
+// PingContext checks whether the server is alive, like Ping.
+func (conn *Conn) PingContext(ctx context.Context) error {
+	return conn.withContext(ctx, conn.Ping)
+}
+
+// RunContext executes a prepared statement without reading its result, like
+// Run.
+func (stmt *Stmt) RunContext(ctx context.Context, params ...interface{}) (result mysql.Result, err error) {
+	err = stmt.conn.withContext(ctx, func() (e error) {
+		result, e = stmt.Run(params...)
+		return
+	})
+	return
+}
+
+// ExecContext executes a prepared statement, like Exec.
+func (stmt *Stmt) ExecContext(ctx context.Context, params ...interface{}) (rows []mysql.Row, result mysql.Result, err error) {
+	err = stmt.conn.withContext(ctx, func() (e error) {
+		rows, result, e = stmt.Exec(params...)
+		return
+	})
+	return
+}
+
+// ExecFirstContext executes a prepared statement, like ExecFirst.
+func (stmt *Stmt) ExecFirstContext(ctx context.Context, params ...interface{}) (row mysql.Row, result mysql.Result, err error) {
+	err = stmt.conn.withContext(ctx, func() (e error) {
+		row, result, e = stmt.ExecFirst(params...)
+		return
+	})
+	return
+}
+
+// ExecLastContext executes a prepared statement, like ExecLast.
+func (stmt *Stmt) ExecLastContext(ctx context.Context, params ...interface{}) (row mysql.Row, result mysql.Result, err error) {
+	err = stmt.conn.withContext(ctx, func() (e error) {
+		row, result, e = stmt.ExecLast(params...)
+		return
+	})
+	return
+}
+
+// withContext calls f with the connection bound to ctx, restoring the previous
+// binding afterwards.
+func (conn *Conn) withContext(ctx context.Context, f func() error) error {
+	prev := conn.ctx
+	conn.ctx = ctx
+	defer func() {
+		conn.ctx = prev
+	}()
+	return f()
+}
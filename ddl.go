@@ -0,0 +1,126 @@
+package pool
+
+import (
+	"fmt"
+	"github.com/ziutek/mymysql/mysql"
+	"time"
+)
+
+// DDL defaults
+const (
+	defaultDDLLockWaitTimeout = 2
+	defaultDDLRetries         = 3
+	defaultDDLRetryDelay      = 5 * time.Second
+)
+
+// DDLOptions configures ExecDDL.  Zero values select the defaults.
+type DDLOptions struct {
+	// MaxTransactionAge is how long a transaction may have been open before
+	// it is assumed to hold metadata locks that would stall the statement.
+	// The default is the lock wait timeout.
+	MaxTransactionAge time.Duration
+
+	// LockWaitTimeout is the number of seconds the statement may wait for a
+	// metadata lock before it gives up, 2 by default.  Keeping it low stops
+	// the statement from queueing every other query on the table behind it.
+	LockWaitTimeout uint
+
+	// Retries is the number of further attempts made if the statement is
+	// blocked, 3 by default, and RetryDelay the time between them, 5 seconds
+	// by default.  Retries count against the pool's retry budget.
+	Retries    int
+	RetryDelay time.Duration
+
+	// NoWait makes ExecDDL give up at once if long-running transactions are
+	// found, rather than waiting for them to finish.
+	NoWait bool
+}
+
+// A DDLBlockedError is returned by ExecDDL when long-running transactions kept
+// it from executing a statement safely.  It lists their server thread IDs.
+type DDLBlockedError struct {
+	ThreadIDs []uint64
+}
+
+func (e *DDLBlockedError) Error() string {
+	return fmt.Sprintf("%s (threads: %v)", ErrDDLBlocked, e.ThreadIDs)
+}
+
+// Is reports whether target is ErrDDLBlocked.
+func (e *DDLBlockedError) Is(target error) bool {
+	return target == ErrDDLBlocked
+}
+
+// ExecDDL executes a schema change such as ALTER TABLE without stalling the
+// rest of the application.  A DDL statement needs an exclusive metadata lock
+// on its table, and while it waits for transactions holding the lock to
+// finish, every other query on the table queues up behind it.  ExecDDL
+// therefore first checks for long-running transactions and then executes the
+// statement with a short lock wait timeout, retrying a few times if it is
+// blocked.
+func (conn *Conn) ExecDDL(sql string, opts DDLOptions) (err error) {
+	if opts.LockWaitTimeout == 0 {
+		opts.LockWaitTimeout = defaultDDLLockWaitTimeout
+	}
+	if opts.MaxTransactionAge == 0 {
+		opts.MaxTransactionAge = time.Duration(opts.LockWaitTimeout) * time.Second
+	}
+	if opts.Retries == 0 {
+		opts.Retries = defaultDDLRetries
+	}
+	if opts.RetryDelay == 0 {
+		opts.RetryDelay = defaultDDLRetryDelay
+	}
+
+	if _, _, err = conn.Query("SET SESSION lock_wait_timeout = %d", opts.LockWaitTimeout); err != nil {
+		return err
+	}
+	defer func() {
+		if _, _, resetErr := conn.Query("SET SESSION lock_wait_timeout = DEFAULT"); err == nil {
+			err = resetErr
+		}
+	}()
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			time.Sleep(opts.RetryDelay)
+		}
+
+		var blockers []uint64
+		if blockers, err = conn.longTransactions(opts.MaxTransactionAge); err != nil {
+			return err
+		}
+		if len(blockers) > 0 {
+			err = &DDLBlockedError{blockers}
+			if opts.NoWait || attempt >= opts.Retries || !conn.pool.AllowRetry() {
+				return err
+			}
+			continue
+		}
+
+		_, _, err = conn.Query(sql)
+		if mysqlErr, ok := err.(*mysql.Error); !ok || mysqlErr.Code != 1205 ||
+			attempt >= opts.Retries || !conn.pool.AllowRetry() {
+			// Done, failed other than by timing out on the lock, or out of
+			// retries
+			return err
+		}
+	}
+}
+
+// longTransactions returns the server thread IDs of the transactions other than
+// the connection's own that have been open for longer than maxAge.
+func (conn *Conn) longTransactions(maxAge time.Duration) ([]uint64, error) {
+	rows, _, err := conn.Query(
+		"SELECT trx_mysql_thread_id FROM information_schema.innodb_trx"+
+			" WHERE trx_started < NOW(6) - INTERVAL %.6f SECOND AND trx_mysql_thread_id <> CONNECTION_ID()",
+		maxAge.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	var threadIDs []uint64
+	for _, row := range rows {
+		threadIDs = append(threadIDs, row.Uint64(0))
+	}
+	return threadIDs, nil
+}
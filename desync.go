@@ -0,0 +1,117 @@
+package pool
+
+import (
+	"fmt"
+	"github.com/ziutek/mymysql/mysql"
+	"strings"
+	"sync/atomic"
+)
+
+// historySize is the number of recent statements each connection remembers
+// when Config.StatementHistory isn't set.
+const historySize = 8
+
+// A ProtocolError is returned when the client and server have lost track of
+// each other's place in the protocol, for instance because packets arrived out
+// of order.  This usually means that the connection was used by two
+// goroutines at once, so the statements most recently sent on the connection
+// are attached, as returned by Conn.History, to help find the culprit.  The
+// connection is destroyed.
+type ProtocolError struct {
+	Err     error
+	History []string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("Protocol error: %s; recent statements:\n%s", e.Err, strings.Join(e.History, "\n"))
+}
+
+// Unwrap returns the error reported by the driver.
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// isProtocolError reports whether err indicates that the protocol stream is out
+// of sync.
+func isProtocolError(err error) bool {
+	switch err {
+	case mysql.ErrSeq, mysql.ErrPkt, mysql.ErrUnkResultPkt, mysql.ErrUnreadedReply, mysql.ErrBadResult:
+		return true
+	}
+	if mysqlErr, ok := err.(*mysql.Error); ok {
+		switch mysqlErr.Code {
+		case
+			1156, // Network packets out of order
+			2014, // Commands out of sync
+			2027: // Malformed packet
+			return true
+		}
+	}
+	return false
+}
+
+// poison destroys a connection whose protocol stream is out of sync, counts
+// the error and returns it as a ProtocolError.
+func (conn *Conn) poison(err error) error {
+	atomic.AddUint64(&conn.pool.protocolErrors, 1)
+	err = &ProtocolError{err, conn.History()}
+	conn.destroy(DestroyedOnError)
+	return err
+}
+
+// recordHistory adds a statement to the connection's history.
+func (conn *Conn) recordHistory(sql string) {
+	conn.historyMutex.Lock()
+	defer conn.historyMutex.Unlock()
+	if conn.history == nil {
+		size := historySize
+		if conn.pool != nil && conn.pool.config.StatementHistory > 0 {
+			size = int(conn.pool.config.StatementHistory)
+		}
+		conn.history = make([]string, size)
+	}
+	conn.history[conn.historyPos%len(conn.history)] = sql
+	conn.historyPos++
+}
+
+// recentHistory returns the statements recently sent on the connection, oldest
+// first.  It may be called while another goroutine is using the connection, as
+// by an OnDestroy callback for a connection destroyed by the pool.
+func (conn *Conn) recentHistory() []string {
+	conn.historyMutex.Lock()
+	defer conn.historyMutex.Unlock()
+	var history []string
+	for i := conn.historyPos - len(conn.history); i < conn.historyPos; i++ {
+		if i >= 0 {
+			history = append(history, conn.history[i%len(conn.history)])
+		}
+	}
+	return history
+}
+
+// History returns the statements most recently sent on the connection, oldest
+// first, redacted as configured by Config.RedactHistory, for reconstructing
+// what led up to an error.  It can still be called from an OnDestroy callback.
+func (conn *Conn) History() []string {
+	return conn.pool.redactHistory(conn.recentHistory())
+}
+
+// redactHistory redacts statements from a connection's history in place with
+// the pool's RedactHistory function, or with Fingerprint if it has none or
+// pool is nil.
+func (pool *Pool) redactHistory(history []string) []string {
+	redact := Fingerprint
+	if pool != nil && pool.config.RedactHistory != nil {
+		redact = pool.config.RedactHistory
+	}
+	for i, sql := range history {
+		history[i] = redact(sql)
+	}
+	return history
+}
+
+// ProtocolErrors returns the number of connections the pool has destroyed
+// because their protocol stream was out of sync.
+func (pool *Pool) ProtocolErrors() uint64 {
+	return atomic.LoadUint64(&pool.protocolErrors)
+}
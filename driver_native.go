@@ -0,0 +1,16 @@
+//go:build !mymysql_thrsafe
+
+package pool
+
+import (
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// threadSafeDriver reports whether connections are made with mymysql's
+// thread-safe driver, which the mymysql_thrsafe build tag selects.
+const threadSafeDriver = false
+
+// beginTransaction begins a transaction on a driver connection.
+func beginTransaction(conn mysql.Conn) (mysql.Transaction, error) {
+	return conn.Begin()
+}
@@ -0,0 +1,49 @@
+//go:build mymysql_thrsafe
+
+package pool
+
+import (
+	"github.com/ziutek/mymysql/mysql"
+	_ "github.com/ziutek/mymysql/thrsafe" // Use the thread-safe driver
+)
+
+// threadSafeDriver reports whether connections are made with mymysql's
+// thread-safe driver, which the mymysql_thrsafe build tag selects.
+const threadSafeDriver = true
+
+// beginTransaction begins a transaction on a driver connection.  The
+// thread-safe driver's transactions lock the connection so that only the
+// transaction may use it, but the pool executes a transaction's statements on
+// the connection itself, so the transaction is managed with plain SQL instead.
+func beginTransaction(conn mysql.Conn) (mysql.Transaction, error) {
+	if _, err := conn.Start("START TRANSACTION"); err != nil {
+		return nil, err
+	}
+	return sqlTransaction{conn}, nil
+}
+
+// A sqlTransaction is a transaction begun with START TRANSACTION on a driver
+// connection.
+type sqlTransaction struct {
+	mysql.Conn
+}
+
+func (t sqlTransaction) Commit() error {
+	_, err := t.Conn.Start("COMMIT")
+	return err
+}
+
+func (t sqlTransaction) Rollback() error {
+	_, err := t.Conn.Start("ROLLBACK")
+	return err
+}
+
+// Do returns the statement as it is, as it already executes on the
+// transaction's connection.
+func (t sqlTransaction) Do(stmt mysql.Stmt) mysql.Stmt {
+	return stmt
+}
+
+func (t sqlTransaction) IsValid() bool {
+	return t.Conn.IsConnected()
+}
@@ -0,0 +1,87 @@
+package pool
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A DryRunError is returned in dry-run mode (see Config.DryRun) for a
+// statement that can't be rolled back.  It holds the statement's fingerprint.
+type DryRunError struct {
+	Fingerprint string
+}
+
+func (e *DryRunError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrDryRun, e.Fingerprint)
+}
+
+// Is reports whether target is ErrDryRun.
+func (e *DryRunError) Is(target error) bool {
+	return target == ErrDryRun
+}
+
+// dryRun prepares the connection for running sql in dry-run mode.  Read-only
+// statements run as usual.  Before the first statement that writes, a
+// transaction is started, which is rolled back when the connection is
+// released, and statements that would end it are rejected.
+func (conn *Conn) dryRun(sql string) error {
+	if conn.pool == nil || !conn.pool.config.DryRun || readOnly(sql) {
+		return nil
+	}
+	for _, fingerprint := range fingerprints(sql) {
+		if endsTransaction(fingerprint) {
+			return &DryRunError{fingerprint}
+		}
+	}
+	return conn.startDryRun()
+}
+
+// startDryRun starts the dry-run transaction, unless it has already been
+// started.
+func (conn *Conn) startDryRun() error {
+	if conn.dryRunTx {
+		return nil
+	}
+	err := conn.execRaw("START TRANSACTION")
+	conn.dryRunTx = err == nil
+	return err
+}
+
+// endDryRun rolls back the dry-run transaction, if it has been started.
+func (conn *Conn) endDryRun() error {
+	if !conn.dryRunTx {
+		return nil
+	}
+	conn.dryRunTx = false
+	return conn.execRaw("ROLLBACK")
+}
+
+// execRaw executes a statement that returns no rows within the request
+// timeout, bypassing the statement guard and dry-run checks.
+func (conn *Conn) execRaw(sql string) error {
+	return conn.withTimeout(sql, func() error {
+		return conn.destroyOnError(func() error {
+			_, _, err := conn.Conn.Query(sql)
+			return err
+		})
+	})
+}
+
+// endsTransaction reports whether a statement with the given fingerprint
+// commits or rolls back the current transaction, whether explicitly or, like
+// DDL, implicitly.
+func endsTransaction(fingerprint string) bool {
+	words := strings.Fields(fingerprint)
+	switch words[0] {
+	case "create", "drop":
+		return len(words) < 2 || words[1] != "temporary"
+	case "rollback":
+		return len(words) < 2 || words[1] != "to"
+	case "set":
+		return strings.Contains(fingerprint, "autocommit")
+	case "alter", "analyze", "begin", "cache", "commit", "flush", "grant", "install", "lock",
+		"optimize", "rename", "repair", "reset", "revoke", "start", "truncate", "uninstall", "unlock", "xa":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package pool
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// A waiter is a call to Get, or one of its variants, that is waiting for a
+// connection to become available.  Connections are handed to waiters over
+// ready.
+type waiter struct {
+	since time.Time
+	stack []byte
+	ready chan *Conn
+}
+
+// newWaiter records a caller that began waiting at the given time.  In debug
+// mode, its stack is recorded too.
+func (pool *Pool) newWaiter(since time.Time) *waiter {
+	w := &waiter{since: since, ready: make(chan *Conn, 1)}
+	if pool.config.Debug {
+		w.stack = debug.Stack()
+	}
+	return w
+}
+
+// A borrowRecord describes the current checkout of a connection.
+type borrowRecord struct {
+	id       uint64
+	at       time.Time
+	stack    []byte
+	reported bool // only accessed by the background check for leaks
+}
+
+// recordBorrow notes that the connection has just been checked out.  In debug
+// mode, or if leaks are being tracked, the stack of the code that checked it
+// out is recorded too.
+func (conn *Conn) recordBorrow() {
+	record := &borrowRecord{id: conn.borrowID, at: time.Now()}
+	if conn.pool.config.Debug || conn.pool.trackLeaks() {
+		record.stack = debug.Stack()
+	}
+	conn.borrowed.Store(record)
+}
+
+// connSnapshot is the state of a connection as captured by Dump.
+type connSnapshot struct {
+	state     int32
+	createdAt time.Time
+	idleSince time.Time
+	borrow    *borrowRecord
+	requests  uint64
+	unread    *unreadResult
+}
+
+// Dump writes a snapshot of the pool's internal state to w in a readable form,
+// for attaching to bug reports about applications that hang waiting for
+// connections.  It lists the callers waiting for a connection, the connections
+// in use with the time they have been held, longest first, and the idle
+// connections with the time they have been idle, followed by the pool's
+// configuration, without the password, and statistics.  The connections and
+// waiters are copied while holding the pool's lock, which is released before
+// anything is written, so the snapshot is consistent and Dump is safe to call
+// however busy the pool is, even if w is slow.  In debug mode (Config.Debug),
+// the stacks of the waiting callers and of the code that checked out each
+// connection in use are included; the latter are also included when leaks are
+// being tracked (Config.LeakWarningThreshold).
+func (pool *Pool) Dump(w io.Writer) error {
+	stats := pool.Stats()
+	now := time.Now()
+
+	pool.mutex.Lock()
+	waiters := append([]*waiter(nil), pool.waiters...)
+	conns := make([]connSnapshot, 0, len(pool.openConnections))
+	for conn := range pool.openConnections {
+		snapshot := connSnapshot{
+			state:     atomic.LoadInt32(&conn.state),
+			createdAt: conn.createdAt,
+			idleSince: time.Unix(0, atomic.LoadInt64(&conn.idleSince)),
+			requests:  atomic.LoadUint64(&conn.stats.Requests),
+		}
+		snapshot.borrow, _ = conn.borrowed.Load().(*borrowRecord)
+		snapshot.unread, _ = conn.unread.Load().(*unreadResult)
+		conns = append(conns, snapshot)
+	}
+	closed := pool.closed()
+	pool.mutex.Unlock()
+
+	var inUse, idle []connSnapshot
+	for _, conn := range conns {
+		switch {
+		case conn.state == stateInUse && conn.borrow != nil:
+			inUse = append(inUse, conn)
+		case conn.state == stateIdle:
+			idle = append(idle, conn)
+		}
+	}
+	sort.Slice(inUse, func(i, j int) bool {
+		return inUse[i].borrow.at.Before(inUse[j].borrow.at)
+	})
+	sort.Slice(idle, func(i, j int) bool {
+		return idle[i].idleSince.Before(idle[j].idleSince)
+	})
+
+	var buf bytes.Buffer
+	name := pool.config.Name
+	if len(name) == 0 {
+		name = "(unnamed)"
+	}
+	fmt.Fprintf(&buf, "Pool %s at %s", name, now.Format(time.RFC3339Nano))
+	if closed {
+		buf.WriteString(" (closed)")
+	}
+	fmt.Fprintf(&buf, "\n%d open of %d, %d in use, %d idle, %d waiting\n",
+		len(conns), pool.config.MaxConnections, len(inUse), len(idle), len(waiters))
+
+	fmt.Fprintf(&buf, "\nWaiting (%d):\n", len(waiters))
+	for _, w := range waiters {
+		fmt.Fprintf(&buf, "  for %s\n", now.Sub(w.since))
+		writeStack(&buf, w.stack)
+	}
+
+	fmt.Fprintf(&buf, "\nIn use (%d):\n", len(inUse))
+	for _, conn := range inUse {
+		fmt.Fprintf(&buf, "  borrow %d held for %s, open for %s, %d requests\n",
+			conn.borrow.id, now.Sub(conn.borrow.at), now.Sub(conn.createdAt), conn.requests)
+		if conn.unread != nil {
+			fmt.Fprintf(&buf, "    result left unread for %s: %s\n", now.Sub(conn.unread.since), conn.unread.result.sql)
+		}
+		writeStack(&buf, conn.borrow.stack)
+	}
+	fmt.Fprintf(&buf, "\nIdle (%d):\n", len(idle))
+	for _, conn := range idle {
+		fmt.Fprintf(&buf, "  idle for %s, open for %s, %d requests\n",
+			now.Sub(conn.idleSince), now.Sub(conn.createdAt), conn.requests)
+	}
+
+	config := pool.endpoint()
+	fmt.Fprintf(&buf, "\nConfig:\n")
+	fmt.Fprintf(&buf, "  address %s %s, user %q, database %q\n", config.Protocol, config.Address, config.Username, config.Database)
+	if len(config.Addresses) > 0 {
+		for _, host := range pool.Hosts() {
+			fmt.Fprintf(&buf, "  host %s healthy %t, %d failures\n", host.Address, host.Healthy, host.Failures)
+		}
+	}
+	fmt.Fprintf(&buf, "  max connections %d, min idle %d, keep alive %t\n", config.MaxConnections, config.MinIdleConnections, config.KeepConnectionsAlive)
+	fmt.Fprintf(&buf, "  max age %ds, max idle %ds, connect timeout %ds, acquire timeout %s, request timeout %ds\n",
+		config.MaxConnectionAge, config.MaxIdleTime, config.ConnectTimeout, pool.acquireTimeout, config.RequestTimeout)
+	fmt.Fprintf(&buf, "  serialize use %t, debug %t\n", config.SerializeConnUse, config.Debug)
+
+	fmt.Fprintf(&buf, "\nStats:\n")
+	fmt.Fprintf(&buf, "  gets %d, waits %d (%s), timeouts %d\n", stats.Gets, stats.Waits, stats.WaitDuration, stats.Timeouts)
+	fmt.Fprintf(&buf, "  opened %d, closed %d, max in use %d, protocol errors %d\n", stats.Opened, stats.Closed, stats.MaxInUse, stats.ProtocolErrors)
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeStack writes an indented stack trace, if one was recorded.
+func writeStack(buf *bytes.Buffer, stack []byte) {
+	if len(stack) == 0 {
+		return
+	}
+	for _, line := range bytes.Split(bytes.TrimRight(stack, "\n"), []byte("\n")) {
+		buf.WriteString("    ")
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+}
@@ -0,0 +1,95 @@
+// Command webapp is a small web application that shows the recommended way of
+// using a connection pool: one pool for the whole process, configured with
+// options, and a connection per request provided by poolhttp.Middleware.
+//
+// It expects a MySQL server with a database holding a table such as:
+//
+//	CREATE TABLE users (id INT PRIMARY KEY, name VARCHAR(100) NOT NULL);
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/mooncake0525/mymysql-pool"
+	"github.com/mooncake0525/mymysql-pool/poolhttp"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	dbAddr := flag.String("db", "127.0.0.1:3306", "address of the MySQL server")
+	user := flag.String("user", "root", "MySQL user")
+	password := flag.String("password", "", "MySQL password")
+	database := flag.String("database", "test", "MySQL database")
+	flag.Parse()
+
+	db, err := pool.New(
+		pool.WithName("webapp"),
+		pool.WithAddress("tcp", *dbAddr),
+		pool.WithCredentials(*user, *password),
+		pool.WithDatabase(*database),
+		pool.WithCharset("utf8mb4", ""),
+		pool.WithMaxConns(20),
+		pool.WithConnectTimeout(2),
+		pool.WithTimeout(10),
+		pool.WithKeepAlive(true),
+		pool.WithMaxConnectionAge(3600),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.RegisterStmt("user", "SELECT name FROM users WHERE id = ?")
+
+	// Only the routes that need a connection of their own go through the
+	// middleware
+	mux := http.NewServeMux()
+	mux.Handle("/users/", poolhttp.Middleware(db, http.HandlerFunc(getUser)))
+	mux.HandleFunc("/health", health(db))
+
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+// getUser looks up a user by ID, using the connection checked out for the
+// request.
+func getUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Path[len("/users/"):])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	conn := poolhttp.ConnFromContext(r.Context())
+	stmt, err := conn.Stmt("user")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	row, _, err := stmt.ExecFirst(id)
+	if err != nil {
+		// The query fails with the context's error if the client went away
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if row == nil {
+		http.NotFound(w, r)
+		return
+	}
+	io.WriteString(w, row.Str(0))
+}
+
+// health reports whether the database is reachable.  It uses the pool directly
+// rather than a per-request connection.
+func health(db *pool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		elapsed, err := db.Ping()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		total, available := db.Size()
+		fmt.Fprintf(w, "ok: ping %s, %d connections (%d idle)\n", elapsed, total, available)
+	}
+}
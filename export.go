@@ -0,0 +1,120 @@
+package pool
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+)
+
+// MarshalJSON encodes the statistics as a JSON object with a member for each
+// field, so that they can be saved across restarts or sent to a collector
+// that aggregates them from several processes.  Destroys is keyed by the
+// names of the reasons, such as "expired", and durations are in nanoseconds.
+func (stats Stats) MarshalJSON() ([]byte, error) {
+	type plain Stats
+	destroys := make(map[string]uint64, len(stats.Destroys))
+	for reason, n := range stats.Destroys {
+		destroys[reason.String()] = n
+	}
+	return json.Marshal(struct {
+		plain
+		Destroys map[string]uint64
+	}{plain(stats), destroys})
+}
+
+// UnmarshalJSON decodes statistics encoded by MarshalJSON.
+func (stats *Stats) UnmarshalJSON(data []byte) error {
+	type plain Stats
+	decoded := struct {
+		*plain
+		Destroys map[string]uint64
+	}{plain: (*plain)(stats)}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	stats.Destroys = make(map[DestroyReason]uint64, len(decoded.Destroys))
+	for name, n := range decoded.Destroys {
+		reason, ok := parseDestroyReason(name)
+		if !ok {
+			return fmt.Errorf("Unknown destroy reason %q", name)
+		}
+		stats.Destroys[reason] = n
+	}
+	return nil
+}
+
+// parseDestroyReason returns the reason with the given name.
+func parseDestroyReason(name string) (DestroyReason, bool) {
+	for reason := DestroyedByCaller; reason <= DestroyedBroken; reason++ {
+		if reason.String() == name {
+			return reason, true
+		}
+	}
+	return 0, false
+}
+
+// Merge adds the statistics in other to stats, for combining the statistics
+// of several processes.  The counters, durations and histograms are added up,
+// as is InUse, the number of connections the processes have in use between
+// them.  MaxInUse, which can't be combined exactly, becomes the larger of the
+// two, and the retry budget's Tokens is left as it was.
+func (stats *Stats) Merge(other Stats) {
+	stats.Gets += other.Gets
+	stats.Waits += other.Waits
+	stats.WaitDuration += other.WaitDuration
+	stats.Timeouts += other.Timeouts
+	stats.Opened += other.Opened
+	stats.Closed += other.Closed
+	if stats.Destroys == nil {
+		stats.Destroys = map[DestroyReason]uint64{}
+	}
+	for reason, n := range other.Destroys {
+		stats.Destroys[reason] += n
+	}
+	stats.IdleEvictions += other.IdleEvictions
+	stats.ExpiredOnCheckout += other.ExpiredOnCheckout
+	stats.Detached += other.Detached
+	stats.Leaks += other.Leaks
+	stats.InUse += other.InUse
+	if other.MaxInUse > stats.MaxInUse {
+		stats.MaxInUse = other.MaxInUse
+	}
+	for i, n := range other.QueryLatency {
+		stats.QueryLatency[i] += n
+	}
+	stats.QueryDuration += other.QueryDuration
+	stats.ProtocolErrors += other.ProtocolErrors
+	stats.Retry.Allowed += other.Retry.Allowed
+	stats.Retry.Denied += other.Retry.Denied
+	stats.Stmt.add(other.Stmt)
+	stats.Conn.add(other.Conn)
+}
+
+// add adds the counters and durations in other to stats.
+func (stats *StmtStats) add(other StmtStats) {
+	for _, phase := range []struct{ dst, src *PhaseStats }{
+		{&stats.Prepare, &other.Prepare},
+		{&stats.Execute, &other.Execute},
+		{&stats.Fetch, &other.Fetch},
+	} {
+		phase.dst.Count += phase.src.Count
+		phase.dst.Errors += phase.src.Errors
+		phase.dst.Duration += phase.src.Duration
+	}
+}
+
+// ImportStats adds statistics exported earlier, typically those the previous
+// run of the process saved when it shut down, to the pool's own, so that its
+// counters carry on from where they left off.  InUse isn't imported, as the
+// connections it counted are gone, and MaxInUse becomes the larger of the two.
+func (pool *Pool) ImportStats(stats Stats) {
+	stats.InUse = 0
+	pool.statsMutex.Lock()
+	pool.stats.Merge(stats)
+	pool.retryStats.Allowed += stats.Retry.Allowed
+	pool.retryStats.Denied += stats.Retry.Denied
+	pool.stmtStats.add(stats.Stmt)
+	pool.retiredStats.add(stats.Conn)
+	pool.statsMutex.Unlock()
+	atomic.AddUint64(&pool.protocolErrors, stats.ProtocolErrors)
+}
@@ -0,0 +1,145 @@
+package pool
+
+import (
+	"sync"
+	"time"
+)
+
+// Failover defaults
+const (
+	defaultFailoverThreshold     = 3
+	defaultFailoverProbeInterval = 30 * time.Second
+)
+
+// HostStatus describes the health of one of the servers listed in
+// Config.Addresses.  Failures is the number of connection attempts in a row
+// that have failed.
+type HostStatus struct {
+	Address  string
+	Healthy  bool
+	Failures uint
+}
+
+// hostList tracks the health of the servers a pool can connect to, in order
+// of preference.
+type hostList struct {
+	mutex     sync.Mutex
+	hosts     []HostStatus
+	threshold uint
+}
+
+// newHostList creates the host list for a configuration.  All the hosts start
+// out healthy.
+func newHostList(config *Config) *hostList {
+	list := &hostList{threshold: config.FailoverThreshold}
+	if list.threshold == 0 {
+		list.threshold = defaultFailoverThreshold
+	}
+	addresses := config.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{config.Address}
+	}
+	for _, address := range addresses {
+		list.hosts = append(list.hosts, HostStatus{Address: address, Healthy: true})
+	}
+	return list
+}
+
+// reset replaces the hosts with those of a new configuration, which all start
+// out healthy.
+func (list *hostList) reset(config *Config) {
+	hosts := newHostList(config).hosts
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.hosts = hosts
+}
+
+// pick returns the address of the most preferred healthy host, or of the most
+// preferred host if none are healthy.
+func (list *hostList) pick() string {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	return list.hosts[list.current()].Address
+}
+
+// current returns the index of the host new connections are opened to.  The
+// caller must hold the list's mutex.
+func (list *hostList) current() int {
+	for i, host := range list.hosts {
+		if host.Healthy {
+			return i
+		}
+	}
+	return 0
+}
+
+// report records the outcome of an attempt to connect to a host.  A host is
+// marked unhealthy once too many attempts in a row have failed, in which case
+// report returns true.
+func (list *hostList) report(address string, err error) (failed bool) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	for i := range list.hosts {
+		host := &list.hosts[i]
+		if host.Address != address {
+			continue
+		}
+		if err == nil {
+			host.Failures = 0
+			host.Healthy = true
+		} else if host.Failures++; host.Failures >= list.threshold && host.Healthy && len(list.hosts) > 1 {
+			host.Healthy = false
+			failed = true
+		}
+	}
+	return
+}
+
+// unhealthy returns the addresses of the hosts that are marked unhealthy.
+func (list *hostList) unhealthy() []string {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	var addresses []string
+	for _, host := range list.hosts {
+		if !host.Healthy {
+			addresses = append(addresses, host.Address)
+		}
+	}
+	return addresses
+}
+
+// Hosts returns the health of the servers listed in Config.Addresses, in order
+// of preference.
+func (pool *Pool) Hosts() []HostStatus {
+	pool.hosts.mutex.Lock()
+	defer pool.hosts.mutex.Unlock()
+	return append([]HostStatus(nil), pool.hosts.hosts...)
+}
+
+// probeHosts tries to connect to each unhealthy host, and marks those that
+// accept the connection healthy again.  If that restores a host that is
+// preferred over the one in use, the pool's connections are recycled so that
+// they move back to it.
+func (pool *Pool) probeHosts() {
+	pool.hosts.mutex.Lock()
+	before := pool.hosts.current()
+	pool.hosts.mutex.Unlock()
+
+	for _, address := range pool.hosts.unhealthy() {
+		probe := pool.newDriverConn(address)
+		err := probe.Connect()
+		if err == nil {
+			probe.Close()
+			pool.logInfo("%s is healthy again", address)
+		}
+		pool.hosts.report(address, err)
+	}
+
+	pool.hosts.mutex.Lock()
+	after := pool.hosts.current()
+	address := pool.hosts.hosts[after].Address
+	pool.hosts.mutex.Unlock()
+	if after < before {
+		pool.Recycle("Failing back to " + address)
+	}
+}
@@ -0,0 +1,188 @@
+package pool
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A StatementGuard restricts the statements a pool sends to the server, as a
+// safety net for credentials that are shared between applications.  Its rules
+// are regular expressions matched against the fingerprint of each statement
+// (see Fingerprint), so they needn't allow for letter case, comments or literal
+// values.  A statement is rejected if it matches any of the Deny rules, or if
+// there are Allow rules and it matches none of them.  For example, to stop an
+// OLTP pool from dropping or truncating tables:
+//
+//	config.StatementGuard = &pool.StatementGuard{
+//		Deny: []*regexp.Regexp{regexp.MustCompile(`^(drop|truncate)\b`)},
+//	}
+type StatementGuard struct {
+	Allow []*regexp.Regexp
+	Deny  []*regexp.Regexp
+}
+
+// A StatementDeniedError is returned when a pool's statement guard rejects a
+// statement.  It holds the fingerprint of the offending statement.
+type StatementDeniedError struct {
+	Fingerprint string
+}
+
+func (e *StatementDeniedError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrStatementDenied, e.Fingerprint)
+}
+
+// Is reports whether target is ErrStatementDenied.
+func (e *StatementDeniedError) Is(target error) bool {
+	return target == ErrStatementDenied
+}
+
+// Check returns a StatementDeniedError if the guard rejects any of the
+// statements in sql.
+func (g *StatementGuard) Check(sql string) error {
+	for _, fingerprint := range fingerprints(sql) {
+		if !g.allows(fingerprint) {
+			return &StatementDeniedError{fingerprint}
+		}
+	}
+	return nil
+}
+
+// allows reports whether the guard's rules allow a statement with the given
+// fingerprint.
+func (g *StatementGuard) allows(fingerprint string) bool {
+	for _, rule := range g.Deny {
+		if rule.MatchString(fingerprint) {
+			return false
+		}
+	}
+	if len(g.Allow) == 0 {
+		return true
+	}
+	for _, rule := range g.Allow {
+		if rule.MatchString(fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// guard checks SQL about to be sent on the connection, with any parameters
+// substituted, against the pool's statement guard, and prepares for it in
+// dry-run mode.
+func (conn *Conn) guard(sql string, params []interface{}) error {
+	if conn.pool == nil || (conn.pool.config.StatementGuard == nil && !conn.pool.config.DryRun) {
+		return nil
+	}
+	if len(params) > 0 {
+		sql = fmt.Sprintf(sql, params...)
+	}
+	if guard := conn.pool.config.StatementGuard; guard != nil {
+		if err := guard.Check(sql); err != nil {
+			return err
+		}
+	}
+	return conn.dryRun(sql)
+}
+
+// Fingerprint normalizes SQL so that statements which differ only in their
+// literal values, comments, whitespace and the letter case of unquoted words
+// have the same fingerprint.  For example, "SELECT name FROM users WHERE id = 42" becomes
+// "select name from users where id = ?".  The fingerprints of multiple
+// statements are separated by "; ".
+func Fingerprint(sql string) string {
+	return strings.Join(fingerprints(sql), "; ")
+}
+
+// fingerprints returns the fingerprints of the statements in sql.  The
+// contents of MySQL's executable comments, /*! ... */, are treated as part of
+// the statement, as the server executes them.
+func fingerprints(sql string) []string {
+	var statements []string
+	var b strings.Builder
+	space := false
+	emit := func(s string) {
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteString(s)
+	}
+	finish := func() {
+		if b.Len() > 0 {
+			statements = append(statements, b.String())
+		}
+		b.Reset()
+		space = false
+	}
+
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+		switch {
+		case c == ';':
+			finish()
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space = true
+		case c == '#' || (c == '-' && strings.HasPrefix(sql[i:], "-- ")):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			space = true
+		case strings.HasPrefix(sql[i:], "/*!"):
+			// Skip the version number and keep the contents
+			i += 3
+			for i < len(sql) && sql[i] >= '0' && sql[i] <= '9' {
+				i++
+			}
+			i--
+			space = true
+		case strings.HasPrefix(sql[i:], "/*"):
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				i = len(sql)
+			} else {
+				i += end + 3
+			}
+			space = true
+		case strings.HasPrefix(sql[i:], "*/"):
+			// The end of an executable comment
+			i++
+			space = true
+		case c == '\'' || c == '"':
+			// A doubled quote doesn't end the literal
+			for i++; i < len(sql) && (sql[i] != c || (i+1 < len(sql) && sql[i+1] == c)); i++ {
+				if sql[i] == '\\' || sql[i] == c {
+					i++
+				}
+			}
+			emit("?")
+		case c == '`':
+			end := strings.IndexByte(sql[i+1:], '`')
+			if end < 0 {
+				end = len(sql) - i - 1
+			}
+			emit(sql[i : i+end+2])
+			i += end + 1
+		case isDigit(c) && (i == 0 || !isWordChar(sql[i-1])):
+			for i+1 < len(sql) && (isWordChar(sql[i+1]) || sql[i+1] == '.') {
+				i++
+			}
+			emit("?")
+		case c >= 'A' && c <= 'Z':
+			emit(string(c + 'a' - 'A'))
+		default:
+			emit(sql[i : i+1])
+		}
+	}
+	finish()
+	return statements
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// isWordChar reports whether c can be part of an unquoted identifier.
+func isWordChar(c byte) bool {
+	return isDigit(c) || c == '_' || c == '$' || (c|0x20 >= 'a' && c|0x20 <= 'z') || c >= 0x80
+}
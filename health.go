@@ -0,0 +1,167 @@
+package pool
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Default interval between health checks
+const defaultHealthCheckInterval = 30 * time.Second
+
+// A HealthChecker configures the pool's background health checks.  Every
+// Interval seconds, 30 by default, the pool checks all of its idle
+// connections at once by pinging them, or by running Query if it is set, and
+// closes those that fail, so that dead connections are removed before Get
+// hands them out.  If none of the idle connections passes, or there are none,
+// the server itself is checked over a separate connection that is closed
+// again straight away, unless the server's budget (see Config.Budget) is used
+// up, in which case the check is skipped.  The outcome is reported by
+// Pool.Healthy and Pool.Health.
+type HealthChecker struct {
+	Interval uint
+	Query    string
+}
+
+// A HealthStatus describes the outcome of the pool's health checks.  Healthy
+// is whether the most recent check, made at CheckedAt, reached the server.
+// LastErr is the error the most recent failed check ran into, at LastErrAt,
+// whether or not the pool has recovered since, and Removed is the number of
+// dead idle connections the checks have closed.
+type HealthStatus struct {
+	Healthy   bool
+	CheckedAt time.Time
+	LastErr   error
+	LastErrAt time.Time
+	Removed   uint64
+}
+
+// Healthy reports whether the pool's most recent health check succeeded.  It
+// is true until a check has failed, and always if the pool doesn't run health
+// checks (see Config.HealthCheck).
+func (pool *Pool) Healthy() bool {
+	return pool.Health().Healthy
+}
+
+// Health returns the outcome of the pool's health checks.
+func (pool *Pool) Health() HealthStatus {
+	pool.statsMutex.Lock()
+	defer pool.statsMutex.Unlock()
+	status := pool.health
+	status.Healthy = status.CheckedAt.IsZero() || status.Healthy
+	return status
+}
+
+// interval returns the interval between health checks.
+func (checker *HealthChecker) interval() time.Duration {
+	if checker.Interval == 0 {
+		return defaultHealthCheckInterval
+	}
+	return time.Duration(checker.Interval) * time.Second
+}
+
+// checkHealth runs a health check on the pool's idle connections, and on the
+// server if none of them passes, and records the outcome.
+func (pool *Pool) checkHealth() {
+	query := pool.config.HealthCheck.Query
+	idle := pool.takeIdle()
+	passed := make(chan bool, len(idle))
+	for _, conn := range idle {
+		// The connections are checked at once, and each goes back as soon as it
+		// passes, so that one hung socket doesn't keep the others from Get
+		go func(conn *Conn) {
+			ok := conn.healthCheck(query) == nil
+			if ok {
+				pool.putIdle(conn)
+			}
+			passed <- ok
+		}(conn)
+	}
+	live := 0
+	for range idle {
+		if <-passed {
+			live++
+		}
+	}
+	removed := len(idle) - live
+	if removed > 0 {
+		pool.logInfo("Health check closed %d dead idle connections", removed)
+	}
+	// Dead idle connections alone don't make the pool unhealthy, as the
+	// server may well have closed them while the pool could still connect
+	var err error
+	if live == 0 {
+		err = pool.checkServer(query)
+	}
+
+	now := time.Now()
+	pool.statsMutex.Lock()
+	pool.health.Removed += uint64(removed)
+	if err == ErrBudgetExhausted {
+		// The server couldn't be checked, so there is no outcome to record
+		pool.statsMutex.Unlock()
+		return
+	}
+	wasHealthy := pool.health.CheckedAt.IsZero() || pool.health.Healthy
+	pool.health.Healthy = err == nil
+	pool.health.CheckedAt = now
+	if err != nil {
+		pool.health.LastErr = err
+		pool.health.LastErrAt = now
+	}
+	pool.statsMutex.Unlock()
+
+	switch {
+	case err != nil && wasHealthy:
+		pool.logError("Health check failed: %v", err)
+	case err == nil && !wasHealthy:
+		pool.logInfo("Health check succeeded again")
+	}
+}
+
+// healthCheck checks an idle connection by pinging it or running the given
+// query on it, within the pool's request timeout.  A connection that fails is
+// destroyed.  The connection's idle time is left as it was.
+func (conn *Conn) healthCheck(query string) error {
+	idleSince := atomic.LoadInt64(&conn.idleSince)
+	conn.setState(stateInUse)
+	err := conn.withDeadline("HEALTH CHECK", time.Now(), func() error {
+		return conn.destroyOnError(func() error {
+			if len(query) == 0 {
+				return conn.Conn.Ping()
+			}
+			_, _, err := conn.Conn.Query(query)
+			return err
+		})
+	})
+	if err != nil {
+		if atomic.LoadInt32(&conn.state) != stateDestroyed {
+			conn.destroy(DestroyedOnError)
+		}
+		return err
+	}
+	conn.setState(stateIdle)
+	atomic.StoreInt64(&conn.idleSince, idleSince)
+	return nil
+}
+
+// checkServer checks the server over a new connection that isn't added to the
+// pool, which is closed again once it has been pinged or the given query has
+// been run on it.  The connection counts against the server's budget like any
+// other, and if the budget is used up, checkServer fails with
+// ErrBudgetExhausted without connecting.
+func (pool *Pool) checkServer(query string) error {
+	if !pool.config.Budget.acquire(pool) {
+		return ErrBudgetExhausted
+	}
+	defer pool.config.Budget.release()
+	conn := pool.newDriverConn(pool.hosts.pick())
+	if err := conn.Connect(); err != nil {
+		return err
+	}
+	defer conn.Close()
+	if len(query) == 0 {
+		return conn.Ping()
+	}
+	_, _, err := conn.Query(query)
+	return err
+}
@@ -0,0 +1,48 @@
+package pool
+
+import (
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// An IDRange is the range of auto-increment IDs generated by an INSERT that
+// added several rows.  The IDs are First, First+Increment and so on, one for
+// each of the Count rows, in the order the rows were listed.
+type IDRange struct {
+	First     uint64
+	Count     uint64
+	Increment uint64
+}
+
+// ID returns the ID generated for the row at index i of the INSERT.
+func (r IDRange) ID(i int) uint64 {
+	return r.First + uint64(i)*r.Increment
+}
+
+// Last returns the ID generated for the last row.
+func (r IDRange) Last() uint64 {
+	return r.ID(int(r.Count) - 1)
+}
+
+// GeneratedIDs returns the IDs generated by a multi-row INSERT that added rows
+// rows, so that callers can map the new IDs back to their input.  The server
+// only reports the first ID, so the range can only be worked out when the IDs
+// are known to be consecutive: the statement must have inserted exactly rows
+// rows, which rules out INSERT IGNORE skipping rows and ON DUPLICATE KEY
+// UPDATE, and innodb_autoinc_lock_mode must not be 2 (interleaved), which
+// lets concurrent inserts take IDs from the middle of the range.  Otherwise
+// ErrIDRangeUnknown is returned.  auto_increment_increment is taken into
+// account.  GeneratedIDs must be called on the connection that executed the
+// INSERT, before it is released.
+func (conn *Conn) GeneratedIDs(result mysql.Result, rows int) (IDRange, error) {
+	if rows <= 0 || result.InsertId() == 0 || result.AffectedRows() != uint64(rows) {
+		return IDRange{}, ErrIDRangeUnknown
+	}
+	row, _, err := conn.QueryFirst("SELECT @@innodb_autoinc_lock_mode, @@auto_increment_increment")
+	if err != nil {
+		return IDRange{}, err
+	}
+	if row.Int(0) == 2 {
+		return IDRange{}, ErrIDRangeUnknown
+	}
+	return IDRange{First: result.InsertId(), Count: uint64(rows), Increment: row.Uint64(1)}, nil
+}
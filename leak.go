@@ -0,0 +1,53 @@
+package pool
+
+import (
+	"time"
+)
+
+// A Leak describes a connection that has been checked out for longer than
+// Config.LeakWarningThreshold, most likely because the code that checked it
+// out never released it.  Stack is the stack of the call to Get, or one of its
+// variants, that checked it out.
+type Leak struct {
+	BorrowID     uint64
+	CheckedOutAt time.Time
+	Held         time.Duration
+	Stack        []byte
+}
+
+// trackLeaks reports whether the pool records where connections are checked
+// out so that leaks can be traced back to their callers.
+func (pool *Pool) trackLeaks() bool {
+	return pool.config.LeakWarningThreshold > 0
+}
+
+// reportLeaks reports the connections that have been in use for longer than
+// threshold to the OnLeak callback, or logs them as warnings if there isn't
+// one.  Each checkout is only reported once.
+func (pool *Pool) reportLeaks(threshold time.Duration) {
+	var leaks []Leak
+	pool.mutex.Lock()
+	for conn := range pool.openConnections {
+		record, _ := conn.borrowed.Load().(*borrowRecord)
+		if record != nil && !record.reported && conn.checkInUse() == nil && time.Since(record.at) > threshold {
+			record.reported = true
+			leaks = append(leaks, Leak{record.id, record.at, time.Since(record.at), record.stack})
+		}
+	}
+	pool.mutex.Unlock()
+
+	if len(leaks) > 0 {
+		pool.updateStats(func(stats *Stats) {
+			stats.Leaks += uint64(len(leaks))
+		})
+	}
+	for i := range leaks {
+		leak := &leaks[i]
+		if pool.config.OnLeak != nil {
+			pool.config.OnLeak(leak)
+			continue
+		}
+		pool.logWarn("Connection with borrow ID %d has been checked out for %s without being released; it was checked out at:\n%s",
+			leak.BorrowID, leak.Held.Round(time.Millisecond), leak.Stack)
+	}
+}
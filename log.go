@@ -0,0 +1,77 @@
+package pool
+
+import (
+	"fmt"
+	"log"
+)
+
+// A Logger receives messages about events in a pool that would otherwise go
+// unnoticed, such as failed connection attempts, connections closed after
+// errors, timeouts and the work of the background tasks.  Messages are
+// prefixed with the pool's name, if it has one.  Loggers such as those of
+// zap's SugaredLogger and logrus satisfy it as they are; StdLogger adapts the
+// standard library's.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// StdLogger returns a Logger that writes to l, marking each message with its
+// level.  Debug messages are dropped unless debug is true.
+func StdLogger(l *log.Logger, debug bool) Logger {
+	return &stdLogger{l, debug}
+}
+
+type stdLogger struct {
+	logger *log.Logger
+	debug  bool
+}
+
+func (l *stdLogger) Debugf(format string, args ...interface{}) {
+	if l.debug {
+		l.logger.Output(2, "DEBUG "+fmt.Sprintf(format, args...))
+	}
+}
+
+func (l *stdLogger) Infof(format string, args ...interface{}) {
+	l.logger.Output(2, "INFO "+fmt.Sprintf(format, args...))
+}
+
+func (l *stdLogger) Warnf(format string, args ...interface{}) {
+	l.logger.Output(2, "WARN "+fmt.Sprintf(format, args...))
+}
+
+func (l *stdLogger) Errorf(format string, args ...interface{}) {
+	l.logger.Output(2, "ERROR "+fmt.Sprintf(format, args...))
+}
+
+func (pool *Pool) logDebug(format string, args ...interface{}) {
+	pool.logf(Logger.Debugf, format, args)
+}
+
+func (pool *Pool) logInfo(format string, args ...interface{}) {
+	pool.logf(Logger.Infof, format, args)
+}
+
+func (pool *Pool) logWarn(format string, args ...interface{}) {
+	pool.logf(Logger.Warnf, format, args)
+}
+
+func (pool *Pool) logError(format string, args ...interface{}) {
+	pool.logf(Logger.Errorf, format, args)
+}
+
+// logf passes a message to the given method of the pool's logger, if it has
+// one, prefixed with the pool's name.
+func (pool *Pool) logf(method func(Logger, string, ...interface{}), format string, args []interface{}) {
+	if pool.config.Logger == nil {
+		return
+	}
+	if len(pool.config.Name) > 0 {
+		format = "Pool %s: " + format
+		args = append([]interface{}{pool.config.Name}, args...)
+	}
+	method(pool.config.Logger, format, args...)
+}
@@ -0,0 +1,39 @@
+package pool
+
+import (
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// QueryMaps executes a query on a connection like Query, but returns each row
+// as a map from column name to value, for generic tooling such as admin pages
+// and templates that don't know the shape of the result in advance.  Values
+// the server sent as text are returned as strings and NULLs as nil.  If
+// several columns share a name, the last of them wins, so such columns should
+// be given aliases.
+func (conn *Conn) QueryMaps(sql string, params ...interface{}) (maps []map[string]interface{}, result mysql.Result, err error) {
+	rows, result, err := conn.Query(sql, params...)
+	if err != nil {
+		return nil, result, err
+	}
+	return rowMaps(result.Fields(), rows), result, nil
+}
+
+// rowMaps converts rows into maps keyed by the names of the given fields.
+func rowMaps(fields []*mysql.Field, rows []mysql.Row) []map[string]interface{} {
+	maps := make([]map[string]interface{}, len(rows))
+	for i, row := range rows {
+		m := make(map[string]interface{}, len(fields))
+		for j, field := range fields {
+			if j >= len(row) {
+				break
+			}
+			if b, ok := row[j].([]byte); ok {
+				m[field.Name] = string(b)
+			} else {
+				m[field.Name] = row[j]
+			}
+		}
+		maps[i] = m
+	}
+	return maps
+}
@@ -0,0 +1,135 @@
+package pool
+
+import (
+	"github.com/ziutek/mymysql/mysql"
+	"strings"
+	"unicode/utf8"
+)
+
+// A MaskFunc replaces a sensitive value read from the database.  It is given
+// the value as the driver returned it, usually a []byte for text queries and a
+// typed value for prepared statements, and NULLs are passed as nil.
+type MaskFunc func(value interface{}) interface{}
+
+// Masking hides the values of sensitive columns in the rows a pool returns, so
+// that an ad hoc or reporting pool can be given to less trusted users of the
+// same schema.  Columns maps column names to the function that masks them.  A
+// name is either a bare column name, matching that column in any table, or a
+// table-qualified one such as "users.email"; names are compared without regard
+// to case.  Columns are matched by their name in the table rather than in the
+// result, so aliasing a column doesn't reveal it, but values computed by
+// expressions such as CONCAT(email) can't be traced back to their columns and
+// are not masked.  Combine masking with a StatementGuard that only allows
+// known queries where that matters.  For example:
+//
+//	untrusted, err := pool.New(base.With(pool.WithName("adhoc"), pool.WithMasking(&pool.Masking{
+//		Columns: map[string]pool.MaskFunc{
+//			"email": pool.Redact,
+//			"ssn":   pool.KeepLast(4),
+//		},
+//	})))
+type Masking struct {
+	Columns map[string]MaskFunc
+}
+
+// masker returns the mask function for a field, or nil if it isn't masked.
+func (m *Masking) masker(field *mysql.Field) MaskFunc {
+	if len(field.OrgName) == 0 {
+		return nil
+	}
+	for name, mask := range m.Columns {
+		column := name
+		if dot := strings.LastIndexByte(name, '.'); dot >= 0 {
+			if !strings.EqualFold(name[:dot], field.OrgTable) {
+				continue
+			}
+			column = name[dot+1:]
+		}
+		if strings.EqualFold(column, field.OrgName) {
+			return mask
+		}
+	}
+	return nil
+}
+
+// maskers returns the mask function for each of the given fields, or nil if
+// none of them are masked.
+func (m *Masking) maskers(fields []*mysql.Field) []MaskFunc {
+	var masks []MaskFunc
+	for i, field := range fields {
+		if mask := m.masker(field); mask != nil {
+			if masks == nil {
+				masks = make([]MaskFunc, len(fields))
+			}
+			masks[i] = mask
+		}
+	}
+	return masks
+}
+
+// Redact masks a value entirely.  Strings and byte slices become "****" and
+// other values NULL; NULLs are left as they are.
+func Redact(value interface{}) interface{} {
+	switch value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		return []byte("****")
+	case string:
+		return "****"
+	}
+	return nil
+}
+
+// KeepLast returns a MaskFunc that replaces all but the last n characters of a
+// string or byte slice with asterisks, as is usual for card and social security
+// numbers.  Other values are redacted.
+func KeepLast(n int) MaskFunc {
+	return func(value interface{}) interface{} {
+		var s string
+		switch v := value.(type) {
+		case []byte:
+			s = string(v)
+		case string:
+			s = v
+		default:
+			return Redact(value)
+		}
+		masked := utf8.RuneCountInString(s) - n
+		if masked < 0 {
+			masked = 0
+		}
+		var out strings.Builder
+		for i := range s {
+			if masked == 0 {
+				out.WriteString(s[i:])
+				break
+			}
+			out.WriteByte('*')
+			masked--
+		}
+		if _, ok := value.([]byte); ok {
+			return []byte(out.String())
+		}
+		return out.String()
+	}
+}
+
+// mask applies the connection's masking to the values of rows read from a
+// result with the given fields.
+func (conn *Conn) mask(fields []*mysql.Field, rows ...mysql.Row) {
+	if conn.masking == nil {
+		return
+	}
+	masks := conn.masking.maskers(fields)
+	if masks == nil {
+		return
+	}
+	for _, row := range rows {
+		for i, mask := range masks {
+			if mask != nil && i < len(row) {
+				row[i] = mask(row[i])
+			}
+		}
+	}
+}
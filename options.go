@@ -0,0 +1,183 @@
+package pool
+
+import (
+	"crypto/tls"
+)
+
+// An Option modifies a pool configuration.
+type Option interface {
+	apply(*Config)
+}
+
+type optionFunc func(*Config)
+
+func (f optionFunc) apply(config *Config) {
+	f(config)
+}
+
+// apply makes a Config usable as an Option that replaces the whole
+// configuration, so New(config) and New(WithAddress(...), ...) both work.
+func (config Config) apply(dst *Config) {
+	*dst = config
+}
+
+// With returns a copy of the configuration with the given options applied.
+// This makes it easy to derive several pools (e.g. an OLTP pool and a reporting
+// pool on the same server) from one base configuration.
+func (config Config) With(opts ...Option) Config {
+	for _, opt := range opts {
+		opt.apply(&config)
+	}
+	return config
+}
+
+// WithAddress sets the protocol ("tcp" or "unix") and address of the server.
+func WithAddress(protocol, address string) Option {
+	return optionFunc(func(config *Config) {
+		config.Protocol = protocol
+		config.Address = address
+	})
+}
+
+// WithName sets the name that identifies the pool in errors and diagnostics.
+func WithName(name string) Option {
+	return optionFunc(func(config *Config) {
+		config.Name = name
+	})
+}
+
+// WithCredentials sets the username and password used to log in.
+func WithCredentials(username, password string) Option {
+	return optionFunc(func(config *Config) {
+		config.Username = username
+		config.Password = password
+	})
+}
+
+// WithCharset sets the charset and, optionally, the collation of new
+// connections.
+func WithCharset(charset, collation string) Option {
+	return optionFunc(func(config *Config) {
+		config.Charset = charset
+		config.Collation = collation
+	})
+}
+
+// WithKeepAlive sets whether released connections are kept open for reuse.
+func WithKeepAlive(keepAlive bool) Option {
+	return optionFunc(func(config *Config) {
+		config.KeepConnectionsAlive = keepAlive
+	})
+}
+
+// WithMaxConnectionAge sets the number of seconds after which a connection is
+// retired.
+func WithMaxConnectionAge(seconds uint) Option {
+	return optionFunc(func(config *Config) {
+		config.MaxConnectionAge = seconds
+	})
+}
+
+// WithConnectTimeout sets the number of seconds allowed for establishing a
+// connection.
+func WithConnectTimeout(seconds uint) Option {
+	return optionFunc(func(config *Config) {
+		config.ConnectTimeout = seconds
+	})
+}
+
+// WithAcquireTimeout sets the number of seconds Get waits for a connection
+// when all of them are in use.
+func WithAcquireTimeout(seconds uint) Option {
+	return optionFunc(func(config *Config) {
+		config.AcquireTimeout = seconds
+	})
+}
+
+// WithMaxConns sets the maximum number of connections the pool may open.
+func WithMaxConns(n uint) Option {
+	return optionFunc(func(config *Config) {
+		config.MaxConnections = n
+	})
+}
+
+// WithMinIdle sets the number of idle connections the pool tries to keep open.
+func WithMinIdle(n uint) Option {
+	return optionFunc(func(config *Config) {
+		config.MinIdleConnections = n
+	})
+}
+
+// WithTimeout sets the number of seconds a request may take before it is
+// cancelled.
+func WithTimeout(seconds uint) Option {
+	return optionFunc(func(config *Config) {
+		config.RequestTimeout = seconds
+	})
+}
+
+// WithDatabase sets the database that new connections use.
+func WithDatabase(name string) Option {
+	return optionFunc(func(config *Config) {
+		config.Database = name
+	})
+}
+
+// WithTLS makes the pool wrap its connections to the server in TLS (see
+// Config.TLS).
+func WithTLS(tlsConfig *tls.Config) Option {
+	return optionFunc(func(config *Config) {
+		config.TLS = tlsConfig
+	})
+}
+
+// WithFailover sets the protocol and the addresses of several servers holding
+// the same data, in order of preference (see Config.Addresses).
+func WithFailover(protocol string, addresses ...string) Option {
+	return optionFunc(func(config *Config) {
+		config.Protocol = protocol
+		config.Addresses = addresses
+	})
+}
+
+// WithLogger sets the logger that receives messages about the pool's
+// activity.
+func WithLogger(logger Logger) Option {
+	return optionFunc(func(config *Config) {
+		config.Logger = logger
+	})
+}
+
+// WithHealthCheck makes the pool check its idle connections and the server
+// every given number of seconds, with the given query, or by pinging them if
+// it is empty (see HealthChecker).
+func WithHealthCheck(seconds uint, query string) Option {
+	return optionFunc(func(config *Config) {
+		config.HealthCheck = &HealthChecker{Interval: seconds, Query: query}
+	})
+}
+
+// WithLeakDetection turns on leak tracking, reporting connections that are
+// still checked out after the given number of seconds to onLeak, or logging
+// them if onLeak is nil (see Config.LeakWarningThreshold).
+func WithLeakDetection(seconds uint, onLeak func(leak *Leak)) Option {
+	return optionFunc(func(config *Config) {
+		config.LeakWarningThreshold = seconds
+		config.OnLeak = onLeak
+	})
+}
+
+// WithDryRun puts the pool in dry-run mode (see Config.DryRun).
+func WithDryRun() Option {
+	return optionFunc(func(config *Config) {
+		config.DryRun = true
+	})
+}
+
+// WithMasking sets the columns whose values the pool masks in the rows it
+// returns.
+func WithMasking(masking *Masking) Option {
+	return optionFunc(func(config *Config) {
+		config.Masking = masking
+	})
+}
@@ -0,0 +1,75 @@
+// Package otelpool traces the operations of a MyMySQL connection pool with
+// OpenTelemetry.  It is kept apart from the pool package so that applications
+// that don't use OpenTelemetry don't depend on it.
+package otelpool
+
+import (
+	"context"
+	"github.com/mooncake0525/mymysql-pool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/mooncake0525/mymysql-pool/otelpool"
+
+// Span attributes, named after the OpenTelemetry database conventions
+const (
+	systemKey   = attribute.Key("db.system.name")
+	poolNameKey = attribute.Key("db.client.connection.pool.name")
+	queryKey    = attribute.Key("db.query.text")
+	rowsKey     = attribute.Key("db.response.returned_rows")
+	waitKey     = attribute.Key("db.client.connection.wait_time")
+)
+
+// Instrument returns a copy of the configuration that creates a span for each
+// connection checkout, query, prepared statement execution and transaction
+// Begin, Commit and Rollback made through the pool.  Spans are children of
+// the span in the context of the operation (see Conn.Context), and are created
+// with tp, or the global tracer provider if tp is nil:
+//
+//	db, err := pool.New(otelpool.Instrument(config, nil))
+//
+// Rather than the SQL itself, whose literal values may be sensitive, spans
+// carry its fingerprint (see pool.Fingerprint).  They also record the number
+// of rows read, the time spent waiting for a connection and any error.  Any
+// OnOperation callback the configuration already has is still called.
+func Instrument(config pool.Config, tp trace.TracerProvider) pool.Config {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	tracer := tp.Tracer(instrumentationName)
+	common := []attribute.KeyValue{systemKey.String("mysql")}
+	if len(config.Name) > 0 {
+		common = append(common, poolNameKey.String(config.Name))
+	}
+
+	next := config.OnOperation
+	config.OnOperation = func(ctx context.Context, op pool.Operation) {
+		attrs := append([]attribute.KeyValue(nil), common...)
+		if len(op.SQL) > 0 {
+			attrs = append(attrs, queryKey.String(pool.Fingerprint(op.SQL)))
+		}
+		if op.Rows >= 0 {
+			attrs = append(attrs, rowsKey.Int(op.Rows))
+		}
+		if op.Wait > 0 {
+			attrs = append(attrs, waitKey.Float64(op.Wait.Seconds()))
+		}
+		_, span := tracer.Start(ctx, op.Name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithTimestamp(op.Start),
+			trace.WithAttributes(attrs...))
+		if op.Err != nil {
+			span.RecordError(op.Err)
+			span.SetStatus(codes.Error, op.Err.Error())
+		}
+		span.End(trace.WithTimestamp(op.Start.Add(op.Duration)))
+
+		if next != nil {
+			next(ctx, op)
+		}
+	}
+	return config
+}
@@ -0,0 +1,68 @@
+package otelpool
+
+import (
+	"context"
+	"github.com/mooncake0525/mymysql-pool"
+	"github.com/stretchr/testify/assert"
+	"github.com/ziutek/mymysql/mysql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"testing"
+	"time"
+)
+
+func TestInstrument(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	var ops []pool.Operation
+	config := pool.Config{}.With(pool.WithName("reports"), pool.WithMaxConns(1))
+	config.OnOperation = func(ctx context.Context, op pool.Operation) {
+		ops = append(ops, op)
+	}
+	db, err := pool.New(Instrument(config, tp))
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Fill the pool so that Get must wait
+	_, err = db.Adopt(connectedConn{})
+	assert.NoError(t, err)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = db.GetContext(ctx)
+	assert.Error(t, err)
+	parent.End()
+
+	assert.Len(t, ops, 1, "The existing callback should still be called")
+	spans := recorder.Ended()
+	if !assert.Len(t, spans, 2) {
+		return
+	}
+	span := spans[0]
+	assert.Equal(t, "Pool.Get", span.Name())
+	assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+	assert.Equal(t, codes.Error, span.Status().Code)
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	assert.Equal(t, "mysql", attrs[systemKey].AsString())
+	assert.Equal(t, "reports", attrs[poolNameKey].AsString())
+	assert.True(t, attrs[waitKey].AsFloat64() > 0)
+	assert.NotContains(t, attrs, rowsKey)
+	assert.Equal(t, ops[0].Start, span.StartTime())
+	assert.Equal(t, ops[0].Duration, span.EndTime().Sub(span.StartTime()))
+}
+
+// connectedConn is a driver connection that is taken to be connected, which
+// the pool can adopt without a server.
+type connectedConn struct {
+	mysql.Conn
+}
+
+func (connectedConn) IsConnected() bool {
+	return true
+}
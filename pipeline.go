@@ -0,0 +1,89 @@
+package pool
+
+import (
+	"fmt"
+	"github.com/ziutek/mymysql/mysql"
+	"strings"
+)
+
+// A Pipeline queues independent statements so that they can be sent to the
+// server in a single round trip.  The statements are sent as one
+// multi-statement query, so they are executed in order and execution stops at
+// the first statement that fails.
+type Pipeline struct {
+	conn    *Conn
+	queries []string
+}
+
+// A PipelineResult holds the outcome of one statement in a pipeline.
+type PipelineResult struct {
+	Rows   []mysql.Row
+	Result mysql.Result
+}
+
+// Pipeline returns a new, empty pipeline on the connection.
+func (conn *Conn) Pipeline() *Pipeline {
+	return &Pipeline{conn: conn}
+}
+
+// Queue adds a statement to the pipeline.  As with Query, any parameters are
+// substituted into the SQL with fmt.Sprintf.
+func (p *Pipeline) Queue(sql string, params ...interface{}) *Pipeline {
+	if len(params) > 0 {
+		sql = fmt.Sprintf(sql, params...)
+	}
+	p.queries = append(p.queries, sql)
+	return p
+}
+
+// Flush sends all queued statements to the server and reads their results.
+// The results of the statements that succeeded are returned even if a later
+// statement fails.  The execution time is limited according to the pool's
+// request timeout.
+func (p *Pipeline) Flush() (results []PipelineResult, err error) {
+	if len(p.queries) == 0 {
+		return nil, nil
+	}
+	sql := strings.Join(p.queries, ";\n")
+	p.queries = nil
+
+	conn := p.conn
+	if err = conn.guard(sql, nil); err != nil {
+		return nil, err
+	}
+	err = conn.withTimeout(sql, func() error {
+		return conn.destroyOnError(func() error {
+			res, e := conn.Conn.Start(sql)
+			for e == nil {
+				var rows []mysql.Row
+				if rows, e = conn.getRows(res); e != nil {
+					// Skip the remaining results so that the connection can
+					// be used again
+					drainResults(res)
+					break
+				}
+				results = append(results, PipelineResult{rows, &Result{Result: res, conn: conn}})
+				if !res.MoreResults() {
+					break
+				}
+				var next mysql.Result
+				if next, e = res.NextResult(); e == nil {
+					res = next
+				}
+			}
+			return e
+		})
+	})
+	return
+}
+
+// drainResults discards any further results following res.
+func drainResults(res mysql.Result) {
+	for res.MoreResults() {
+		next, err := res.NextResult()
+		if err != nil || next.End() != nil {
+			return
+		}
+		res = next
+	}
+}
@@ -1,11 +1,33 @@
 package pool
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/mooncake0525/mymysql-pool/testsupport"
 	"github.com/stretchr/testify/assert"
 	"github.com/ziutek/mymysql/mysql"
+	"golang.org/x/crypto/ssh"
 	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -35,6 +57,212 @@ func getPool(t *testing.T, config Config) *Pool {
 	return pool
 }
 
+func TestConfig_With(t *testing.T) {
+	derived := config.With(WithMaxConns(50), WithTimeout(60), WithDatabase("reports"))
+	assert.Equal(t, uint(50), derived.MaxConnections)
+	assert.Equal(t, uint(60), derived.RequestTimeout)
+	assert.Equal(t, "reports", derived.Database)
+	assert.Equal(t, config.Address, derived.Address)
+
+	// The base configuration must be left untouched
+	assert.Equal(t, uint(numConns), config.MaxConnections)
+	assert.Equal(t, "test", config.Database)
+}
+
+func TestNew_options(t *testing.T) {
+	pool, err := New(
+		WithAddress("tcp", "localhost:3306"),
+		WithCredentials("testuser", "testpass"),
+		WithDatabase("test"),
+		WithMaxConns(3),
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, "tcp", pool.config.Protocol)
+	assert.Equal(t, "localhost:3306", pool.config.Address)
+	assert.Equal(t, uint(3), pool.config.MaxConnections)
+
+	// A Config followed by options overrides just those fields
+	pool, err = New(config, WithDatabase("reports"))
+	assert.NoError(t, err)
+	assert.Equal(t, "reports", pool.config.Database)
+	assert.Equal(t, config.Address, pool.config.Address)
+}
+
+func TestPool_TLS(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	server.Handle("SELECT 1", &testsupport.Response{Columns: []string{"1"}, Rows: [][]interface{}{{1}}})
+
+	// A TLS-terminating proxy in front of the server, with a self-signed
+	// certificate for localhost
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	cert, _ := x509.ParseCertificate(der)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			backend, err := net.Dial("tcp", server.Addr())
+			if err != nil {
+				client.Close()
+				continue
+			}
+			go func() {
+				io.Copy(backend, client)
+				backend.Close()
+			}()
+			go func() {
+				io.Copy(client, backend)
+				client.Close()
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	pool, err := New(WithAddress("tcp", "localhost:"+port), WithTLS(&tls.Config{RootCAs: roots}), WithConnectTimeout(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	rows, _, err := conn.Query("SELECT 1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, rows[0].Int(0))
+	}
+	assert.NoError(t, conn.Release())
+
+	// The server's certificate is checked
+	untrusted, err := New(WithAddress("tcp", "localhost:"+port), WithTLS(&tls.Config{}), WithConnectTimeout(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer untrusted.Close()
+	_, err = untrusted.Get()
+	var unknown x509.UnknownAuthorityError
+	assert.True(t, errors.As(err, &unknown), "Got %v", err)
+}
+
+func TestPool_StmtStats(t *testing.T) {
+	var phases []StmtPhase
+	cfg := config
+	cfg.OnStmtPhase = func(ctx context.Context, phase StmtPhase, sql string, elapsed time.Duration, err error) {
+		phases = append(phases, phase)
+	}
+	pool := getPool(t, cfg)
+
+	ctx := context.Background()
+	start := time.Now().Add(-time.Second)
+	pool.traceStmt(ctx, StmtPrepare, "SELECT 1", start, nil)
+	pool.traceStmt(ctx, StmtExecute, "SELECT 1", start, nil)
+	pool.traceStmt(ctx, StmtExecute, "SELECT 1", start, errors.New("oops"))
+	pool.traceStmt(ctx, StmtFetch, "SELECT 1", start, nil)
+
+	stats := pool.StmtStats()
+	assert.Equal(t, uint64(1), stats.Prepare.Count)
+	assert.Equal(t, uint64(2), stats.Execute.Count)
+	assert.Equal(t, uint64(1), stats.Execute.Errors)
+	assert.Equal(t, uint64(1), stats.Fetch.Count)
+	assert.True(t, stats.Execute.Duration >= 2*time.Second)
+	assert.Equal(t, []StmtPhase{StmtPrepare, StmtExecute, StmtExecute, StmtFetch}, phases)
+}
+
+func TestConfig_hookContext(t *testing.T) {
+	type traceKey struct{}
+	var traces []interface{}
+	cfg := config
+	cfg.MaxConnections = 1
+	cfg.InitConnection = func(conn *Conn) error {
+		traces = append(traces, conn.Context().Value(traceKey{}))
+		return nil
+	}
+	cfg.OnStmtPhase = func(ctx context.Context, phase StmtPhase, sql string, elapsed time.Duration, err error) {
+		traces = append(traces, ctx.Value(traceKey{}))
+	}
+	pool := getPool(t, cfg)
+
+	ctx := context.WithValue(context.Background(), traceKey{}, "abc")
+	err := pool.Go(ctx, func(conn *Conn) error {
+		stmt, err := conn.Prepare("SELECT 1")
+		if err != nil {
+			return err
+		}
+		_, _, err = stmt.Exec()
+		return err
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"abc", "abc", "abc", "abc"}, traces)
+
+	// Outside a Go call the connection isn't bound to a context
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+	assert.Equal(t, context.Background(), conn.Context())
+}
+
+func TestConfig_lifecycleHooks(t *testing.T) {
+	var events []string
+	cfg := config
+	cfg.MaxConnections = 1
+	cfg.OnConnect = func(conn *Conn) { events = append(events, "connect") }
+	cfg.OnCheckout = func(conn *Conn) { events = append(events, "checkout") }
+	cfg.OnRelease = func(conn *Conn) {
+		_, _, err := conn.Query("SELECT 1")
+		assert.NoError(t, err, "The connection should be usable in OnRelease")
+		events = append(events, "release")
+	}
+	cfg.OnDestroy = func(conn *Conn, reason DestroyReason) { events = append(events, "destroy "+reason.String()) }
+	pool := getPool(t, cfg)
+
+	for i := 0; i < 2; i++ {
+		conn, err := pool.Get()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, conn.Release())
+	}
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Destroy()
+	assert.Equal(t, []string{
+		"connect", "checkout", "release",
+		"checkout", "release",
+		"checkout", "destroy " + DestroyedByCaller.String(),
+	}, events)
+}
+
 func TestConnLifecycle(t *testing.T) {
 	pool := getPool(t, config)
 	conns := make([]*Conn, numConns)
@@ -107,65 +335,3783 @@ func TestConnLifecycle(t *testing.T) {
 	wg.Wait()
 }
 
-func TestConn_withTimeout(t *testing.T) {
+func TestPool_GetN(t *testing.T) {
 	pool := getPool(t, config)
-	var wg sync.WaitGroup
 
-	for i := 0; i < 10; i += 2 {
-		wg.Add(1)
-		go func(i int) {
-			conn, err := pool.Get()
-			if assert.NoError(t, err) && assert.NotNil(t, conn) {
-				err := conn.withTimeout(func() error {
-					time.Sleep(time.Duration(i) * time.Second)
-					return nil
-				})
-				if uint(i) < config.RequestTimeout {
-					assert.NoError(t, err)
-				} else {
-					assert.Error(t, err)
-				}
-				conn.Release()
-			}
-			wg.Done()
-		}(i)
+	// Asking for more than the pool can hold should fail immediately
+	_, err := pool.GetN(numConns+1, time.Second)
+	assert.Equal(t, ErrBatchTooLarge, err)
+	_, err = pool.GetN(-1, time.Second)
+	assert.Equal(t, ErrInvalidBatchSize, err)
+
+	conns, err := pool.GetN(numConns-1, time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, conns, numConns-1)
+
+	// Only one connection is left, so a batch of two must fail and give back
+	// the connection it managed to acquire
+	_, err = pool.GetN(2, time.Second)
+	assert.Error(t, err)
+	total, avail := pool.Size()
+	assert.Equal(t, numConns, total, "Pool size should be %d", numConns)
+	assert.Equal(t, 1, avail, "Number of available connections should be 1")
+
+	for _, conn := range conns {
+		assert.NoError(t, conn.Release())
 	}
+}
 
-	wg.Wait()
+func TestPool_GetFor(t *testing.T) {
+	const sql = "SELECT ?"
+	pool := getPool(t, config)
+	conns, err := pool.GetN(3, time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conns[1].Prepare(sql)
+	assert.NoError(t, err)
+	for _, conn := range conns {
+		assert.NoError(t, conn.Release())
+	}
+
+	conn, err := pool.GetFor(sql)
+	assert.NoError(t, err)
+	assert.Equal(t, conns[1], conn)
+	conn.Release()
+
+	total, avail := pool.Size()
+	assert.Equal(t, 3, total, "Pool size should be 3")
+	assert.Equal(t, 3, avail, "Number of available connections should be 3")
 }
 
-func TestConn_destroyOnError(t *testing.T) {
-	var testCases = map[error]bool{
-		nil:                      false, // No error
-		io.EOF:                   false,
-		errors.New("oops"):       true,
-		&mysql.Error{Code: 1021}: true,  // Disk full
-		&mysql.Error{Code: 1022}: false, // Duplicate key
-		&mysql.Error{Code: 1105}: false, // Unknown error
-		&mysql.Error{Code: 1146}: false, // No such table
-		&mysql.Error{Code: 1149}: false, // Syntax error
-		&mysql.Error{Code: 1152}: true,  // Aborting connection
-		&mysql.Error{Code: 1267}: false, // Illegal mix of collations
-		&mysql.Error{Code: 2005}: true,  // Unknown host
-		&mysql.Error{Code: 2006}: true,  // Server has gone away
-		&mysql.Error{Code: 2056}: true,  // Lost connection
+func TestPool_Shrink(t *testing.T) {
+	pool := getPool(t, config)
+	conns, err := pool.GetN(3, time.Second)
+	assert.NoError(t, err)
+	for _, conn := range conns {
+		assert.NoError(t, conn.Release())
 	}
 
-	for errExpected, shouldDestroy := range testCases {
-		pool := getPool(t, config)
-		conn, err := pool.Get()
+	// The two oldest connections should be closed first
+	assert.Equal(t, 2, pool.Shrink(2))
+	total, avail := pool.Size()
+	assert.Equal(t, 1, total, "Pool size should be 1")
+	assert.Equal(t, 1, avail, "Number of available connections should be 1")
+
+	conn, err := pool.Get()
+	assert.NoError(t, err)
+	assert.Equal(t, conns[2], conn)
+	conn.Release()
+
+	assert.Equal(t, 1, pool.Shrink(5))
+}
+
+func TestPool_Close(t *testing.T) {
+	cfg := config
+	cfg.CloseGracePeriod = 1
+	pool := getPool(t, cfg)
+	conns, err := pool.GetN(3, time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, conns[0].Release())
+
+	// A connection released during the grace period is closed, while one that
+	// is held on to has its socket closed from under it
+	time.AfterFunc(100*time.Millisecond, func() {
+		conns[1].Release()
+	})
+	err = pool.Close()
+	assert.EqualError(t, err, "Closed 1 connections that were still in use")
+	_, _, err = conns[2].Query("SELECT 1")
+	assert.Error(t, err)
+	total, _ := pool.Size()
+	assert.Equal(t, 0, total, "Pool size should be 0")
+
+	_, err = pool.Get()
+	assert.Equal(t, ErrPoolClosed, err)
+	assert.Equal(t, ErrPoolClosed, pool.Close())
+}
+
+func TestPool_Close_waiting(t *testing.T) {
+	pool, _ := fullPool(t, WithConnectTimeout(5))
+	time.AfterFunc(50*time.Millisecond, func() {
+		// The connection that fills the pool is still checked out
+		assert.True(t, errors.Is(pool.Close(), ErrConnsInUse))
+	})
+	start := time.Now()
+	_, err := pool.Get()
+	assert.Equal(t, ErrPoolClosed, err)
+	assert.True(t, time.Since(start) < time.Second, "The wait should end when the pool is closed")
+}
+
+func TestPool_Warmup(t *testing.T) {
+	cfg := config
+	cfg.MinIdleConnections = 2
+	pool := getPool(t, cfg)
+	defer pool.Close()
+	assert.NoError(t, pool.Warmup())
+	total, avail := pool.Size()
+	assert.Equal(t, 2, total, "Pool size should be 2")
+	assert.Equal(t, 2, avail, "Number of available connections should be 2")
+
+	// Checking a connection out makes the pool open another in the background
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+	time.Sleep(100 * time.Millisecond)
+	total, avail = pool.Size()
+	assert.Equal(t, 3, total, "Pool size should be 3")
+	assert.Equal(t, 2, avail, "Number of available connections should be 2")
+}
+
+func TestPool_reapIdle(t *testing.T) {
+	cfg := config
+	cfg.MinIdleConnections = 1
+	pool := getPool(t, cfg)
+	defer pool.Close()
+	conns, err := pool.GetN(3, time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, conn := range conns {
+		assert.NoError(t, conn.Release())
+	}
+
+	// Only connections that have been idle for too long are closed, and the
+	// minimum number of idle connections is kept
+	conns[0].idleSince = time.Now().Add(-2 * time.Minute).UnixNano()
+	pool.reapIdle(time.Minute)
+	total, avail := pool.Size()
+	assert.Equal(t, 2, total, "Pool size should be 2")
+	assert.Equal(t, 2, avail, "Number of available connections should be 2")
+
+	conns[1].idleSince = time.Now().Add(-2 * time.Minute).UnixNano()
+	conns[2].idleSince = time.Now().Add(-2 * time.Minute).UnixNano()
+	pool.reapIdle(time.Minute)
+	total, avail = pool.Size()
+	assert.Equal(t, 1, total, "Pool size should be 1")
+	assert.Equal(t, 1, avail, "Number of available connections should be 1")
+}
+
+func TestConfig_InitConnection(t *testing.T) {
+	errInit := errors.New("init failed")
+	cfg := config
+	cfg.InitConnection = func(conn *Conn) error {
+		return errInit
+	}
+	pool := getPool(t, cfg)
+	_, err := pool.Get()
+	assert.Equal(t, errInit, err)
+	total, _ := pool.Size()
+	assert.Equal(t, 0, total, "Failed connections should not be counted")
+
+	cfg.InitConnection = func(conn *Conn) error {
+		_, _, err := conn.Query("SET @pool_test = 42")
+		return err
+	}
+	pool = getPool(t, cfg)
+	conn, err := pool.Get()
+	if assert.NoError(t, err) {
+		row, _, err := conn.QueryFirst("SELECT @pool_test")
 		assert.NoError(t, err)
-		assert.NotNil(t, conn)
+		assert.Equal(t, 42, row.Int(0))
+		conn.Release()
+	}
+}
 
-		errReturned := conn.destroyOnError(func() error {
-			return errExpected
-		})
+func TestTransaction_Do(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
 
-		assert.Equal(t, errExpected, errReturned)
-		if shouldDestroy {
-			assert.Nil(t, conn.pool, "Error: %s", errExpected)
-		} else {
-			assert.NotNil(t, conn.pool, "Error: %s", errExpected)
+	stmt, err := conn.Prepare("SELECT ?")
+	assert.NoError(t, err)
+	trans, err := conn.Begin()
+	assert.NoError(t, err)
+
+	// Binding a pooled statement must not panic and must keep the wrapper
+	bound := trans.Do(stmt)
+	assert.Equal(t, stmt, bound)
+	row, _, err := bound.ExecFirst(1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, row.Int(0))
+	assert.NoError(t, trans.Rollback())
+}
+
+func TestConn_useAfterRelease(t *testing.T) {
+	cfg := config
+	cfg.Debug = true
+	pool := getPool(t, cfg)
+
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, conn.Release())
+	assert.IsType(t, &ConnClosedError{}, conn.Release())
+	_, _, err = conn.Query("SELECT 1")
+	if assert.IsType(t, &ConnClosedError{}, err) {
+		assert.True(t, err.(*ConnClosedError).Is(ErrConnClosed))
+		assert.Contains(t, string(err.(*ConnClosedError).Stack), "Release")
+	}
+
+	conn, err = pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Destroy()
+	_, err = conn.Prepare("SELECT 1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Destroy")
+}
+
+func TestConn_Sidecar(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sidecar, err := conn.Sidecar()
+	assert.NoError(t, err)
+	row, _, err := sidecar.QueryFirst("SELECT CONNECTION_ID()")
+	assert.NoError(t, err)
+	assert.NotEqual(t, conn.ThreadId(), uint32(row.Uint64(0)))
+
+	// Releasing the parent releases the sidecar too
+	assert.NoError(t, conn.Release())
+	total, avail := pool.Size()
+	assert.Equal(t, 2, total, "Pool size should be 2")
+	assert.Equal(t, 2, avail, "Number of available connections should be 2")
+	assert.Equal(t, ErrConnClosed, sidecar.Release())
+}
+
+func TestConn_Sidecar_releasedEarly(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 2, KeepConnectionsAlive: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := pool.Adopt(fakeDriverConn{})
+	assert.NoError(t, err)
+	spare, err := pool.Adopt(fakeDriverConn{})
+	assert.NoError(t, err)
+	assert.NoError(t, spare.Release())
+
+	sidecar, err := conn.Sidecar()
+	assert.NoError(t, err)
+	assert.NoError(t, sidecar.Release())
+
+	// Releasing the parent leaves the sidecar's next borrower alone
+	other, err := pool.Get()
+	assert.NoError(t, err)
+	assert.True(t, other == sidecar)
+	assert.NoError(t, conn.Release())
+	_, avail := pool.Size()
+	assert.Equal(t, 1, avail, "The sidecar should still be in use")
+	assert.NoError(t, other.Release())
+}
+
+func TestConn_Stmt(t *testing.T) {
+	pool := getPool(t, config)
+	pool.RegisterStmt("double", "SELECT ? * 2")
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	_, err = conn.Stmt("triple")
+	assert.Equal(t, ErrUnknownStmt, err)
+
+	stmt, err := conn.Stmt("double")
+	assert.NoError(t, err)
+	row, _, err := stmt.ExecFirst(21)
+	assert.NoError(t, err)
+	assert.Equal(t, 42, row.Int(0))
+
+	// The statement must be prepared again after a reconnect
+	assert.NoError(t, conn.Reconnect())
+	stmt2, err := conn.Stmt("double")
+	assert.NoError(t, err)
+	assert.NotEqual(t, stmt, stmt2)
+	row, _, err = stmt2.ExecFirst(4)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, row.Int(0))
+}
+
+func TestConn_resultSizeLimits(t *testing.T) {
+	cfg := config
+	cfg.MaxResultRows = 2
+	pool := getPool(t, cfg)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	rows, _, err := conn.Query("SELECT 1 UNION SELECT 2")
+	assert.NoError(t, err)
+	assert.Len(t, rows, 2)
+	_, _, err = conn.Query("SELECT 1 UNION SELECT 2 UNION SELECT 3")
+	assert.Equal(t, ErrResultTooLarge, err)
+
+	// The connection must remain usable after an oversized result
+	assert.NotNil(t, conn.pool)
+	_, _, err = conn.Query("SELECT 1")
+	assert.NoError(t, err)
+}
+
+func TestRowSize(t *testing.T) {
+	assert.Equal(t, uint(0), rowSize(mysql.Row{}))
+	assert.Equal(t, uint(13), rowSize(mysql.Row{[]byte("hello"), nil, int64(7)}))
+	assert.Equal(t, uint(3), rowSize(mysql.Row{"abc"}))
+}
+
+func TestConn_Pipeline(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	results, err := conn.Pipeline().
+		Queue("SELECT %d", 1).
+		Queue("SET @pipeline = 2").
+		Queue("SELECT @pipeline").
+		Flush()
+	assert.NoError(t, err)
+	if assert.Len(t, results, 3) {
+		assert.Equal(t, 1, results[0].Rows[0].Int(0))
+		assert.Len(t, results[1].Rows, 0)
+		assert.Equal(t, 2, results[2].Rows[0].Int(0))
+	}
+
+	// Execution stops at the first failing statement
+	results, err = conn.Pipeline().
+		Queue("SELECT 1").
+		Queue("SELECT * FROM no_such_table").
+		Queue("SELECT 3").
+		Flush()
+	assert.Error(t, err)
+	assert.Len(t, results, 1)
+	_, _, err = conn.Query("SELECT 1")
+	assert.NoError(t, err)
+}
+
+func TestPool_applySocketOptions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+	tcp, err := net.Dial("tcp", listener.Addr().String())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer tcp.Close()
+
+	cfg := config
+	cfg.TCPKeepAlive = 30
+	cfg.TCPDelay = true
+	cfg.ReadBufferSize = 1 << 16
+	cfg.WriteBufferSize = 1 << 16
+	pool := getPool(t, cfg)
+	assert.NoError(t, pool.applySocketOptions(tcp.(*net.TCPConn)))
+}
+
+func TestDeadlineConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := &deadlineConn{client, 50 * time.Millisecond, 50 * time.Millisecond}
+
+	// Nobody is writing to the other end, so the read must time out
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	if assert.Error(t, err) {
+		assert.True(t, err.(net.Error).Timeout())
+	}
+	assert.True(t, time.Since(start) < time.Second)
+
+	// Likewise nobody is reading, so the write must time out
+	_, err = conn.Write([]byte{1})
+	if assert.Error(t, err) {
+		assert.True(t, err.(net.Error).Timeout())
+	}
+}
+
+func TestCountingConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	var stats ConnStats
+	conn := &countingConn{client, &stats}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(server, buf)
+		server.Write([]byte("pong"))
+	}()
+	_, err := conn.Write([]byte("ping!"))
+	assert.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, ConnStats{BytesSent: 5, BytesReceived: 4}, stats)
+}
+
+func TestHTTPConnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	// A proxy that accepts the tunnel and immediately sends a greeting on
+	// behalf of the server
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
 		}
+		defer conn.Close()
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil || req.Method != "CONNECT" || req.Host != "db:3306" {
+			conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\ngreeting"))
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	conn, err := httpConnect(&url.URL{Scheme: "http", Host: listener.Addr().String()}, "db:3306", time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	greeting := make([]byte, 8)
+	_, err = io.ReadFull(conn, greeting)
+	assert.NoError(t, err)
+	assert.Equal(t, "greeting", string(greeting))
+}
+
+func TestNew_proxy(t *testing.T) {
+	cfg := config
+	cfg.Proxy = "ftp://proxy"
+	_, err := New(cfg)
+	assert.Error(t, err)
+
+	cfg.Proxy = "socks5://proxy:1080"
+	cfg.SSH = &SSHConfig{}
+	_, err = New(cfg)
+	assert.Equal(t, ErrProxyWithSSH, err)
+}
+
+func TestConfig_Connector(t *testing.T) {
+	var instance string
+	var deadline bool
+	cfg := config
+	cfg.Address = "project:region:instance"
+	cfg.Connector = func(ctx context.Context, name string) (net.Conn, error) {
+		instance = name
+		_, deadline = ctx.Deadline()
+		client, _ := net.Pipe()
+		return client, nil
+	}
+	pool := getPool(t, cfg)
+	netConn, err := pool.dial("", "", cfg.Address, time.Second)
+	assert.NoError(t, err)
+	netConn.Close()
+	assert.Equal(t, cfg.Address, instance)
+	assert.True(t, deadline, "The connect timeout should be passed on")
+
+	cfg.Proxy = "socks5://proxy:1080"
+	_, err = New(cfg)
+	assert.Equal(t, ErrConnectorWithTunnel, err)
+}
+
+func TestPool_DialStats(t *testing.T) {
+	errRefused := errors.New("refused")
+	fail := true
+	cfg := config
+	cfg.Connector = func(ctx context.Context, name string) (net.Conn, error) {
+		if fail {
+			return nil, errRefused
+		}
+		client, _ := net.Pipe()
+		return client, nil
+	}
+	pool := getPool(t, cfg)
+	_, err := pool.dial("tcp", "", cfg.Address, time.Second)
+	assert.Equal(t, errRefused, err)
+	fail = false
+	for i := 0; i < 2; i++ {
+		netConn, err := pool.dial("tcp", "", cfg.Address, time.Second)
+		assert.NoError(t, err)
+		netConn.Close()
+	}
+
+	stats := pool.DialStats()
+	assert.Equal(t, uint64(1), stats[cfg.Address].Attempts)
+	assert.Equal(t, uint64(1), stats[cfg.Address].Failures)
+	assert.Equal(t, uint64(2), stats["pipe"].Attempts)
+	assert.Equal(t, uint64(0), stats["pipe"].Failures)
+	assert.Equal(t, uint64(2), stats["pipe"].Latency[0])
+}
+
+func TestNewOLTP(t *testing.T) {
+	pool, err := NewOLTP(Config{Address: "db:3306", MaxConnections: 7})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, uint(7), pool.config.MaxConnections, "Settings in the base configuration are kept")
+	assert.Equal(t, "db:3306", pool.config.Address)
+	assert.Equal(t, oltpProfile.RequestTimeout, pool.config.RequestTimeout)
+	assert.True(t, pool.config.KeepConnectionsAlive)
+
+	pool, err = NewReporting(Config{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, reportingProfile.MaxResultRows, pool.config.MaxResultRows)
+	}
+}
+
+func TestPool_Name(t *testing.T) {
+	pool, _ := fullPool(t, WithName("reports"))
+	assert.Equal(t, "reports", pool.Name())
+	_, err := pool.get(context.Background(), time.Millisecond)
+	assert.EqualError(t, err, "Pool reports: Timeout reached while waiting for SQL connection (total: 1, avail: 0, max: 1)")
+}
+
+func TestPoolError(t *testing.T) {
+	pool, _ := fullPool(t, WithName("reports"))
+	_, err := pool.get(context.Background(), time.Millisecond)
+	var poolErr *PoolError
+	if assert.True(t, errors.As(err, &poolErr)) {
+		assert.Equal(t, "reports", poolErr.Pool)
+		assert.Equal(t, "get", poolErr.Op)
+	}
+	assert.True(t, errors.Is(err, ErrPoolExhausted))
+	assert.True(t, errors.Is(err, ErrAcquireTimeout))
+
+	// Failing to connect is told apart from the pool being exhausted
+	pool, err = New(WithName("reports"), WithAddress("unix", "/nonexistent.sock"), WithMaxConns(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = pool.Get()
+	if assert.True(t, errors.As(err, &poolErr)) {
+		assert.Equal(t, "connect", poolErr.Op)
+	}
+	assert.False(t, errors.Is(err, ErrPoolExhausted))
+	var netErr *net.OpError
+	assert.True(t, errors.As(err, &netErr))
+	assert.Equal(t, "Pool reports: "+netErr.Error(), err.Error())
+}
+
+func TestConfig_AcquireTimeout(t *testing.T) {
+	pool, _ := fullPool(t, Config{ConnectTimeout: 10, AcquireTimeout: 1})
+	assert.Equal(t, time.Second, pool.acquireTimeout)
+	start := time.Now()
+	_, err := pool.Get()
+	assert.True(t, time.Since(start) < 5*time.Second, "Get should wait for the acquire timeout, not the connect timeout")
+	var timeoutErr *AcquireTimeoutError
+	if assert.True(t, errors.As(err, &timeoutErr)) {
+		assert.True(t, errors.Is(err, ErrAcquireTimeout))
+		assert.True(t, timeoutErr.Waited >= time.Second)
+	}
+
+	// The connect timeout is used by default
+	pool, err = New(Config{ConnectTimeout: 10})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 10*time.Second, pool.acquireTimeout)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.Equal(t, ErrCollationWithoutCharset, Config{Collation: "utf8mb4_bin"}.Validate())
+	assert.Equal(t, ErrUnknownProtocol, Config{Protocol: "udp"}.Validate())
+	assert.Equal(t, ErrNoAddress, Config{Protocol: "unix"}.Validate())
+	assert.NoError(t, Config{Protocol: "unix", Addresses: []string{"/a.sock", "/b.sock"}}.Validate())
+	assert.Equal(t, ErrMinIdleAboveMax, Config{MinIdleConnections: 11}.Validate(), "The default MaxConnections should apply")
+	assert.NoError(t, Config{MinIdleConnections: 10}.Validate())
+	assert.Equal(t, ErrProxyWithSSH, Config{Proxy: "socks5://proxy:1080", SSH: &SSHConfig{}}.Validate())
+	assert.Equal(t, ErrTimeoutsWithSSH, Config{ReadTimeout: 5, SSH: &SSHConfig{}}.Validate())
+	assert.NoError(t, Config{TenantVariable: "app.tenant_id"}.Validate())
+	assert.Equal(t, ErrInvalidTenantVariable, Config{TenantVariable: "x = 1, @y"}.Validate())
+
+	_, err := New(Config{Collation: "utf8mb4_bin"})
+	assert.Equal(t, ErrCollationWithoutCharset, err, "New should reject an invalid configuration")
+
+	pool, err := New(Config{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint(DefaultMaxConnections), pool.config.MaxConnections)
+		assert.Equal(t, uint(DefaultConnectTimeout), pool.config.ConnectTimeout)
+		assert.Equal(t, uint(DefaultRequestTimeout), pool.config.RequestTimeout)
+		assert.Equal(t, DefaultProtocol, pool.config.Protocol)
+		assert.Equal(t, DefaultAddress, pool.config.Address)
+	}
+	pool, err = New(Config{Address: "/tmp/mysql.sock"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "unix", pool.config.Protocol, "A path should be taken for a Unix socket")
+	}
+}
+
+func TestPool_Stats(t *testing.T) {
+	pool, _ := fullPool(t)
+	_, err := pool.get(context.Background(), time.Millisecond)
+	assert.Error(t, err)
+	stats := pool.Stats()
+	assert.Equal(t, uint64(1), stats.Gets)
+	assert.Equal(t, uint64(1), stats.Waits)
+	assert.Equal(t, uint64(1), stats.Timeouts)
+	assert.True(t, stats.WaitDuration >= time.Millisecond)
+
+	pool.observeQuery(time.Now())
+	pool.observeQuery(time.Now().Add(-2 * time.Millisecond))
+	pool.observeQuery(time.Now().Add(-time.Minute))
+	stats = pool.Stats()
+	assert.Equal(t, uint64(1), stats.QueryLatency[0])
+	assert.Equal(t, uint64(1), stats.QueryLatency[1])
+	assert.Equal(t, uint64(1), stats.QueryLatency[len(QueryLatencyBuckets)])
+	assert.True(t, stats.QueryDuration >= time.Minute)
+}
+
+func TestPool_Stats_conns(t *testing.T) {
+	pool := getPool(t, config)
+	conns, err := pool.GetN(3, time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, conns[0].Release())
+	conns[1].Destroy()
+	assert.Equal(t, 1, pool.Shrink(1))
+
+	stats := pool.Stats()
+	assert.Equal(t, uint64(3), stats.Gets)
+	assert.Equal(t, uint64(3), stats.Opened)
+	assert.Equal(t, uint64(2), stats.Closed)
+	assert.Equal(t, map[DestroyReason]uint64{DestroyedByCaller: 1, DestroyedIdle: 1}, stats.Destroys)
+	assert.Equal(t, uint64(1), stats.IdleEvictions)
+	assert.Equal(t, 1, stats.InUse)
+	assert.Equal(t, 3, stats.MaxInUse)
+	assert.NoError(t, conns[2].Release())
+}
+
+func TestFingerprint(t *testing.T) {
+	for sql, fingerprint := range map[string]string{
+		"SELECT name FROM users WHERE id = 42":                       "select name from users where id = ?",
+		"select  name\n from users  where id=7 -- lookup":            "select name from users where id=?",
+		"INSERT INTO t VALUES ('it''s', \"a\\\"b\", 1.5e3, x1)":      "insert into t values (?, ?, ?, x1)",
+		"SELECT * FROM `Users` /* hint */ WHERE a = 1; DROP TABLE t": "select * from `Users` where a = ?; drop table t",
+		"/*!50000 TRUNCATE */ t":                                     "truncate t",
+	} {
+		assert.Equal(t, fingerprint, Fingerprint(sql), sql)
+	}
+}
+
+func TestSplitScript(t *testing.T) {
+	script := `-- Schema
+CREATE TABLE t (a VARCHAR(10) DEFAULT ';');  # trailing comment
+/* block; comment */
+INSERT INTO t VALUES ('it''s;', "a\";b", 1);
+/*!40101 SET NAMES utf8 */;
+
+DELIMITER //
+CREATE PROCEDURE p()
+BEGIN
+  SELECT 1; SELECT ` + "`x;y`" + `;
+END//
+delimiter ;
+SELECT 2 -- no delimiter`
+	assert.Equal(t, []ScriptStatement{
+		{"CREATE TABLE t (a VARCHAR(10) DEFAULT ';')", 2},
+		{`INSERT INTO t VALUES ('it''s;', "a\";b", 1)`, 4},
+		{"/*!40101 SET NAMES utf8 */", 5},
+		{"CREATE PROCEDURE p()\nBEGIN\n  SELECT 1; SELECT `x;y`;\nEND", 8},
+		{"SELECT 2 -- no delimiter", 13},
+	}, SplitScript(script))
+	assert.Empty(t, SplitScript("  -- nothing\n;;\n"))
+}
+
+func TestConn_ExecScript(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	server.Handle("SELECT * FROM script", &testsupport.Response{Columns: []string{"a"}, Rows: [][]interface{}{{1}, {2}}})
+	server.Handle("INSERT INTO missing VALUES (3)", &testsupport.Response{Err: &mysql.Error{Code: 1146, Msg: []byte("Table 'test.missing' doesn't exist")}})
+	pool, err := New(Config{Protocol: "tcp", Address: server.Addr(), MaxConnections: 1, RequestTimeout: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	assert.NoError(t, conn.ExecScript(`CREATE TEMPORARY TABLE script (a INT);
+INSERT INTO script VALUES (1), (2);
+SELECT * FROM script`))
+
+	before := len(server.Queries())
+	err = conn.ExecScript(`INSERT INTO script VALUES (1), (2);
+SELECT * FROM script;
+
+INSERT INTO missing VALUES (3);
+INSERT INTO script VALUES (4)`)
+	var scriptErr *ScriptError
+	if assert.True(t, errors.As(err, &scriptErr)) {
+		assert.Equal(t, 4, scriptErr.Statement.Line)
+		assert.Equal(t, "INSERT INTO missing VALUES (3)", scriptErr.Statement.SQL)
+		assert.Equal(t, uint16(1146), scriptErr.Err.(*mysql.Error).Code)
+	}
+	assert.Equal(t, []string{"INSERT INTO script VALUES (1), (2)", "SELECT * FROM script", "INSERT INTO missing VALUES (3)"},
+		server.Queries()[before:], "Statements after the failure should not run")
+	assert.True(t, conn.IsConnected(), "A failing statement shouldn't cost the connection")
+}
+
+func TestStatementGuard(t *testing.T) {
+	guard := &StatementGuard{
+		Allow: []*regexp.Regexp{regexp.MustCompile(`^(select|insert|drop)\b`)},
+		Deny:  []*regexp.Regexp{regexp.MustCompile(`^(drop|truncate)\b`)},
+	}
+	assert.NoError(t, guard.Check("SELECT 1"))
+	assert.NoError(t, guard.Check("INSERT INTO t VALUES (1)"))
+	err := guard.Check("SELECT 1; Drop Table users")
+	assert.True(t, errors.Is(err, ErrStatementDenied))
+	assert.EqualError(t, err, "Statement rejected by the pool's statement guard: drop table users")
+	assert.Error(t, guard.Check("UPDATE t SET a = 1"), "Statements not allowed should be rejected")
+
+	// Statements are checked before they reach the server
+	pool, err := New(Config{StatementGuard: guard})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := &Conn{pool: pool, state: stateInUse}
+	_, _, err = conn.Query("DROP TABLE %s", "users")
+	assert.True(t, errors.Is(err, ErrStatementDenied))
+	_, err = conn.Prepare("TRUNCATE t")
+	assert.True(t, errors.Is(err, ErrStatementDenied))
+	_, err = conn.Pipeline().Queue("SELECT 1").Queue("DROP TABLE t").Flush()
+	assert.True(t, errors.Is(err, ErrStatementDenied))
+}
+
+func TestMasking(t *testing.T) {
+	assert.Nil(t, Redact(nil))
+	assert.Equal(t, "****", Redact("secret"))
+	assert.Nil(t, Redact(int64(42)))
+	assert.Equal(t, []byte("*****6789"), KeepLast(4)([]byte("123456789")))
+	assert.Equal(t, "**é", KeepLast(1)("ééé"))
+	assert.Equal(t, "12", KeepLast(4)("12"))
+
+	masking := &Masking{Columns: map[string]MaskFunc{
+		"USERS.Name": KeepLast(2),
+		"created":    Redact,
+		"orders.id":  Redact,
+	}}
+	pool, err := New(WithMasking(masking))
+	if !assert.NoError(t, err) {
+		return
+	}
+	newResult := func() *Result {
+		result := newFakePoolResult(2)
+		result.conn.pool = pool
+		result.conn.masking = pool.config.Masking
+		result.Result.(*fakeResult).fields = []*mysql.Field{
+			{Name: "id", OrgName: "id", OrgTable: "users"},
+			{Name: "alias", OrgName: "name", OrgTable: "users"},
+			{Name: "created"},
+		}
+		return result
+	}
+
+	// Columns are matched by their name in the table
+	rows, err := newResult().GetRows()
+	assert.NoError(t, err)
+	if assert.Len(t, rows, 2) {
+		assert.Equal(t, mysql.Row{[]byte("1"), []byte("**me"), []byte("2014-01-01 00:00:00")}, rows[1])
+	}
+
+	var (
+		id      int
+		name    string
+		created []byte
+	)
+	assert.NoError(t, newResult().Scan(&id, &name, &created))
+	assert.Equal(t, "**me", name)
+
+	row, err := newResult().GetPooledRow()
+	if assert.NoError(t, err) && assert.NotNil(t, row) {
+		assert.Equal(t, "**me", row.Str(1))
+		row.Release()
+	}
+}
+
+func TestPool_Dump(t *testing.T) {
+	pool, err := New(Config{Name: "orders", Password: "secret", Debug: true, MaxConnections: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := &Conn{pool: pool, state: stateInUse, createdAt: time.Now(), borrowID: 7}
+	conn.recordBorrow()
+	pool.openConnections[conn] = struct{}{}
+
+	go pool.get(context.Background(), time.Second)
+	for waiting := 0; waiting == 0; {
+		time.Sleep(time.Millisecond)
+		pool.mutex.Lock()
+		waiting = len(pool.waiters)
+		pool.mutex.Unlock()
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, pool.Dump(&buf))
+	dump := buf.String()
+	assert.Contains(t, dump, "Pool orders at ")
+	assert.Contains(t, dump, "1 open of 1, 1 in use, 0 idle, 1 waiting")
+	assert.Contains(t, dump, "borrow 7 held for ")
+	assert.Contains(t, dump, "TestPool_Dump", "Stacks should be recorded in debug mode")
+	assert.NotContains(t, dump, "secret")
+}
+
+func TestClusterPool(t *testing.T) {
+	cluster, err := NewCluster(ClusterConfig{
+		Config:   Config{Name: "orders", Protocol: "tcp"},
+		Primary:  "db1:3306",
+		Replicas: []string{"db2:3306", "db3:3306"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cluster.Close()
+	primary, replicas := cluster.Primary(), cluster.Replicas()
+	assert.Equal(t, "orders-primary", primary.Name())
+	assert.Equal(t, "db1:3306", primary.config.Address)
+	if !assert.Len(t, replicas, 2) {
+		return
+	}
+	assert.Equal(t, "orders-replica2", replicas[1].Name())
+	assert.Equal(t, "db3:3306", replicas[1].config.Address)
+
+	// Only read-only statements go to the replicas, in turn by default
+	assert.Equal(t, replicas[0], routed(cluster, context.Background(), "SELECT * FROM orders"))
+	assert.Equal(t, replicas[1], routed(cluster, context.Background(), "show tables"))
+	assert.Equal(t, replicas[0], routed(cluster, context.Background(), "SELECT 1; EXPLAIN SELECT 2"))
+	for _, sql := range []string{
+		"UPDATE orders SET paid = 1",
+		"SELECT * FROM orders WHERE id = 1 FOR UPDATE",
+		"SELECT * FROM orders LOCK IN SHARE MODE",
+		"SELECT id INTO @id FROM orders",
+		"SELECT 1; DELETE FROM orders",
+		"/* comment only */",
+	} {
+		assert.Equal(t, primary, routed(cluster, context.Background(), sql), sql)
+	}
+
+	assert.Contains(t, replicas, Random{}.Pick(replicas))
+	replicas[0].openConnections[&Conn{state: stateInUse}] = struct{}{}
+	assert.Equal(t, replicas[1], LeastConnections{}.Pick(replicas))
+}
+
+func TestClusterPool_session(t *testing.T) {
+	cluster, err := NewCluster(ClusterConfig{
+		Config:               Config{Protocol: "tcp"},
+		Primary:              "db1:3306",
+		Replicas:             []string{"db2:3306"},
+		ReadYourWritesWindow: 60,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cluster.Close()
+	primary, replica := cluster.Primary(), cluster.Replicas()[0]
+
+	ctx := WithSession(context.Background())
+	assert.Equal(t, replica, routed(cluster, ctx, "SELECT * FROM orders"), "Reads before a write should go to a replica")
+	assert.Equal(t, primary, routed(cluster, ctx, "UPDATE orders SET paid = 1"))
+	assert.Equal(t, primary, routed(cluster, ctx, "SELECT * FROM orders"), "Reads after a write should be pinned to the primary")
+	derived, cancel := context.WithCancel(ctx)
+	defer cancel()
+	assert.Equal(t, primary, routed(cluster, derived, "SELECT * FROM orders"), "Derived contexts should share the session")
+
+	// Other sessions and calls without a session are unaffected
+	assert.Equal(t, replica, routed(cluster, WithSession(context.Background()), "SELECT * FROM orders"))
+	assert.Equal(t, replica, routed(cluster, context.Background(), "SELECT * FROM orders"))
+
+	// Once the window has passed, reads go back to the replicas
+	cluster.window = 0
+	assert.Equal(t, replica, routed(cluster, ctx, "SELECT * FROM orders"))
+}
+
+func TestClusterPool_session_longWrite(t *testing.T) {
+	cluster, err := NewCluster(ClusterConfig{
+		Config:   Config{Protocol: "tcp", KeepConnectionsAlive: true, RequestTimeout: 10},
+		Primary:  "db1:3306",
+		Replicas: []string{"db2:3306"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cluster.Close()
+	primary, replica := cluster.Primary(), cluster.Replicas()[0]
+	conn, err := primary.Adopt(fakeDriverConn{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, conn.Release())
+
+	// The write takes longer than the window, which is counted from when it
+	// is done
+	cluster.window = 50 * time.Millisecond
+	ctx := WithSession(context.Background())
+	conn, err = cluster.GetForContext(ctx, "UPDATE orders SET paid = 1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	time.Sleep(2 * cluster.window)
+	assert.Equal(t, replica, routed(cluster, ctx, "SELECT * FROM orders"), "The write's start has passed out of the window")
+	assert.NoError(t, conn.Release())
+	assert.Equal(t, primary, routed(cluster, ctx, "SELECT * FROM orders"), "Reads after the write should be pinned to the primary")
+}
+
+// routed returns the pool the cluster routes the given SQL to.
+func routed(cluster *ClusterPool, ctx context.Context, sql string) *Pool {
+	pool, _ := cluster.route(ctx, sql)
+	return pool
+}
+
+func TestClusterPool_Promote(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	var promoted []*Pool
+	cluster, err := NewCluster(ClusterConfig{
+		Config:       Config{Protocol: "tcp", ConnectTimeout: 1},
+		Primary:      server.Addr(),
+		Replicas:     []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"},
+		AutoPromote:  true,
+		PromoteAfter: 2,
+		OnPromote: func(old, new *Pool) {
+			promoted = append(promoted, old, new)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer cluster.Close()
+	primary, replicas := cluster.Primary(), cluster.Replicas()
+	assert.NotNil(t, primary.config.HealthCheck, "AutoPromote should turn on health checks")
+
+	// A primary that fails its health checks but can still be reached is kept
+	checked := time.Now()
+	fail := func(pool *Pool) {
+		checked = checked.Add(time.Second)
+		pool.health = HealthStatus{CheckedAt: checked}
+	}
+	for i := 0; i < 3; i++ {
+		fail(primary)
+		cluster.promoteIfDown()
+	}
+	assert.Equal(t, primary, cluster.Primary(), "A reachable primary should be kept")
+
+	assert.NoError(t, cluster.Promote(replicas[1]))
+	assert.Equal(t, replicas[1], cluster.Primary())
+	assert.Equal(t, []*Pool{replicas[0], replicas[2]}, cluster.Replicas())
+	assert.Equal(t, replicas[1], routed(cluster, context.Background(), "UPDATE orders SET paid = 1"), "Writes should go to the new primary")
+	assert.True(t, primary.closed(), "The old primary should be closed")
+	assert.Equal(t, []*Pool{primary, replicas[1]}, promoted)
+	assert.Len(t, replicas, 3, "Slices returned earlier should be left alone")
+	assert.Equal(t, ErrNotReplica, cluster.Promote(primary))
+
+	// A primary that fails enough health checks in a row, and can't be
+	// reached, is replaced by the first healthy replica
+	cluster.promoteIfDown()
+	assert.Equal(t, replicas[1], cluster.Primary(), "A healthy primary should be kept")
+	fail(replicas[0])
+	fail(replicas[1])
+	cluster.promoteIfDown()
+	cluster.promoteIfDown()
+	assert.Equal(t, replicas[1], cluster.Primary(), "A single failed check shouldn't promote a replica")
+	checked = checked.Add(time.Second)
+	replicas[1].health = HealthStatus{Healthy: true, CheckedAt: checked}
+	cluster.promoteIfDown()
+	fail(replicas[1])
+	cluster.promoteIfDown()
+	assert.Equal(t, replicas[1], cluster.Primary(), "Failures should have to be in a row")
+	fail(replicas[1])
+	cluster.promoteIfDown()
+	assert.Equal(t, replicas[2], cluster.Primary())
+	assert.Equal(t, []*Pool{replicas[0]}, cluster.Replicas())
+}
+
+func TestPool_failover(t *testing.T) {
+	pool, err := New(Config{FailoverThreshold: 2}, WithFailover("unix", "/nonexistent/a.sock", "/nonexistent/b.sock"), WithMaxConns(10))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+
+	// The preferred host is used until it has failed too often
+	_, err = pool.Get()
+	assert.Error(t, err)
+	assert.Equal(t, "/nonexistent/a.sock", pool.hosts.pick())
+	_, err = pool.Get()
+	assert.Error(t, err)
+	assert.Equal(t, "/nonexistent/b.sock", pool.hosts.pick())
+	assert.Equal(t, []HostStatus{
+		{"/nonexistent/a.sock", false, 2},
+		{"/nonexistent/b.sock", true, 0},
+	}, pool.Hosts())
+
+	// A host that recovers is preferred again
+	pool.hosts.report("/nonexistent/a.sock", nil)
+	assert.Equal(t, "/nonexistent/a.sock", pool.hosts.pick())
+
+	// If every host is unhealthy, the most preferred one is tried
+	for i := 0; i < 2; i++ {
+		pool.hosts.report("/nonexistent/a.sock", io.EOF)
+		pool.hosts.report("/nonexistent/b.sock", io.EOF)
+	}
+	assert.Equal(t, "/nonexistent/a.sock", pool.hosts.pick())
+	pool.probeHosts()
+	assert.Equal(t, uint(3), pool.Hosts()[1].Failures)
+}
+
+func TestPool_circuitBreaker(t *testing.T) {
+	pool, err := New(Config{CircuitThreshold: 2}, WithAddress("unix", "/nonexistent.sock"), WithMaxConns(10))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+
+	// The breaker opens after too many failures in a row
+	for i := 0; i < 2; i++ {
+		_, err = pool.Get()
+		assert.False(t, errors.Is(err, ErrCircuitOpen))
+	}
+	_, err = pool.Get()
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+	var netErr *net.OpError
+	assert.True(t, errors.As(err, &netErr), "The last connection error should be kept")
+
+	// Once the backoff has passed, one probe is let through
+	pool.breaker.openUntil = time.Now()
+	_, err = pool.Get()
+	assert.False(t, errors.Is(err, ErrCircuitOpen))
+	_, err = pool.Get()
+	assert.True(t, errors.Is(err, ErrCircuitOpen))
+
+	pool.breaker.openUntil = time.Now()
+	assert.NoError(t, pool.breaker.allow())
+	assert.True(t, errors.Is(pool.breaker.allow(), ErrCircuitOpen), "Only one probe should be let through")
+	pool.breaker.report(nil)
+	assert.NoError(t, pool.breaker.allow())
+}
+
+// testLogger records the messages logged by a pool.
+type testLogger struct {
+	mutex    sync.Mutex
+	messages []string
+}
+
+func (l *testLogger) logf(level, format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages = append(l.messages, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Debugf(format string, args ...interface{}) { l.logf("DEBUG", format, args...) }
+func (l *testLogger) Infof(format string, args ...interface{})  { l.logf("INFO", format, args...) }
+func (l *testLogger) Warnf(format string, args ...interface{})  { l.logf("WARN", format, args...) }
+func (l *testLogger) Errorf(format string, args ...interface{}) { l.logf("ERROR", format, args...) }
+
+func TestConfig_Logger(t *testing.T) {
+	logger := &testLogger{}
+	pool, err := New(Config{Name: "orders", CircuitThreshold: 1, CircuitBackoff: 10},
+		WithAddress("unix", "/nonexistent.sock"), WithMaxConns(1), WithLogger(logger))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = pool.Get()
+	assert.Error(t, err)
+	assert.NoError(t, pool.Close())
+
+	if assert.Len(t, logger.messages, 3) {
+		assert.Regexp(t, "^ERROR Pool orders: Not connecting for 10s after 1 failed attempts in a row$", logger.messages[0])
+		assert.Regexp(t, "^WARN Pool orders: Can't connect to /nonexistent.sock: ", logger.messages[1])
+		assert.Equal(t, "INFO Pool orders: Closed the pool", logger.messages[2])
+	}
+
+	var buf bytes.Buffer
+	std := StdLogger(log.New(&buf, "", 0), false)
+	std.Debugf("dropped")
+	std.Warnf("kept %d", 1)
+	assert.Equal(t, "WARN kept 1\n", buf.String())
+}
+
+func TestPool_AllowRetry(t *testing.T) {
+	cfg := config
+	cfg.RetryRate = 1
+	cfg.RetryBurst = 2
+	pool := getPool(t, cfg)
+	assert.True(t, pool.AllowRetry())
+	assert.True(t, pool.AllowRetry())
+	assert.False(t, pool.AllowRetry())
+	stats := pool.RetryStats()
+	assert.Equal(t, uint64(2), stats.Allowed)
+	assert.Equal(t, uint64(1), stats.Denied)
+	assert.True(t, stats.Tokens < 1)
+
+	// The budget refills over time, up to the burst
+	pool.retriesRefilled = pool.retriesRefilled.Add(-time.Minute)
+	assert.Equal(t, float64(2), pool.RetryStats().Tokens)
+	assert.True(t, pool.AllowRetry())
+
+	// Without a rate, retries are unlimited
+	pool = getPool(t, config)
+	for i := 0; i < 5; i++ {
+		assert.True(t, pool.AllowRetry())
+	}
+}
+
+func TestPool_RetryPolicy(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	failures := map[string]int{}
+	var mutex sync.Mutex
+	server.HandleFunc(func(sql string) *testsupport.Response {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failures[sql] > 0 {
+			failures[sql]--
+			return &testsupport.Response{Err: &mysql.Error{Code: 1213, Msg: []byte("Deadlock found when trying to get lock")}}
+		}
+		return nil
+	})
+	fail := func(sql string, n int) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		failures[sql] = n
+	}
+	pool, err := New(Config{Protocol: "tcp", Address: server.Addr(), MaxConnections: 2, RequestTimeout: 1,
+		RetryPolicy: &RetryPolicy{Backoff: time.Millisecond}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+
+	fail("UPDATE t SET n = n + 1", 2)
+	_, err = pool.Exec("UPDATE t SET n = n + 1")
+	assert.NoError(t, err, "Deadlocks are retried")
+	assert.Equal(t, uint64(2), pool.RetryStats().Allowed)
+
+	fail("UPDATE t SET n = n + 1", 3)
+	_, err = pool.Exec("UPDATE t SET n = n + 1")
+	if assert.IsType(t, &mysql.Error{}, err, "Attempts are limited") {
+		assert.Equal(t, uint16(1213), err.(*mysql.Error).Code)
+	}
+
+	// Transactions are run again from the start
+	fail("UPDATE t SET n = 0", 1)
+	calls := 0
+	err = pool.WithTransaction(func(tx *Transaction) error {
+		calls++
+		if _, err := tx.Exec("UPDATE t SET n = 0"); err != nil {
+			return fmt.Errorf("Resetting: %w", err)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	// Other errors aren't retried
+	pool.config.RetryPolicy.Codes = []uint16{1205}
+	fail("UPDATE t SET n = n + 1", 1)
+	_, err = pool.Exec("UPDATE t SET n = n + 1")
+	assert.Error(t, err)
+
+	policy := &RetryPolicy{Backoff: time.Second, MaxBackoff: 3 * time.Second}
+	assert.Equal(t, time.Second, policy.backoff(1))
+	assert.Equal(t, 2*time.Second, policy.backoff(2))
+	assert.Equal(t, 3*time.Second, policy.backoff(3))
+}
+
+func TestConn_retireBy(t *testing.T) {
+	conn := &Conn{}
+	assert.False(t, conn.expired(), "Connections without a maximum age never expire")
+
+	conn.retireBy(time.Now().Add(time.Hour))
+	assert.False(t, conn.expired())
+	conn.retireBy(time.Now().Add(2 * time.Hour))
+	assert.False(t, conn.expired(), "Retirement is never postponed")
+	conn.retireBy(time.Now().Add(-time.Second))
+	assert.True(t, conn.expired())
+}
+
+func TestPool_Recycle(t *testing.T) {
+	pool := getPool(t, config)
+	conns, err := pool.GetN(3, time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, conns[0].Release())
+	assert.NoError(t, conns[1].Release())
+
+	// With no ramp, idle connections are retired straight away and the one in
+	// use as soon as it is released
+	pool.Recycle("credentials rotated")
+	total, avail := pool.Size()
+	assert.Equal(t, 1, total, "Pool size should be 1")
+	assert.Equal(t, 0, avail, "Number of available connections should be 0")
+	assert.NoError(t, conns[2].Release())
+	total, _ = pool.Size()
+	assert.Equal(t, 0, total, "Pool size should be 0")
+
+	reason, _ := pool.LastRecycle()
+	assert.Equal(t, "credentials rotated", reason)
+}
+
+func TestPool_Recycle_options(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	pool, err := New(Config{Protocol: "unix", Address: "/nonexistent.sock", MaxConnections: 1, ConnectTimeout: 1, KeepConnectionsAlive: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	_, err = pool.Get()
+	assert.Error(t, err)
+
+	assert.Equal(t, ErrUnknownProtocol, pool.Recycle("moved", WithAddress("udp", server.Addr())))
+	assert.Equal(t, "unix", pool.endpoint().Protocol, "An invalid configuration should not be applied")
+
+	assert.NoError(t, pool.Recycle("moved", WithAddress("tcp", server.Addr()), WithCredentials("bob", "secret"), WithMaxConns(5)))
+	conn, err := pool.Get()
+	if assert.NoError(t, err, "New connections should be opened to the new address") {
+		assert.NoError(t, conn.Release())
+	}
+	assert.Equal(t, []HostStatus{{Address: server.Addr(), Healthy: true}}, pool.Hosts())
+	assert.Equal(t, "bob", pool.endpoint().Username)
+	assert.Equal(t, uint(1), pool.config.MaxConnections, "Only the address, credentials and database should change")
+}
+
+func TestPool_refreshOldest(t *testing.T) {
+	pool := getPool(t, config)
+	conns, err := pool.GetN(4, time.Second)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, conn := range conns {
+		assert.NoError(t, conn.Release())
+	}
+
+	// A quarter of four connections is exactly one, the oldest
+	pool.refreshOldest(0.25)
+	total, _ := pool.Size()
+	assert.Equal(t, 3, total, "Pool size should be 3")
+	assert.Nil(t, conns[0].pool)
+	assert.NotNil(t, conns[1].pool)
+
+	// A fraction of a connection is rounded up
+	pool.refreshOldest(0.01)
+	total, _ = pool.Size()
+	assert.Equal(t, 2, total, "Pool size should be 2")
+}
+
+func TestConn_Annotate(t *testing.T) {
+	conn := &Conn{pool: getPool(t, config), borrowID: 7}
+	_, ok := BorrowIDFromContext(context.Background())
+	assert.False(t, ok)
+	id, ok := BorrowIDFromContext(conn.Annotate(context.Background()))
+	assert.True(t, ok)
+	assert.Equal(t, uint64(7), id)
+
+	assert.Equal(t, "SELECT 1", conn.tag("SELECT 1"))
+	cfg := config
+	cfg.TagQueries = true
+	conn.pool = getPool(t, cfg)
+	assert.Equal(t, "/* borrow:7 */ SELECT 1", conn.tag("SELECT 1"))
+}
+
+func TestResponder(t *testing.T) {
+	pool := getPool(t, config)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	conn, err := NewResponder(pool, req)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The client disconnects while the query is running
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	_, _, err = conn.Query("SELECT SLEEP(5)")
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "The query should have been killed")
+
+	// The connection survives and is unbound from the request on release
+	assert.NotNil(t, conn.pool)
+	assert.NoError(t, conn.Release())
+	c, err := pool.Get()
+	if assert.NoError(t, err) {
+		_, _, err = c.Query("SELECT 1")
+		assert.NoError(t, err)
+		c.Release()
+	}
+}
+
+func TestConn_withTimeout(t *testing.T) {
+	pool := getPool(t, config)
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i += 2 {
+		wg.Add(1)
+		go func(i int) {
+			conn, err := pool.Get()
+			if assert.NoError(t, err) && assert.NotNil(t, conn) {
+				err := conn.withTimeout("SLEEP", func() error {
+					time.Sleep(time.Duration(i) * time.Second)
+					return nil
+				})
+				if uint(i) < config.RequestTimeout {
+					assert.NoError(t, err)
+				} else {
+					assert.Error(t, err)
+				}
+				conn.Release()
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestResult_timeout(t *testing.T) {
+	cfg := config
+	cfg.RequestTimeout = 1
+	pool := getPool(t, cfg)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	// Reading the result shares the time allowed for the query
+	res, err := conn.Start("SELECT 1 UNION SELECT 2")
+	if !assert.NoError(t, err) {
+		return
+	}
+	row, err := res.GetRow()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, row.Int(0))
+	time.Sleep(1100 * time.Millisecond)
+	_, err = res.GetRow()
+	assert.Equal(t, ErrRequestTimeout, err)
+}
+
+func TestPool_Go(t *testing.T) {
+	pool := getPool(t, config)
+
+	// Errors are passed through and the connection is returned to the pool
+	errFailed := errors.New("failed")
+	var borrowed *Conn
+	err := pool.Go(context.Background(), func(conn *Conn) error {
+		borrowed = conn
+		_, _, err := conn.QueryFirst("SELECT 1")
+		assert.NoError(t, err)
+		return errFailed
+	})
+	assert.Equal(t, errFailed, err)
+	assert.Equal(t, stateIdle, borrowed.state)
+
+	// Cancellation kills the running query
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = pool.Go(ctx, func(conn *Conn) error {
+		_, _, err := conn.QueryFirst("SELECT SLEEP(5)")
+		return err
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, context.DeadlineExceeded, pool.Go(ctx, func(conn *Conn) error {
+		t.Error("fn called with a cancelled context")
+		return nil
+	}))
+
+	// Panics destroy the connection and are propagated
+	assert.PanicsWithValue(t, "boom", func() {
+		pool.Go(context.Background(), func(conn *Conn) error {
+			borrowed = conn
+			panic("boom")
+		})
+	})
+	assert.Equal(t, stateDestroyed, borrowed.state)
+}
+
+func TestPool_ConnStats(t *testing.T) {
+	pool := getPool(t, config)
+	for i := 0; i < 3; i++ {
+		conn, err := pool.Get()
+		if !assert.NoError(t, err) {
+			return
+		}
+		_, _, err = conn.Query("SELECT 1")
+		assert.NoError(t, err)
+		assert.NoError(t, conn.Ping())
+		conn.Release()
+	}
+	stats := pool.ConnStats()
+	assert.Equal(t, uint64(3), stats.Borrows)
+	assert.Equal(t, uint64(6), stats.Requests)
+	assert.True(t, stats.BytesSent > 0)
+	assert.True(t, stats.BytesReceived > 0)
+
+	// The statistics survive the connections
+	pool.Shrink(numConns)
+	retired := pool.ConnStats()
+	assert.Equal(t, stats.Borrows, retired.Borrows)
+	assert.Equal(t, stats.Requests, retired.Requests)
+	assert.True(t, retired.BytesSent >= stats.BytesSent)
+	assert.Equal(t, stats.BytesReceived, retired.BytesReceived)
+}
+
+func TestPool_Adopt(t *testing.T) {
+	pool := getPool(t, config)
+	driverConn := mysql.New(config.Protocol, "", config.Address, config.Username, config.Password, config.Database)
+	if !assert.NoError(t, driverConn.Connect()) {
+		return
+	}
+	conn, err := pool.Adopt(driverConn)
+	if !assert.NoError(t, err) {
+		return
+	}
+	row, _, err := conn.QueryFirst("SELECT 1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, row.Int(0))
+	assert.NoError(t, conn.Release())
+
+	total, avail := pool.Size()
+	assert.Equal(t, 1, total, "Pool size should be 1")
+	assert.Equal(t, 1, avail, "Number of available connections should be 1")
+	assert.Equal(t, uint64(1), pool.Stats().Opened)
+}
+
+func TestConn_Detach(t *testing.T) {
+	pool, err := New(WithAddress("unix", "/nonexistent.sock"), WithMaxConns(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	driverConn := pool.newDriverConn(pool.config.Address)
+	conn := &Conn{Conn: driverConn, pool: pool, state: stateInUse}
+	driverConn.SetDialer(conn.dial)
+	pool.openConnections[conn] = struct{}{}
+
+	detached, err := conn.Detach()
+	assert.NoError(t, err)
+	assert.Equal(t, driverConn, detached)
+	total, _ := pool.Size()
+	assert.Equal(t, 0, total, "The connection's slot should be freed")
+	assert.Equal(t, uint64(1), pool.Stats().Detached)
+
+	// The detached connection still dials through the pool
+	err = detached.Reconnect()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "/nonexistent.sock")
+	}
+
+	_, err = conn.Detach()
+	assert.True(t, errors.Is(err, ErrConnClosed))
+	assert.Error(t, conn.Release())
+}
+
+func TestConfig_OnDestroy(t *testing.T) {
+	var reasons []DestroyReason
+	pool, err := New(Config{OnDestroy: func(conn *Conn, reason DestroyReason) {
+		reasons = append(reasons, reason)
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := &Conn{Conn: pool.newDriverConn(""), pool: pool, state: stateInUse}
+	pool.openConnections[conn] = struct{}{}
+	conn.Destroy()
+	conn.Destroy()
+	assert.Equal(t, []DestroyReason{DestroyedByCaller}, reasons, "OnDestroy should be called once")
+}
+
+func TestPool_Adopt_full(t *testing.T) {
+	pool, conn := fullPool(t)
+	driverConn := mysql.New("unix", "", "/nonexistent.sock", "user", "", "")
+	_, err := pool.Adopt(driverConn)
+	assert.Equal(t, ErrPoolFull, err)
+	conn.Release()
+
+	assert.NoError(t, pool.Close())
+	_, err = pool.Adopt(driverConn)
+	assert.Equal(t, ErrPoolClosed, err)
+}
+
+func TestConn_MarkBroken(t *testing.T) {
+	var destroyed []error
+	pool, err := New(Config{MaxConnections: 1, KeepConnectionsAlive: true, RequestTimeout: 10,
+		OnDestroy: func(conn *Conn, reason DestroyReason) {
+			assert.Equal(t, DestroyedBroken, reason)
+			destroyed = append(destroyed, conn.Broken())
+		}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := pool.Adopt(fakeDriverConn{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, conn.Broken())
+	reason := errors.New("sql_mode was changed")
+	conn.MarkBroken(reason)
+	assert.Equal(t, reason, conn.Broken())
+	assert.NoError(t, conn.Release())
+	assert.Equal(t, []error{reason}, destroyed)
+	total, _ := pool.Size()
+	assert.Equal(t, 0, total, "The connection should not be kept")
+	assert.Equal(t, uint64(1), pool.Stats().Destroys[DestroyedBroken])
+
+	conn, err = pool.Adopt(fakeDriverConn{})
+	if assert.NoError(t, err) {
+		conn.MarkBroken(nil)
+		assert.NoError(t, conn.Release())
+		assert.Equal(t, []error{reason, ErrMarkedBroken}, destroyed)
+	}
+}
+
+// preparingConn is a healthy driver connection that prepares statements which
+// record when they are deleted.  It records the statements it prepares if
+// prepared is set.
+type preparingConn struct {
+	fakeDriverConn
+	deleted  *[]string
+	prepared *[]string
+}
+
+func (c preparingConn) Prepare(sql string) (mysql.Stmt, error) {
+	if c.prepared != nil {
+		*c.prepared = append(*c.prepared, sql)
+	}
+	return fakeStmt{sql: sql, deleted: c.deleted}, nil
+}
+
+type fakeStmt struct {
+	mysql.Stmt
+	sql     string
+	deleted *[]string
+}
+
+func (s fakeStmt) Delete() error {
+	*s.deleted = append(*s.deleted, s.sql)
+	return nil
+}
+
+func (s fakeStmt) Run(params ...interface{}) (mysql.Result, error) {
+	return newFakeResult(2), nil
+}
+
+func TestConn_Prepare_evict(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 1, RequestTimeout: 10, MaxCachedStatements: 2})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var deleted []string
+	conn := &Conn{Conn: preparingConn{deleted: &deleted}, pool: pool, statements: map[string]*Stmt{}, state: stateInUse}
+	for _, sql := range []string{"SELECT 1", "SELECT 2", "SELECT 1", "SELECT 3", "SELECT 1", "SELECT 4"} {
+		_, err := conn.Prepare(sql)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"SELECT 2", "SELECT 3"}, deleted, "The least recently used statements should be evicted")
+	assert.Len(t, conn.statements, 2)
+	assert.Contains(t, conn.statements, "SELECT 1")
+	assert.Contains(t, conn.statements, "SELECT 4")
+}
+
+func TestConn_Prepare_evictExecuted(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 1, RequestTimeout: 10, MaxCachedStatements: 2})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var deleted []string
+	conn := &Conn{Conn: preparingConn{deleted: &deleted}, pool: pool, statements: map[string]*Stmt{}, state: stateInUse}
+	first, err := conn.Prepare("SELECT 1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Prepare("SELECT 2")
+	assert.NoError(t, err)
+	_, err = first.Run()
+	assert.NoError(t, err)
+	_, err = conn.Prepare("SELECT 3")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SELECT 2"}, deleted, "A statement that was just executed should not be evicted")
+
+	// The statement whose result is being read is kept even though it is the
+	// least recently used
+	conn.unread.Store(&unreadResult{result: &Result{sql: "SELECT 1"}})
+	_, err = conn.Prepare("SELECT 4")
+	assert.NoError(t, err)
+	_, err = conn.Prepare("SELECT 5")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SELECT 2", "SELECT 3", "SELECT 4"}, deleted)
+	assert.Contains(t, conn.statements, "SELECT 1")
+	assert.Contains(t, conn.statements, "SELECT 5")
+	conn.unread.Store((*unreadResult)(nil))
+}
+
+func TestPool_Prepare(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 2, KeepConnectionsAlive: true, RequestTimeout: 10})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var deleted, prepared []string
+	for i := 0; i < 2; i++ {
+		conn := &Conn{Conn: preparingConn{deleted: &deleted, prepared: &prepared}, pool: pool, statements: map[string]*Stmt{}, state: stateIdle}
+		pool.openConnections[conn] = struct{}{}
+		pool.putIdle(conn)
+	}
+
+	stmt, err := pool.Prepare("SELECT * FROM users WHERE id = ?")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"SELECT * FROM users WHERE id = ?"}, prepared)
+	for i := 0; i < 3; i++ {
+		rows, _, err := stmt.Exec(1)
+		assert.NoError(t, err)
+		assert.Len(t, rows, 2)
+	}
+	row, _, err := stmt.ExecFirst(1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "name", row.Str(1))
+	}
+	assert.Len(t, prepared, 1, "The connection the statement was prepared on should be reused")
+	total, avail := pool.Size()
+	assert.Equal(t, 2, total)
+	assert.Equal(t, 2, avail, "Connections should be released")
+
+	// Once the connection that has it is busy, the statement is prepared on
+	// another one
+	conn, err := pool.GetFor(stmt.String())
+	if assert.NoError(t, err) {
+		_, _, err = stmt.Exec(1)
+		assert.NoError(t, err)
+		assert.Len(t, prepared, 2)
+		conn.Release()
+	}
+}
+
+func TestServerBudget(t *testing.T) {
+	budget := NewServerBudget(2)
+	newPool := func(name string) *Pool {
+		pool, err := New(Config{Name: name, MaxConnections: 2, KeepConnectionsAlive: true, RequestTimeout: 10, Budget: budget},
+			WithAddress("unix", "/nonexistent.sock"))
+		assert.NoError(t, err)
+		return pool
+	}
+	a, b := newPool("a"), newPool("b")
+	defer a.Close()
+	defer b.Close()
+
+	a1, err := a.Adopt(fakeDriverConn{})
+	assert.NoError(t, err)
+	a2, err := a.Adopt(fakeDriverConn{})
+	assert.NoError(t, err)
+	_, err = b.Adopt(fakeDriverConn{})
+	assert.Equal(t, ErrBudgetExhausted, err)
+	_, err = b.Conn()
+	assert.True(t, errors.Is(err, ErrBudgetExhausted))
+	var poolErr *PoolError
+	if assert.True(t, errors.As(err, &poolErr)) {
+		assert.Equal(t, "connect", poolErr.Op)
+	}
+	open, max := budget.Size()
+	assert.Equal(t, 2, open)
+	assert.Equal(t, 2, max)
+
+	// Another pool's idle connection is closed to make room
+	assert.NoError(t, a1.Release())
+	_, err = b.Get()
+	var opErr *net.OpError
+	assert.True(t, errors.As(err, &opErr), "A connection should have been attempted: %v", err)
+	total, _ := a.Size()
+	assert.Equal(t, 1, total)
+	open, _ = budget.Size()
+	assert.Equal(t, 1, open, "A failed connection attempt shouldn't use up the budget")
+
+	// Once there is nothing to reclaim, Get waits
+	b1, err := b.Adopt(fakeDriverConn{})
+	assert.NoError(t, err)
+	_, err = b.get(context.Background(), time.Millisecond)
+	assert.True(t, errors.Is(err, ErrAcquireTimeout))
+
+	a2.Destroy()
+	b1.Destroy()
+	open, _ = budget.Size()
+	assert.Equal(t, 0, open)
+}
+
+func TestConn_WithTempTable(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	var name string
+	err = conn.WithTempTable("(id INT PRIMARY KEY)", func(table string) error {
+		name = table
+		if _, _, err := conn.Query("INSERT INTO %s VALUES (1), (2)", table); err != nil {
+			return err
+		}
+		row, _, err := conn.QueryFirst("SELECT COUNT(*) FROM %s", table)
+		if err == nil {
+			assert.Equal(t, 2, row.Int(0))
+		}
+		return err
+	})
+	assert.NoError(t, err)
+
+	// The table is dropped even if fn fails
+	errFn := errors.New("failed")
+	assert.Equal(t, errFn, conn.WithTempTable("(id INT)", func(table string) error {
+		name = table
+		return errFn
+	}))
+	_, _, err = conn.Query("SELECT * FROM %s", name)
+	assert.Error(t, err, "The temporary table should have been dropped")
+}
+
+func TestConn_QueryInBatches(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	values := make([]interface{}, 25)
+	for i := range values {
+		values[i] = i
+	}
+
+	// Each chunk is a separate query, and their rows are merged
+	rows, res, err := conn.QueryInBatches("SELECT COUNT(*) FROM DUAL WHERE 12 IN (%s)", values, 10)
+	if assert.NoError(t, err) && assert.Len(t, rows, 3) {
+		assert.Equal(t, []int{0, 1, 0}, []int{rows[0].Int(0), rows[1].Int(0), rows[2].Int(0)})
+		assert.NotNil(t, res)
+	}
+
+	rows, res, err = conn.QueryInBatches("SELECT 1 FROM DUAL WHERE 1 IN (%s)", nil, 10)
+	assert.NoError(t, err)
+	assert.Nil(t, rows)
+	assert.Nil(t, res)
+
+	_, _, err = conn.QueryInBatches("SELECT 1 FROM DUAL WHERE 1 IN (%s)", values, 0)
+	assert.Equal(t, ErrInvalidChunkSize, err)
+}
+
+func TestConn_sqlList(t *testing.T) {
+	pool := getPool(t, config)
+	conn := &Conn{Conn: pool.newDriverConn(pool.config.Address)}
+	when := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	list, err := conn.sqlList([]interface{}{1, "it's", []byte("raw"), nil, when, 2.5, true})
+	assert.NoError(t, err)
+	assert.Equal(t, `1, 'it\'s', 'raw', NULL, '2024-03-01 12:30:00', 2.5, true`, list)
+
+	// Named types are formatted by kind, not by their String methods
+	type status string
+	type level int
+	_, err = conn.sqlList([]interface{}{status("x', is_admin = 1 -- "), level(3), stringer{}})
+	assert.EqualError(t, err, "Can't use pool.stringer as an SQL literal")
+	list, err = conn.sqlList([]interface{}{status("x', is_admin = 1 -- "), level(3)})
+	assert.NoError(t, err)
+	assert.Equal(t, `'x\', is_admin = 1 -- ', 3`, list)
+}
+
+// A stringer is a value that formats itself as SQL.
+type stringer struct{}
+
+func (stringer) String() string {
+	return "1; DROP TABLE users"
+}
+
+func TestConn_Use(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	assert.NoError(t, conn.Use("information_schema"))
+	assert.NoError(t, conn.Reconnect())
+	row, _, err := conn.QueryFirst("SELECT DATABASE()")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "information_schema", row.Str(0))
+	}
+}
+
+func TestConn_lockUse(t *testing.T) {
+	cfg := config
+	cfg.SerializeConnUse = true
+	conn := &Conn{pool: getPool(t, cfg), state: stateInUse}
+
+	// Two operations at once, with the second waiting for the first
+	running := make(chan struct{})
+	finish := make(chan struct{})
+	var order []int
+	go conn.withTimeout("FIRST", func() error {
+		close(running)
+		<-finish
+		order = append(order, 1)
+		return nil
+	})
+	<-running
+	time.AfterFunc(50*time.Millisecond, func() { close(finish) })
+	assert.NoError(t, conn.withTimeout("SECOND", func() error {
+		order = append(order, 2)
+		return nil
+	}))
+	assert.Equal(t, []int{1, 2}, order)
+
+	// In debug mode, the second operation fails
+	cfg.Debug = true
+	conn = &Conn{pool: getPool(t, cfg), state: stateInUse}
+	running = make(chan struct{})
+	finish = make(chan struct{})
+	defer close(finish)
+	go conn.withTimeout("FIRST", func() error {
+		close(running)
+		<-finish
+		return nil
+	})
+	<-running
+	err := conn.withTimeout("SECOND", func() error { return nil })
+	assert.True(t, errors.Is(err, ErrConcurrentUse))
+	if assert.IsType(t, &ConcurrentUseError{}, err) {
+		assert.Contains(t, string(err.(*ConcurrentUseError).Stack), "TestConn_lockUse")
+	}
+}
+
+func TestConn_poison(t *testing.T) {
+	pool := getPool(t, config)
+	conn := &Conn{Conn: pool.newDriverConn(pool.config.Address), pool: pool, state: stateInUse}
+	for i := 0; i < historySize+2; i++ {
+		conn.recordHistory(fmt.Sprintf("SELECT %d", i))
+	}
+	assert.Equal(t, []string{"SELECT 2", "SELECT 3", "SELECT 4", "SELECT 5", "SELECT 6", "SELECT 7", "SELECT 8", "SELECT 9"}, conn.recentHistory())
+
+	err := conn.destroyOnError(func() error {
+		return mysql.ErrSeq
+	})
+	if assert.IsType(t, &ProtocolError{}, err) {
+		assert.Equal(t, mysql.ErrSeq, errors.Unwrap(err))
+		assert.Len(t, err.(*ProtocolError).History, historySize)
+	}
+	assert.Equal(t, stateDestroyed, conn.state)
+	assert.Equal(t, uint64(1), pool.ProtocolErrors())
+}
+
+func TestConn_History(t *testing.T) {
+	logger := &testLogger{}
+	var destroyed []string
+	pool, err := New(Config{StatementHistory: 3, Logger: logger, OnDestroy: func(conn *Conn, reason DestroyReason) {
+		destroyed = conn.History()
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := &Conn{Conn: fakeDriverConn{}, pool: pool, statements: map[string]*Stmt{}, state: stateInUse}
+	pool.openConnections[conn] = struct{}{}
+	for i := 0; i < 5; i++ {
+		conn.recordHistory(fmt.Sprintf("UPDATE users SET email = 'user%d@example.com' WHERE id = %d", i, i))
+	}
+	redacted := []string{"update users set email = ? where id = ?", "update users set email = ? where id = ?", "update users set email = ? where id = ?"}
+	assert.Equal(t, redacted, conn.History(), "Literals should be redacted by default")
+
+	pool.config.RedactHistory = func(sql string) string { return sql }
+	assert.Equal(t, "UPDATE users SET email = 'user4@example.com' WHERE id = 4", conn.History()[2])
+	pool.config.RedactHistory = nil
+
+	// The history is logged when a server error closes the connection
+	conn.destroyOnError(func() error {
+		return &mysql.Error{Code: 1021}
+	})
+	assert.Equal(t, stateDestroyed, conn.state)
+	assert.Equal(t, redacted, destroyed)
+	if assert.Len(t, logger.messages, 2) {
+		assert.Contains(t, logger.messages[1], "WARN Closed connection after error")
+		assert.Contains(t, logger.messages[1], "recent statements:\nupdate users set email = ? where id = ?\n")
+		assert.NotContains(t, logger.messages[1], "example.com")
+	}
+}
+
+func TestConn_History_concurrent(t *testing.T) {
+	conn := &Conn{Conn: fakeDriverConn{}, state: stateInUse}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			conn.recordHistory(fmt.Sprintf("SELECT %d", i))
+		}
+	}()
+
+	// An OnDestroy callback may read the history while the connection's
+	// owner is still recording statements
+	for i := 0; i < 100; i++ {
+		assert.True(t, len(conn.History()) <= historySize)
+	}
+	<-done
+	assert.Len(t, conn.History(), historySize)
+}
+
+func TestConn_SetTenant(t *testing.T) {
+	cfg := config
+	cfg.MaxConnections = 1
+	pool := getPool(t, cfg)
+	ctx := WithTenant(context.Background(), "acme")
+	err := pool.Go(ctx, func(conn *Conn) error {
+		row, _, err := conn.QueryFirst("SELECT @tenant_id")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "acme", row.Str(0))
+		}
+		return err
+	})
+	assert.NoError(t, err)
+
+	// The next user of the connection doesn't inherit the tenant
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+	row, _, err := conn.QueryFirst("SELECT @tenant_id IS NULL")
+	if assert.NoError(t, err) {
+		assert.True(t, row.Bool(0))
+	}
+}
+
+func TestPool_Schema(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+	_, _, err = conn.Query("CREATE TABLE schema_test (id INT UNSIGNED PRIMARY KEY, name VARCHAR(20) NULL)")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Query("DROP TABLE schema_test")
+
+	schema, err := pool.Schema()
+	if !assert.NoError(t, err) || !assert.NotNil(t, schema.Tables["schema_test"]) {
+		return
+	}
+	table := schema.Tables["schema_test"]
+	assert.Equal(t, []string{"id"}, table.PrimaryKey)
+	if assert.Len(t, table.Columns, 2) {
+		id := table.Columns[0]
+		assert.Equal(t, "id", id.Name)
+		assert.Contains(t, id.Type, "unsigned")
+		assert.Equal(t, "int", id.DataType)
+		assert.False(t, id.Nullable)
+		assert.Equal(t, "PRI", id.Key)
+		assert.Equal(t, Column{Name: "name", Type: "varchar(20)", DataType: "varchar", Nullable: true}, table.Columns[1])
+	}
+	assert.Equal(t, "varchar", table.Column("NAME").DataType)
+
+	// The schema is cached until it is invalidated
+	cached, err := pool.Schema()
+	assert.NoError(t, err)
+	assert.True(t, cached == schema)
+	pool.InvalidateSchema()
+	reloaded, err := pool.Schema()
+	assert.NoError(t, err)
+	assert.False(t, reloaded == schema)
+}
+
+func TestPool_Schema_primaryKey(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	// grants has a primary key whose columns are in a different order than
+	// in the table, and tokens only a unique key that MySQL reports as PRI
+	server.HandleFunc(func(sql string) *testsupport.Response {
+		switch {
+		case strings.Contains(sql, "information_schema.COLUMNS"):
+			return &testsupport.Response{
+				Columns: []string{"TABLE_NAME", "COLUMN_NAME", "COLUMN_TYPE", "DATA_TYPE", "IS_NULLABLE", "COLUMN_KEY"},
+				Rows: [][]interface{}{
+					{"grants", "role", "int", "int", "NO", "PRI"},
+					{"grants", "user", "int", "int", "NO", "PRI"},
+					{"tokens", "token", "char(32)", "char", "NO", "PRI"},
+				},
+			}
+		case strings.Contains(sql, "information_schema.KEY_COLUMN_USAGE"):
+			return &testsupport.Response{
+				Columns: []string{"TABLE_NAME", "COLUMN_NAME"},
+				Rows:    [][]interface{}{{"grants", "user"}, {"grants", "role"}},
+			}
+		}
+		return nil
+	})
+	pool, err := New(WithAddress("tcp", server.Addr()), WithDatabase("test"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	schema, err := pool.Schema()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"user", "role"}, schema.Tables["grants"].PrimaryKey)
+	assert.Empty(t, schema.Tables["tokens"].PrimaryKey)
+	assert.Equal(t, "PRI", schema.Tables["tokens"].Column("token").Key)
+}
+
+func TestProgress_Fraction(t *testing.T) {
+	assert.Equal(t, 0.0, Progress{Completed: 10}.Fraction())
+	assert.Equal(t, 0.25, Progress{Completed: 10, Estimated: 40}.Fraction())
+	assert.Equal(t, 1.0, Progress{Completed: 50, Estimated: 40}.Fraction())
+}
+
+func TestConn_WatchProgress(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	stop, err := conn.WatchProgress(100*time.Millisecond, func(p Progress) bool {
+		assert.NotEmpty(t, p.Stage)
+		return true
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, err = conn.Query("SELECT SLEEP(0.5)")
+	assert.NoError(t, err)
+	stop()
+	stop()
+}
+
+func TestPool_GetContext(t *testing.T) {
+	pool, _ := fullPool(t, WithConnectTimeout(5))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := pool.GetContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second, "The wait should end when the context is cancelled")
+
+	_, err = pool.GetContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestConn_QueryContext(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.GetContext(context.Background())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, _, err = conn.QueryContext(ctx, "SELECT SLEEP(5)")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// The connection remains usable without the context
+	row, _, err := conn.QueryFirst("SELECT 1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, row.Int(0))
+	}
+}
+
+func TestConn_ExecDDL(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+	_, _, err = conn.Query("CREATE TABLE ddl_test (id INT PRIMARY KEY) ENGINE=InnoDB")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Query("DROP TABLE ddl_test")
+
+	// A long-running transaction blocks the statement
+	other, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer other.Release()
+	_, _, err = other.Query("START TRANSACTION WITH CONSISTENT SNAPSHOT")
+	assert.NoError(t, err)
+	_, _, err = other.Query("SELECT * FROM ddl_test")
+	assert.NoError(t, err)
+	time.Sleep(1100 * time.Millisecond)
+
+	opts := DDLOptions{MaxTransactionAge: time.Second, NoWait: true}
+	err = conn.ExecDDL("ALTER TABLE ddl_test ADD COLUMN name VARCHAR(20)", opts)
+	assert.True(t, errors.Is(err, ErrDDLBlocked))
+	if assert.IsType(t, &DDLBlockedError{}, err) {
+		assert.Equal(t, []uint64{uint64(other.ThreadId())}, err.(*DDLBlockedError).ThreadIDs)
+	}
+
+	_, _, err = other.Query("COMMIT")
+	assert.NoError(t, err)
+	assert.NoError(t, conn.ExecDDL("ALTER TABLE ddl_test ADD COLUMN name VARCHAR(20)", opts))
+}
+
+func TestConn_ExecDDL_subSecond(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	pool, err := New(WithAddress("tcp", server.Addr()))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	// A sub-second age isn't truncated to zero, which would make every open
+	// transaction a blocker
+	assert.NoError(t, conn.ExecDDL("ALTER TABLE t ADD COLUMN c INT", DDLOptions{MaxTransactionAge: 500 * time.Millisecond}))
+	var found bool
+	for _, sql := range server.Queries() {
+		found = found || strings.Contains(sql, "INTERVAL 0.500000 SECOND")
+	}
+	assert.True(t, found, "Queries: %v", server.Queries())
+}
+
+func TestQuerier(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	count := func(q Querier) int {
+		row, _, err := q.QueryFirst("SELECT COUNT(*) FROM querier_test")
+		assert.NoError(t, err)
+		return row.Int(0)
+	}
+	insert := func(q Querier) {
+		res, err := q.Exec("INSERT INTO querier_test VALUES (%d)", count(q)+1)
+		if assert.NoError(t, err) {
+			assert.Equal(t, uint64(1), res.AffectedRows())
+		}
+	}
+
+	_, err = conn.Exec("CREATE TABLE querier_test (id INT PRIMARY KEY) ENGINE=InnoDB")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Exec("DROP TABLE querier_test")
+
+	insert(conn)
+	trans, err := conn.Begin()
+	if !assert.NoError(t, err) {
+		return
+	}
+	insert(trans.(*Transaction))
+	assert.Equal(t, 2, count(trans.(*Transaction)))
+	assert.NoError(t, trans.Rollback())
+	assert.Equal(t, 1, count(conn))
+}
+
+func TestPool_Query(t *testing.T) {
+	pool := getPool(t, config)
+
+	_, err := pool.Exec("CREATE TABLE pool_query_test (id INT PRIMARY KEY)")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Exec("DROP TABLE pool_query_test")
+
+	res, err := pool.Exec("INSERT INTO pool_query_test VALUES (1), (2)")
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(2), res.AffectedRows())
+	}
+	rows, _, err := pool.Query("SELECT id FROM pool_query_test ORDER BY id")
+	if assert.NoError(t, err) && assert.Len(t, rows, 2) {
+		assert.Equal(t, 2, rows[1].Int(0))
+	}
+	row, _, err := pool.QueryFirst("SELECT COUNT(*) FROM pool_query_test")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, row.Int(0))
+	}
+	_, _, err = pool.Query("SELECT * FROM missing")
+	assert.Error(t, err)
+
+	total, available := pool.Size()
+	assert.Equal(t, total, available, "Every connection should have been released")
+}
+
+func TestRegisterPool(t *testing.T) {
+	primary, err := New(Config{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	reports, err := New(Config{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, RegisterPool("primary", primary))
+	assert.NoError(t, RegisterPool("reports", reports))
+	assert.Equal(t, ErrPoolRegistered, RegisterPool("primary", reports))
+	assert.Equal(t, []string{"primary", "reports"}, RegisteredPools())
+
+	p, err := GetPool("primary")
+	assert.NoError(t, err)
+	assert.Equal(t, primary, p)
+	_, err = GetPool("missing")
+	assert.Equal(t, ErrUnknownPool, err)
+
+	// Closing a pool unregisters it
+	assert.NoError(t, reports.Close())
+	_, err = GetPool("reports")
+	assert.Equal(t, ErrUnknownPool, err)
+	assert.Equal(t, ErrPoolClosed, RegisterPool("reports", reports))
+
+	assert.Equal(t, primary, UnregisterPool("primary"))
+	assert.NoError(t, RegisterPool("primary", primary))
+	assert.NoError(t, CloseRegisteredPools())
+	assert.Empty(t, RegisteredPools())
+	assert.True(t, primary.closed())
+}
+
+func TestRegister(t *testing.T) {
+	readonly, err := Register("readonly", Config{MaxConnections: 2}, WithDatabase("shop"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer readonly.Close()
+	assert.Equal(t, "readonly", readonly.Name())
+	assert.Equal(t, "shop", readonly.config.Database)
+	assert.Equal(t, readonly, Lookup("readonly"))
+	assert.Nil(t, Lookup("missing"))
+
+	named, err := Register("reports", WithName("reporting"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "reporting", named.Name())
+		assert.Equal(t, named, Lookup("reports"))
+		named.Close()
+	}
+
+	_, err = Register("readonly")
+	assert.Equal(t, ErrPoolRegistered, err)
+	assert.Equal(t, readonly, Lookup("readonly"))
+}
+
+func TestPool_Exec_releases(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 1, KeepConnectionsAlive: true, ConnectTimeout: 1, RequestTimeout: 10}, WithDryRun())
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := &Conn{Conn: fakeDriverConn{}, pool: pool, statements: map[string]*Stmt{}, state: stateIdle}
+	pool.openConnections[conn] = struct{}{}
+	pool.putIdle(conn)
+
+	// Failing statements must not leak the pool's only connection
+	for i := 0; i < 3; i++ {
+		_, err = pool.Exec("DROP TABLE t")
+		assert.True(t, errors.Is(err, ErrDryRun))
+	}
+	total, available := pool.Size()
+	assert.Equal(t, 1, total)
+	assert.Equal(t, 1, available)
+}
+
+func TestPool_WithTransaction(t *testing.T) {
+	pool := getPool(t, config)
+	_, err := pool.Exec("CREATE TABLE with_transaction_test (id INT PRIMARY KEY) ENGINE=InnoDB")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Exec("DROP TABLE with_transaction_test")
+	insert := func(id int) func(tx *Transaction) error {
+		return func(tx *Transaction) error {
+			_, err := tx.Exec("INSERT INTO with_transaction_test VALUES (%d)", id)
+			return err
+		}
+	}
+	count := func() int {
+		row, _, err := pool.QueryFirst("SELECT COUNT(*) FROM with_transaction_test")
+		assert.NoError(t, err)
+		return row.Int(0)
+	}
+
+	assert.NoError(t, pool.WithTransaction(insert(1)))
+	assert.Equal(t, 1, count())
+
+	failure := errors.New("failure")
+	err = pool.WithTransaction(func(tx *Transaction) error {
+		insert(2)(tx)
+		return failure
+	})
+	assert.Equal(t, failure, err)
+	assert.Equal(t, 1, count(), "The transaction should have been rolled back")
+
+	assert.Panics(t, func() {
+		pool.WithTransaction(func(tx *Transaction) error {
+			insert(3)(tx)
+			panic("oops")
+		})
+	})
+	assert.Equal(t, 1, count(), "The transaction should have been rolled back")
+	total, available := pool.Size()
+	assert.Equal(t, total, available, "Every connection should have been released")
+}
+
+func TestPool_WithTransaction_dryRun(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 1, KeepConnectionsAlive: true, ConnectTimeout: 1, RequestTimeout: 10}, WithDryRun())
+	if !assert.NoError(t, err) {
+		return
+	}
+	var queries []string
+	conn := &Conn{Conn: recordingConn{queries: &queries}, pool: pool, statements: map[string]*Stmt{}, state: stateIdle}
+	pool.openConnections[conn] = struct{}{}
+	pool.putIdle(conn)
+
+	failure := errors.New("failure")
+	assert.Equal(t, failure, pool.WithTransaction(func(tx *Transaction) error {
+		return failure
+	}))
+	assert.Panics(t, func() {
+		pool.WithTransaction(func(tx *Transaction) error {
+			panic("oops")
+		})
+	})
+	assert.NoError(t, pool.WithTransaction(func(tx *Transaction) error {
+		return nil
+	}))
+	assert.Equal(t, []string{
+		"START TRANSACTION", "ROLLBACK",
+		"START TRANSACTION", "ROLLBACK",
+		"START TRANSACTION", "ROLLBACK",
+	}, queries)
+	total, available := pool.Size()
+	assert.Equal(t, 1, total)
+	assert.Equal(t, 1, available)
+}
+
+func TestStats_JSON(t *testing.T) {
+	stats := Stats{
+		Gets:         10,
+		WaitDuration: time.Second,
+		Destroys:     map[DestroyReason]uint64{DestroyedExpired: 2, DestroyedOnError: 1},
+		MaxInUse:     4,
+		Retry:        RetryStats{Allowed: 3},
+		Stmt:         StmtStats{Execute: PhaseStats{Count: 5, Duration: time.Millisecond}},
+		Conn:         ConnStats{Requests: 7},
+	}
+	stats.QueryLatency[2] = 6
+	data, err := json.Marshal(stats)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, string(data), `"Destroys":{"error":1,"expired":2}`)
+
+	var decoded Stats
+	if assert.NoError(t, json.Unmarshal(data, &decoded)) {
+		assert.Equal(t, stats, decoded)
+	}
+	assert.Error(t, json.Unmarshal([]byte(`{"Destroys":{"bored":1}}`), &decoded))
+
+	merged := stats
+	merged.Destroys = map[DestroyReason]uint64{DestroyedExpired: 1}
+	merged.MaxInUse = 2
+	merged.Merge(stats)
+	assert.Equal(t, uint64(20), merged.Gets)
+	assert.Equal(t, 2*time.Second, merged.WaitDuration)
+	assert.Equal(t, map[DestroyReason]uint64{DestroyedExpired: 3, DestroyedOnError: 1}, merged.Destroys)
+	assert.Equal(t, 4, merged.MaxInUse)
+	assert.Equal(t, uint64(12), merged.QueryLatency[2])
+	assert.Equal(t, uint64(10), merged.Stmt.Execute.Count)
+	assert.Equal(t, uint64(14), merged.Conn.Requests)
+
+	// Imported statistics carry on in the pool
+	pool, err := New(Config{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	stats.InUse = 3
+	stats.ProtocolErrors = 2
+	pool.ImportStats(stats)
+	pool.ImportStats(stats)
+	imported := pool.Stats()
+	assert.Equal(t, uint64(20), imported.Gets)
+	assert.Equal(t, uint64(4), imported.Destroys[DestroyedExpired])
+	assert.Equal(t, 0, imported.InUse)
+	assert.Equal(t, 4, imported.MaxInUse)
+	assert.Equal(t, uint64(4), imported.ProtocolErrors)
+	assert.Equal(t, uint64(6), imported.Retry.Allowed)
+	assert.Equal(t, uint64(10), imported.Stmt.Execute.Count)
+	assert.Equal(t, uint64(14), imported.Conn.Requests)
+}
+
+// deadDriverConn is a driver connection whose server has gone away.
+type deadDriverConn struct {
+	fakeDriverConn
+}
+
+func (deadDriverConn) Ping() error {
+	return io.ErrUnexpectedEOF
+}
+
+func (deadDriverConn) Start(sql string, params ...interface{}) (mysql.Result, error) {
+	return nil, io.ErrUnexpectedEOF
+}
+
+func TestConn_Release_brokenByOnRelease(t *testing.T) {
+	var reasons []DestroyReason
+	pool, err := New(Config{MaxConnections: 1, KeepConnectionsAlive: true, RequestTimeout: 10,
+		OnRelease: func(conn *Conn) {
+			_, _, err := conn.Query("DO 1")
+			assert.Equal(t, io.ErrUnexpectedEOF, err)
+		},
+		OnDestroy: func(conn *Conn, reason DestroyReason) {
+			reasons = append(reasons, reason)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := pool.Adopt(deadDriverConn{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The callback's failed query destroys the connection, which Release
+	// then leaves alone
+	assert.NoError(t, conn.Release())
+	assert.Equal(t, []DestroyReason{DestroyedOnError}, reasons)
+	total, _ := pool.Size()
+	assert.Equal(t, 0, total)
+}
+
+func TestConn_Release_verifyFails(t *testing.T) {
+	budget := NewServerBudget(1)
+	pool, err := New(Config{MaxConnections: 1, KeepConnectionsAlive: true, RequestTimeout: 10, Budget: budget})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := pool.Adopt(deadDriverConn{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// The failed ping destroys the connection, which is only counted once
+	assert.NoError(t, conn.Release())
+	stats := pool.Stats()
+	assert.Equal(t, uint64(1), stats.Closed)
+	assert.Equal(t, map[DestroyReason]uint64{DestroyedOnError: 1}, stats.Destroys)
+	open, _ := budget.Size()
+	assert.Equal(t, 0, open)
+}
+
+func TestConn_Destroy_concurrent(t *testing.T) {
+	budget := NewServerBudget(2)
+	pool, err := New(Config{MaxConnections: 2, Budget: budget})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := pool.Adopt(fakeDriverConn{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.Destroy()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(1), pool.Stats().Closed)
+	open, _ := budget.Size()
+	assert.Equal(t, 0, open)
+}
+
+func TestPool_checkHealth(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 3, RequestTimeout: 10, HealthCheck: &HealthChecker{}},
+		WithAddress("unix", "/nonexistent.sock"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, pool.Healthy(), "The pool should be healthy until a check fails")
+	idleSince := time.Now().Add(-time.Minute)
+	for _, driverConn := range []mysql.Conn{fakeDriverConn{}, fakeDriverConn{}, deadDriverConn{}} {
+		conn := &Conn{Conn: driverConn, pool: pool, statements: map[string]*Stmt{}, state: stateIdle, idleSince: idleSince.UnixNano()}
+		pool.openConnections[conn] = struct{}{}
+		pool.putIdle(conn)
+	}
+
+	// Dead connections are removed, and the live ones keep their idle time.
+	// The dead connection is checked last, but as others passed, the pool
+	// stays healthy.
+	pool.checkHealth()
+	total, avail := pool.Size()
+	assert.Equal(t, 2, total)
+	assert.Equal(t, 2, avail)
+	for _, conn := range pool.takeIdle() {
+		assert.Equal(t, idleSince.UnixNano(), conn.idleSince)
+		assert.Equal(t, stateIdle, conn.state)
+	}
+	health := pool.Health()
+	assert.True(t, health.Healthy)
+	assert.False(t, health.CheckedAt.IsZero())
+	assert.Nil(t, health.LastErr)
+	assert.Equal(t, uint64(1), health.Removed)
+	assert.Equal(t, uint64(1), pool.Stats().Destroys[DestroyedOnError])
+
+	// With no idle connections, the server itself is checked
+	pool.checkHealth()
+	health = pool.Health()
+	assert.False(t, pool.Healthy())
+	assert.Error(t, health.LastErr)
+	assert.Equal(t, health.CheckedAt, health.LastErrAt)
+}
+
+func TestPool_checkHealth_budget(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 2, RequestTimeout: 10, HealthCheck: &HealthChecker{}, Budget: NewServerBudget(1)},
+		WithAddress("unix", "/nonexistent.sock"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn, err := pool.Adopt(fakeDriverConn{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Destroy()
+
+	// The only connection is in use and the budget leaves no room to check the
+	// server, so nothing is recorded
+	assert.Equal(t, ErrBudgetExhausted, pool.checkServer(""))
+	pool.checkHealth()
+	health := pool.Health()
+	assert.True(t, health.Healthy)
+	assert.True(t, health.CheckedAt.IsZero())
+}
+
+// A hungDriverConn is a driver connection whose pings don't return until
+// release is closed.
+type hungDriverConn struct {
+	fakeDriverConn
+	release chan struct{}
+}
+
+func (c hungDriverConn) Ping() error {
+	<-c.release
+	return io.ErrUnexpectedEOF
+}
+
+func TestPool_checkHealth_hung(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 2, RequestTimeout: 10, HealthCheck: &HealthChecker{}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	hung := hungDriverConn{release: make(chan struct{})}
+	for _, driverConn := range []mysql.Conn{hung, fakeDriverConn{}} {
+		conn := &Conn{Conn: driverConn, pool: pool, statements: map[string]*Stmt{}, state: stateIdle}
+		pool.openConnections[conn] = struct{}{}
+		pool.putIdle(conn)
+	}
+
+	// The connection that passes goes back while the other is still checked
+	done := make(chan struct{})
+	go func() {
+		pool.checkHealth()
+		close(done)
+	}()
+	assert.Eventually(t, func() bool {
+		_, avail := pool.Size()
+		return avail == 1
+	}, time.Second, time.Millisecond)
+	close(hung.release)
+	<-done
+	total, avail := pool.Size()
+	assert.Equal(t, 1, total)
+	assert.Equal(t, 1, avail)
+	assert.True(t, pool.Healthy())
+}
+
+func TestPool_validateIdle(t *testing.T) {
+	now := time.Now()
+	assert.Equal(t, time.Duration(0), suspendedFor(now, now.Add(time.Minute)))
+
+	pool, err := New(Config{MaxConnections: 4, RequestTimeout: 10})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i, driverConn := range []mysql.Conn{fakeDriverConn{}, deadDriverConn{}, fakeDriverConn{}, fakeDriverConn{}} {
+		conn := &Conn{Conn: driverConn, pool: pool, statements: map[string]*Stmt{}, state: stateIdle}
+		if i == 3 {
+			conn.expiresAt = now.Add(-time.Second).UnixNano()
+		}
+		pool.openConnections[conn] = struct{}{}
+		pool.putIdle(conn)
+	}
+	pool.validateIdle()
+	total, avail := pool.Size()
+	assert.Equal(t, 2, total)
+	assert.Equal(t, 2, avail)
+	stats := pool.Stats()
+	assert.Equal(t, uint64(1), stats.Destroys[DestroyedOnError])
+	assert.Equal(t, uint64(1), stats.Destroys[DestroyedExpired])
+}
+
+func TestConfig_OnExpired(t *testing.T) {
+	var expired []*ConnExpiredError
+	pool, err := New(Config{
+		MaxConnections:       2,
+		KeepConnectionsAlive: true,
+		ConnectTimeout:       1,
+		RequestTimeout:       10,
+		OnExpired: func(err *ConnExpiredError) {
+			expired = append(expired, err)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	old := &Conn{Conn: fakeDriverConn{}, pool: pool, statements: map[string]*Stmt{}, state: stateIdle,
+		createdAt: time.Now().Add(-time.Hour), expiresAt: time.Now().Add(-time.Minute).UnixNano()}
+	old.stats.Borrows = 3
+	fresh := &Conn{Conn: fakeDriverConn{}, pool: pool, statements: map[string]*Stmt{}, state: stateIdle, createdAt: time.Now()}
+	for _, conn := range []*Conn{old, fresh} {
+		pool.openConnections[conn] = struct{}{}
+		pool.putIdle(conn)
+	}
+
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, fresh, conn)
+	assert.Equal(t, uint64(1), pool.Stats().ExpiredOnCheckout)
+	assert.Equal(t, uint64(3), old.Stats().Borrows, "The expired connection should not count as borrowed")
+	if assert.Len(t, expired, 1) {
+		assert.True(t, errors.Is(expired[0], ErrConnExpired))
+		assert.True(t, expired[0].Age >= time.Hour)
+		assert.Equal(t, uint64(3), expired[0].Stats.Borrows)
+	}
+}
+
+func TestPool_SelfTest(t *testing.T) {
+	pool := getPool(t, config)
+	report := pool.SelfTest()
+	assert.True(t, report.OK(), report.String())
+	assert.Len(t, report.Checks, 5)
+}
+
+func TestPool_SelfTest_unreachable(t *testing.T) {
+	pool, err := New(Config{Protocol: "unix", Address: "/nonexistent/mysqld.sock", MaxConnections: 1, ConnectTimeout: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	report := pool.SelfTest()
+	assert.False(t, report.OK())
+	if assert.Len(t, report.Checks, 5) {
+		assert.Equal(t, "connect", report.Checks[0].Name)
+		assert.Error(t, report.Checks[0].Err)
+		assert.True(t, report.Checks[4].Skipped)
+	}
+	assert.Contains(t, report.String(), "charset      skipped")
+}
+
+func TestPool_checkPacket(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	server.Handle("SELECT @@max_allowed_packet", &testsupport.Response{
+		Columns: []string{"@@max_allowed_packet"},
+		Rows:    [][]interface{}{{4194304}},
+	})
+	for min, ok := range map[uint]bool{0: true, 16 * 1024 * 1024: false} {
+		pool, err := New(WithAddress("tcp", server.Addr()), optionFunc(func(config *Config) {
+			config.MinAllowedPacket = min
+		}))
+		if !assert.NoError(t, err) {
+			return
+		}
+		conn, err := pool.Get()
+		if assert.NoError(t, err) {
+			detail, passed, err := pool.checkPacket(conn)
+			assert.Equal(t, "max_allowed_packet is 4194304 bytes", detail)
+			assert.Equal(t, ok, passed, "MinAllowedPacket %d", min)
+			assert.Equal(t, !ok, err != nil)
+			conn.Release()
+		}
+		pool.Close()
+	}
+}
+
+func TestGrantPrivileges(t *testing.T) {
+	for grant, privileges := range map[string]string{
+		"GRANT USAGE ON *.* TO `app`@`%`":                   "",
+		"GRANT ALL PRIVILEGES ON *.* TO 'root'@'localhost'": "ALL PRIVILEGES ON *.*",
+		"GRANT SELECT, INSERT ON `app\\_db`.* TO `app`@`%`": "SELECT, INSERT ON `app\\_db`.*",
+		"GRANT SELECT ON `other`.* TO `app`@`%`":            "",
+		"GRANT SELECT ON `app_db`.`users` TO `app`@`%`":     "",
+		"GRANT `reader`@`%` TO `app`@`%`":                   "",
+	} {
+		assert.Equal(t, privileges, grantPrivileges(grant, "app_db"), grant)
+	}
+}
+
+func TestConn_SetRequestTimeout(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 1, KeepConnectionsAlive: true, RequestTimeout: 10})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := &Conn{Conn: fakeDriverConn{}, pool: pool, statements: map[string]*Stmt{}, state: stateInUse}
+	pool.openConnections[conn] = struct{}{}
+
+	started := time.Now().Add(-time.Second)
+	run := func() error {
+		return conn.withDeadline("SELECT 1", started, func() error {
+			return nil
+		})
+	}
+	conn.SetRequestTimeout(2 * time.Second)
+	assert.NoError(t, run())
+	conn.SetRequestTimeout(0)
+	assert.Equal(t, 10*time.Second, conn.requestTimeout())
+
+	// The override lasts until the connection is released
+	conn.SetRequestTimeout(time.Minute)
+	assert.NoError(t, conn.Release())
+	assert.Equal(t, 10*time.Second, conn.requestTimeout())
+
+	conn.setState(stateInUse)
+	conn.SetRequestTimeout(time.Millisecond)
+	assert.Equal(t, ErrRequestTimeout, run())
+}
+
+func TestConn_GeneratedIDs(t *testing.T) {
+	pool := getPool(t, config)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec("CREATE TEMPORARY TABLE generated_ids (id INT AUTO_INCREMENT PRIMARY KEY, name VARCHAR(10) UNIQUE)")
+	if !assert.NoError(t, err) {
+		return
+	}
+	names := []string{"a", "b", "c"}
+	res, err := conn.Exec("INSERT INTO generated_ids (name) VALUES ('a'), ('b'), ('c')")
+	if !assert.NoError(t, err) {
+		return
+	}
+	ids, err := conn.GeneratedIDs(res, len(names))
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i, name := range names {
+		row, _, err := conn.QueryFirst("SELECT name FROM generated_ids WHERE id = %d", ids.ID(i))
+		if assert.NoError(t, err) {
+			assert.Equal(t, name, row.Str(0))
+		}
+	}
+
+	// INSERT IGNORE skipping a row leaves the IDs unknown
+	res, err = conn.Exec("INSERT IGNORE INTO generated_ids (name) VALUES ('a'), ('d')")
+	if assert.NoError(t, err) {
+		_, err = conn.GeneratedIDs(res, 2)
+		assert.Equal(t, ErrIDRangeUnknown, err)
+	}
+}
+
+func TestIDRange(t *testing.T) {
+	ids := IDRange{First: 11, Count: 3, Increment: 10}
+	assert.Equal(t, uint64(11), ids.ID(0))
+	assert.Equal(t, uint64(21), ids.ID(1))
+	assert.Equal(t, uint64(31), ids.Last())
+}
+
+func TestConn_softTimeout(t *testing.T) {
+	var reported []string
+	cfg := config
+	cfg.SoftRequestTimeout = 1
+	cfg.OnSlowRequest = func(ctx context.Context, sql string, elapsed time.Duration, stack []byte) {
+		assert.True(t, elapsed >= time.Second)
+		assert.Contains(t, string(stack), "TestConn_softTimeout")
+		reported = append(reported, sql)
+	}
+	pool := getPool(t, cfg)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	for _, d := range []time.Duration{0, 2} {
+		err := conn.withTimeout(fmt.Sprintf("SLEEP %d", d), func() error {
+			time.Sleep(d * time.Second)
+			return nil
+		})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"SLEEP 2"}, reported)
+}
+
+func TestConn_reportSlowQuery(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	server.Handle("SELECT SLEEP(0.15)", &testsupport.Response{Columns: []string{"SLEEP(0.15)"}, Rows: [][]interface{}{{0}}, Delay: 150 * time.Millisecond})
+	server.Handle(serverTimeSQL, &testsupport.Response{Columns: []string{"TIMER_WAIT"}, Rows: [][]interface{}{{uint64(100e9)}}})
+	var reported []*SlowQuery
+	pool, err := New(Config{Protocol: "tcp", Address: server.Addr(), MaxConnections: 1, RequestTimeout: 5,
+		OnSlowQuery: func(ctx context.Context, slow *SlowQuery) {
+			reported = append(reported, slow)
+		}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	pool.softTimeout = 100 * time.Millisecond
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	_, _, err = conn.Query("SELECT 1")
+	assert.NoError(t, err)
+	assert.Empty(t, reported, "Fast queries should not be reported")
+
+	_, _, err = conn.Query("SELECT SLEEP(0.15)")
+	assert.NoError(t, err)
+	if assert.Len(t, reported, 1) {
+		slow := reported[0]
+		assert.Equal(t, "SELECT SLEEP(0.15)", slow.SQL)
+		assert.True(t, slow.Elapsed >= 150*time.Millisecond)
+		assert.True(t, slow.HasServerTime)
+		assert.Equal(t, 100*time.Millisecond, slow.ServerTime)
+		assert.Equal(t, slow.Elapsed-slow.ServerTime, slow.NetworkTime())
+	}
+
+	// A lookup that is interrupted doesn't stop the pool from asking
+	server.Handle(serverTimeSQL, &testsupport.Response{Err: &mysql.Error{Code: 1317, Msg: []byte("Query execution was interrupted")}})
+	_, _, err = conn.Query("SELECT SLEEP(0.15)")
+	assert.NoError(t, err)
+	if assert.Len(t, reported, 2) {
+		assert.False(t, reported[1].HasServerTime)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&pool.noServerTime))
+
+	// Once the server refuses to tell, the pool stops asking
+	server.Handle(serverTimeSQL, &testsupport.Response{Err: &mysql.Error{Code: 1142, Msg: []byte("SELECT command denied")}})
+	for i := 0; i < 2; i++ {
+		_, _, err = conn.Query("SELECT SLEEP(0.15)")
+		assert.NoError(t, err)
+	}
+	if assert.Len(t, reported, 4) {
+		assert.False(t, reported[3].HasServerTime)
+		assert.Equal(t, time.Duration(0), reported[3].NetworkTime())
+	}
+	asked := 0
+	for _, sql := range server.Queries() {
+		if sql == serverTimeSQL {
+			asked++
+		}
+	}
+	assert.Equal(t, 3, asked)
+}
+
+func TestConn_destroyOnError(t *testing.T) {
+	var testCases = map[error]bool{
+		nil:                      false, // No error
+		io.EOF:                   false,
+		errors.New("oops"):       true,
+		&mysql.Error{Code: 1021}: true,  // Disk full
+		&mysql.Error{Code: 1022}: false, // Duplicate key
+		&mysql.Error{Code: 1105}: false, // Unknown error
+		&mysql.Error{Code: 1146}: false, // No such table
+		&mysql.Error{Code: 1149}: false, // Syntax error
+		&mysql.Error{Code: 1152}: true,  // Aborting connection
+		&mysql.Error{Code: 1267}: false, // Illegal mix of collations
+		&mysql.Error{Code: 2005}: true,  // Unknown host
+		&mysql.Error{Code: 2006}: true,  // Server has gone away
+		&mysql.Error{Code: 2056}: true,  // Lost connection
+		ErrResultTooLarge:        false,
+	}
+
+	for errExpected, shouldDestroy := range testCases {
+		pool := getPool(t, config)
+		conn, err := pool.Get()
+		assert.NoError(t, err)
+		assert.NotNil(t, conn)
+
+		errReturned := conn.destroyOnError(func() error {
+			return errExpected
+		})
+
+		assert.Equal(t, errExpected, errReturned)
+		if shouldDestroy {
+			assert.Nil(t, conn.pool, "Error: %s", errExpected)
+		} else {
+			assert.NotNil(t, conn.pool, "Error: %s", errExpected)
+		}
+	}
+}
+
+func TestPool_fakeServer(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	server.Handle("SELECT 1", &testsupport.Response{Columns: []string{"1"}, Rows: [][]interface{}{{1}}})
+	server.Handle("SELECT SLEEP(5)", &testsupport.Response{Delay: 5 * time.Second})
+	pool, err := New(Config{Protocol: "tcp", Address: server.Addr(), MaxConnections: 1, RequestTimeout: 1, KeepConnectionsAlive: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	// query checks out a connection and runs into the given fault, if any,
+	// on its first statement
+	query := func(fault testsupport.Fault) error {
+		conn, err := pool.Get()
+		if err != nil {
+			return err
+		}
+		defer conn.Release()
+		server.Inject(fault, 1)
+		rows, _, err := conn.Query("SELECT 1")
+		if err == nil {
+			assert.Equal(t, 1, rows[0].Int(0))
+		}
+		return err
+	}
+	assert.NoError(t, query(0))
+
+	// A connection the server drops is destroyed, and replaced by a new one
+	assert.Error(t, query(testsupport.Drop))
+	assert.Equal(t, uint64(1), pool.Stats().Destroys[DestroyedOnError])
+	assert.NoError(t, query(0))
+
+	// So is one over which the server sends garbage
+	assert.Error(t, query(testsupport.Corrupt))
+	assert.NoError(t, query(0))
+	_, accepted := server.Connections()
+	assert.Equal(t, 3, accepted)
+
+	// A request the server doesn't answer in time is given up on
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	start := time.Now()
+	_, _, err = conn.Query("SELECT SLEEP(5)")
+	assert.Equal(t, ErrRequestTimeout, err)
+	assert.True(t, time.Since(start) < 2*time.Second)
+	conn.Release()
+	assert.NoError(t, query(0))
+}
+
+func TestConn_QueryMaps(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	server.Handle("SELECT id, name FROM users", &testsupport.Response{Columns: []string{"id", "name"}, Rows: [][]interface{}{{1, "ann"}, {2, nil}}})
+	pool, err := New(Config{Protocol: "tcp", Address: server.Addr(), MaxConnections: 1, RequestTimeout: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	maps, result, err := conn.QueryMaps("SELECT id, name FROM users")
+	if assert.NoError(t, err) {
+		assert.Len(t, result.Fields(), 2)
+		assert.Equal(t, []map[string]interface{}{
+			{"id": "1", "name": "ann"},
+			{"id": "2", "name": nil},
+		}, maps)
+	}
+
+	server.Handle("SELECT nonsense", &testsupport.Response{Err: &mysql.Error{Code: 1054, Msg: []byte("Unknown column 'nonsense'")}})
+	maps, _, err = conn.QueryMaps("SELECT nonsense")
+	assert.Error(t, err)
+	assert.Nil(t, maps)
+}
+
+func TestUpdateBuilder(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	pool, err := New(Config{Protocol: "tcp", Address: server.Addr(), MaxConnections: 1, RequestTimeout: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	name, admin := "O'Brien", false
+	var email *string
+	_, err = Update("app.users").
+		Set("name", &name).
+		Set("email", email).
+		Set("admin", &admin).
+		Set("age", 0).
+		Set("note", nil).
+		Set("weird`col", 5).
+		Where("id = ?", 7).
+		Where("tenant = ? OR tenant IS ?", "acme", nil).
+		Exec(conn)
+	assert.NoError(t, err)
+	queries := server.Queries()
+	assert.Equal(t, "UPDATE `app`.`users` SET `name` = 'O\\'Brien', `admin` = false, `weird``col` = 5 "+
+		"WHERE (id = 7) AND (tenant = 'acme' OR tenant IS NULL)", queries[len(queries)-1])
+
+	// Values of named string types are escaped too
+	type status string
+	s := status("x', is_admin = 1 WHERE 1=1 -- ")
+	_, err = Update("users").Set("status", &s).Where("id = ?", 7).Exec(conn)
+	assert.NoError(t, err)
+	queries = server.Queries()
+	assert.Equal(t, "UPDATE `users` SET `status` = 'x\\', is_admin = 1 WHERE 1=1 -- ' WHERE (id = 7)", queries[len(queries)-1])
+	_, err = Update("users").Set("status", struct{ s string }{"x"}).Where("id = ?", 7).Exec(conn)
+	assert.EqualError(t, err, "Can't use struct { s string } as an SQL literal")
+
+	_, err = Update("users").Set("name", email).Where("id = ?", 7).Exec(conn)
+	assert.Equal(t, ErrNothingToUpdate, err)
+	_, err = Update("users").Set("name", "x").Exec(conn)
+	assert.Equal(t, ErrUpdateWithoutWhere, err)
+	_, err = Update("users").Set("name", "x").Where("id = ? AND tenant = ?", 7).Exec(conn)
+	assert.Equal(t, ErrPlaceholderCount, err)
+}
+
+func TestConn_QueryRows(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	users := &testsupport.Response{Columns: []string{"id", "name"}, Rows: [][]interface{}{{1, "ann"}, {2, "bob"}, {3, "cy"}}}
+	server.Handle("SELECT id, name FROM users", users)
+	pool, err := New(Config{Protocol: "tcp", Address: server.Addr(), MaxConnections: 1, RequestTimeout: 1, KeepConnectionsAlive: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	rows, err := conn.QueryRows("SELECT id, name FROM users")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, ErrNoCurrentRow, rows.Scan())
+	var names []string
+	for rows.Next() {
+		var id int
+		var name string
+		assert.Equal(t, ErrScanColumnCount, rows.Scan(&id))
+		if assert.NoError(t, rows.Scan(&id, &name)) {
+			names = append(names, name)
+		}
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []string{"ann", "bob", "cy"}, names)
+	assert.NoError(t, rows.Close())
+
+	// Rows that aren't read are discarded by Close
+	rows, err = conn.QueryRows("SELECT id, name FROM users")
+	if assert.NoError(t, err) {
+		assert.True(t, rows.Next())
+		assert.NoError(t, rows.Close())
+		assert.False(t, rows.Next())
+	}
+
+	// Reading stops once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	rows, err = conn.QueryRowsContext(ctx, "SELECT id, name FROM users")
+	if assert.NoError(t, err) {
+		assert.True(t, rows.Next())
+		cancel()
+		assert.False(t, rows.Next())
+		assert.Equal(t, context.Canceled, rows.Err())
+	}
+	conn.Release()
+
+	// A server that stalls in the middle of the result set fails the read
+	conn, err = pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	users.RowDelay = 400 * time.Millisecond
+	rows, err = conn.QueryRows("SELECT id, name FROM users")
+	if assert.NoError(t, err) {
+		start := time.Now()
+		for rows.Next() {
+		}
+		assert.Equal(t, ErrRequestTimeout, rows.Err())
+		assert.True(t, time.Since(start) < 2*time.Second)
+	}
+	conn.Release()
+}
+
+// fakeDriverConn is a driver connection that is always healthy.
+type fakeDriverConn struct {
+	mysql.Conn
+}
+
+func (fakeDriverConn) IsConnected() bool {
+	return true
+}
+
+func (fakeDriverConn) Ping() error {
+	return nil
+}
+
+func (fakeDriverConn) Close() error {
+	return nil
+}
+
+// fullPool returns a pool of the given configuration that has already opened
+// the one connection it may have, which is checked out, so that Get must wait.
+func fullPool(t *testing.T, opts ...Option) (*Pool, *Conn) {
+	pool, err := New(append(opts, WithMaxConns(1))...)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	conn, err := pool.Adopt(fakeDriverConn{})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return pool, conn
+}
+
+// recordingConn is a healthy driver connection that records the statements
+// executed with Query.
+type recordingConn struct {
+	fakeDriverConn
+	queries *[]string
+}
+
+func (c recordingConn) Query(sql string, params ...interface{}) ([]mysql.Row, mysql.Result, error) {
+	*c.queries = append(*c.queries, sql)
+	return nil, nil, nil
+}
+
+func TestConfig_DryRun(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 1, KeepConnectionsAlive: true, RequestTimeout: 10}, WithDryRun())
+	if !assert.NoError(t, err) {
+		return
+	}
+	var queries []string
+	conn := &Conn{Conn: recordingConn{queries: &queries}, pool: pool, statements: map[string]*Stmt{}, state: stateInUse}
+	pool.openConnections[conn] = struct{}{}
+
+	for _, sql := range []string{"DROP TABLE t", "ALTER TABLE t ADD c INT", "COMMIT", "SET autocommit = 1", "LOCK TABLES t WRITE"} {
+		_, _, err := conn.Query(sql)
+		assert.True(t, errors.Is(err, ErrDryRun), sql)
+	}
+	assert.Empty(t, queries, "Rejected statements should not start a transaction")
+	assert.NoError(t, conn.guard("SELECT 1", nil))
+	assert.NoError(t, conn.guard("CREATE TEMPORARY TABLE t (a INT)", nil))
+	assert.NoError(t, conn.guard("UPDATE t SET a = %d", []interface{}{1}))
+	assert.NoError(t, conn.guard("ROLLBACK TO SAVEPOINT s", nil))
+	assert.Equal(t, []string{"START TRANSACTION"}, queries, "Only the first write should start a transaction")
+
+	// A commit rolls the dry-run transaction back, and the next write starts another
+	trans, err := conn.Begin()
+	if assert.NoError(t, err) {
+		assert.NoError(t, trans.Commit())
+	}
+	assert.NoError(t, conn.guard("DELETE FROM t", nil))
+	assert.NoError(t, conn.Release())
+	assert.Equal(t, []string{"START TRANSACTION", "ROLLBACK", "START TRANSACTION", "ROLLBACK"}, queries)
+}
+
+func TestPool_releaseHappensBefore(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 2, KeepConnectionsAlive: true, ConnectTimeout: 10, RequestTimeout: 10})
+	if !assert.NoError(t, err) {
+		return
+	}
+	counts := map[*Conn]*int{}
+	for i := 0; i < 2; i++ {
+		conn := &Conn{Conn: fakeDriverConn{}, pool: pool, statements: map[string]*Stmt{}, state: stateIdle}
+		pool.openConnections[conn] = struct{}{}
+		pool.putIdle(conn)
+		counts[conn] = new(int)
+	}
+
+	// Borrowers update state kept with the connection without locking, which
+	// the race detector reports unless the hand-over is synchronized
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				conn, err := pool.Get()
+				if !assert.NoError(t, err) {
+					return
+				}
+				*counts[conn]++
+				conn.database = fmt.Sprint(*counts[conn])
+				assert.NoError(t, conn.Release())
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for conn, n := range counts {
+		total += *n
+		assert.Equal(t, fmt.Sprint(*n), conn.database)
+	}
+	assert.Equal(t, 800, total)
+}
+
+func TestPool_fifo(t *testing.T) {
+	pool, err := New(Config{MaxConnections: 1, KeepConnectionsAlive: true, ConnectTimeout: 10, RequestTimeout: 10})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := &Conn{Conn: fakeDriverConn{}, pool: pool, statements: map[string]*Stmt{}, state: stateInUse}
+	pool.openConnections[conn] = struct{}{}
+	waiting := func() int {
+		pool.mutex.Lock()
+		defer pool.mutex.Unlock()
+		return len(pool.waiters)
+	}
+
+	// Callers that give up waiting leave the queue
+	_, err = pool.get(context.Background(), time.Millisecond)
+	assert.True(t, errors.Is(err, ErrAcquireTimeout))
+	assert.Equal(t, 0, waiting())
+
+	var mutex sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn, err := pool.Get()
+			if !assert.NoError(t, err) {
+				return
+			}
+			mutex.Lock()
+			order = append(order, i)
+			mutex.Unlock()
+			conn.Release()
+		}(i)
+		for waiting() <= i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	conn.Release()
+	wg.Wait()
+	assert.Equal(t, []int{0, 1, 2, 3, 4}, order, "Connections should be handed out in the order they were asked for")
+	assert.Equal(t, 0, waiting())
+	_, avail := pool.Size()
+	assert.Equal(t, 1, avail)
+}
+
+// fakeResult is an in-memory result set with numRows rows of identical values.
+type fakeResult struct {
+	mysql.Result
+	fields  []*mysql.Field
+	values  mysql.Row
+	numRows int
+}
+
+func newFakeResult(numRows int) *fakeResult {
+	return &fakeResult{
+		fields:  []*mysql.Field{{Name: "id"}, {Name: "name"}, {Name: "created"}},
+		values:  mysql.Row{[]byte("1"), []byte("name"), []byte("2014-01-01 00:00:00")},
+		numRows: numRows,
+	}
+}
+
+func (r *fakeResult) Fields() []*mysql.Field {
+	return r.fields
+}
+
+func (r *fakeResult) MakeRow() mysql.Row {
+	return make(mysql.Row, len(r.fields))
+}
+
+func (r *fakeResult) ScanRow(row mysql.Row) error {
+	if r.numRows == 0 {
+		return io.EOF
+	}
+	r.numRows--
+	copy(row, r.values)
+	return nil
+}
+
+func (r *fakeResult) GetRow() (mysql.Row, error) {
+	return mysql.GetRow(r)
+}
+
+func (r *fakeResult) StatusOnly() bool {
+	return false
+}
+
+func (r *fakeResult) MoreResults() bool {
+	return false
+}
+
+func (r *fakeResult) NextResult() (mysql.Result, error) {
+	return nil, nil
+}
+
+func (r *fakeResult) End() error {
+	return mysql.End(r)
+}
+
+func newFakePoolResult(numRows int) *Result {
+	return &Result{Result: newFakeResult(numRows), conn: &Conn{state: stateInUse}}
+}
+
+func TestResult_GetPooledRow(t *testing.T) {
+	result := newFakePoolResult(2)
+	for i := 0; i < 2; i++ {
+		row, err := result.GetPooledRow()
+		assert.NoError(t, err)
+		if assert.NotNil(t, row) {
+			assert.Equal(t, "name", row.Str(1))
+			row.Release()
+		}
+	}
+	row, err := result.GetPooledRow()
+	assert.NoError(t, err)
+	assert.Nil(t, row)
+
+	assert.NoError(t, newFakePoolResult(5).End())
+}
+
+func TestResult_End_statusOnly(t *testing.T) {
+	server, err := testsupport.NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer server.Close()
+	pool, err := New(Config{Protocol: "tcp", Address: server.Addr(), MaxConnections: 1, RequestTimeout: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Release()
+
+	// Statements without a result set can be ended and iterated over like
+	// any other
+	result, err := conn.Start("UPDATE t SET id = 2")
+	if assert.NoError(t, err) {
+		assert.NoError(t, result.End())
+	}
+	result, err = conn.Start("UPDATE t SET id = 3")
+	if assert.NoError(t, err) {
+		assert.NoError(t, result.(*Result).MapRows(func(mysql.Row) error { return nil }))
+	}
+	rows, err := conn.QueryRows("UPDATE t SET id = 4")
+	if assert.NoError(t, err) {
+		assert.False(t, rows.Next())
+		assert.NoError(t, rows.Err())
+	}
+	assert.True(t, conn.IsConnected())
+}
+
+func TestResult_Scan(t *testing.T) {
+	result := newFakePoolResult(2)
+	var (
+		id      int
+		name    []byte
+		created time.Time
+	)
+	assert.NoError(t, result.Scan(&id, &name, &created))
+	assert.Equal(t, 1, id)
+	assert.Equal(t, "name", string(name))
+	assert.Equal(t, 2014, created.Year())
+
+	var str string
+	assert.Error(t, result.Scan(&id, &str, &id), "Can't convert a name to an int")
+	assert.Equal(t, ErrScanColumnCount, result.Scan(&id))
+	assert.Equal(t, io.EOF, result.Scan(&id, &name, &created))
+}
+
+func TestResult_MapRows(t *testing.T) {
+	var ids []int
+	assert.NoError(t, newFakePoolResult(3).MapRows(func(row mysql.Row) error {
+		ids = append(ids, row.Int(0))
+		return nil
+	}))
+	assert.Equal(t, []int{1, 1, 1}, ids)
+
+	// An error from the callback stops the iteration
+	errStop := errors.New("stop")
+	calls := 0
+	result := newFakePoolResult(3)
+	assert.Equal(t, errStop, result.MapRows(func(row mysql.Row) error {
+		calls++
+		return errStop
+	}))
+	assert.Equal(t, 1, calls)
+	row, err := result.GetRow()
+	assert.NoError(t, err)
+	assert.Nil(t, row, "The rest of the result set should be discarded")
+}
+
+func TestResult_ReduceRows(t *testing.T) {
+	sum, err := newFakePoolResult(4).ReduceRows(func(acc interface{}, row mysql.Row) (interface{}, error) {
+		return acc.(int) + row.Int(0), nil
+	}, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 14, sum)
+}
+
+func TestPool_reportUnread(t *testing.T) {
+	var reported []string
+	pool, err := New(Config{
+		OnUnreadResult: func(ctx context.Context, sql string, held time.Duration) {
+			reported = append(reported, sql)
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	result := newFakePoolResult(1)
+	result.conn.pool = pool
+	result.sql = "SELECT 1"
+	pool.openConnections[result.conn] = struct{}{}
+	result.trackUnread()
+
+	pool.reportUnread(time.Minute)
+	assert.Empty(t, reported)
+	pool.reportUnread(0)
+	pool.reportUnread(0)
+	assert.Equal(t, []string{"SELECT 1"}, reported, "A result should only be reported once")
+
+	// Reading the result to the end frees the connection
+	for {
+		row, err := result.GetRow()
+		assert.NoError(t, err)
+		if row == nil {
+			break
+		}
+	}
+	assert.Nil(t, result.conn.unread.Load())
+}
+
+func TestConn_Release_unreadResult(t *testing.T) {
+	cfg := config
+	cfg.MaxConnections = 1
+	pool := getPool(t, cfg)
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Start("SELECT 1 UNION SELECT 2")
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Release())
+
+	// The connection is returned to the pool in a usable state
+	conn2, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn2.Release()
+	assert.Equal(t, conn, conn2)
+	_, _, err = conn2.Query("SELECT 1")
+	assert.NoError(t, err)
+}
+
+func TestPool_reportLeaks(t *testing.T) {
+	var leaks []*Leak
+	pool, err := New(Config{LeakWarningThreshold: 60, OnLeak: func(leak *Leak) {
+		leaks = append(leaks, leak)
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn := &Conn{pool: pool, state: stateInUse, borrowID: 3}
+	conn.recordBorrow()
+	pool.openConnections[conn] = struct{}{}
+
+	pool.reportLeaks(time.Minute)
+	assert.Empty(t, leaks)
+	pool.reportLeaks(0)
+	pool.reportLeaks(0)
+	if assert.Len(t, leaks, 1, "A checkout should only be reported once") {
+		assert.Equal(t, uint64(3), leaks[0].BorrowID)
+		assert.Contains(t, string(leaks[0].Stack), "TestPool_reportLeaks", "The stack of the checkout should be recorded")
+	}
+	assert.Equal(t, uint64(1), pool.Stats().Leaks)
+
+	// Without a callback, leaks are logged
+	logger := &testLogger{}
+	pool.config.OnLeak = nil
+	pool.config.Logger = logger
+	conn.borrowID = 4
+	conn.recordBorrow()
+	pool.reportLeaks(0)
+	if assert.Len(t, logger.messages, 1) {
+		assert.Contains(t, logger.messages[0], "WARN Connection with borrow ID 4 has been checked out for ")
+		assert.Contains(t, logger.messages[0], "TestPool_reportLeaks")
+	}
+
+	// Released connections aren't leaks
+	conn.borrowID = 5
+	conn.recordBorrow()
+	conn.state = stateIdle
+	pool.reportLeaks(0)
+	assert.Len(t, logger.messages, 1)
+}
+
+func TestConn_drainUnread(t *testing.T) {
+	pool, err := New(WithTimeout(5))
+	if !assert.NoError(t, err) {
+		return
+	}
+	result := newFakePoolResult(3)
+	result.conn.pool = pool
+	_, err = result.GetRow()
+	assert.NoError(t, err)
+	result.trackUnread()
+
+	assert.NoError(t, result.conn.drainUnread())
+	assert.Nil(t, result.conn.unread.Load())
+	row, err := result.Result.GetRow()
+	assert.NoError(t, err)
+	assert.Nil(t, row, "The rest of the result set should be discarded")
+
+	// Nothing is left to drain
+	assert.NoError(t, result.conn.drainUnread())
+}
+
+func BenchmarkResult_GetRow(b *testing.B) {
+	b.ReportAllocs()
+	result := newFakePoolResult(b.N)
+	for i := 0; i < b.N; i++ {
+		result.GetRow()
+	}
+}
+
+func BenchmarkResult_GetPooledRow(b *testing.B) {
+	b.ReportAllocs()
+	result := newFakePoolResult(b.N)
+	for i := 0; i < b.N; i++ {
+		row, _ := result.GetPooledRow()
+		row.Release()
+	}
+}
+
+func BenchmarkResult_Scan(b *testing.B) {
+	b.ReportAllocs()
+	result := newFakePoolResult(b.N)
+	var (
+		id      int
+		name    []byte
+		created []byte
+	)
+	for i := 0; i < b.N; i++ {
+		result.Scan(&id, &name, &created)
+	}
+}
+
+// fakeServerConn is a driver connection to a fake server that answers every
+// query with a single row.
+type fakeServerConn struct {
+	fakeDriverConn
+}
+
+func (fakeServerConn) Start(sql string, params ...interface{}) (mysql.Result, error) {
+	return newFakeResult(1), nil
+}
+
+// benchPool returns a pool holding a single idle connection to a fake server.
+func benchPool(tb testing.TB) *Pool {
+	pool, err := New(Config{MaxConnections: 1, KeepConnectionsAlive: true, RequestTimeout: 10})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn := &Conn{Conn: fakeServerConn{}, pool: pool, statements: map[string]*Stmt{}, state: stateIdle}
+	pool.openConnections[conn] = struct{}{}
+	pool.putIdle(conn)
+	return pool
+}
+
+// Allocation budgets for the pool's hot path.  TestAllocs fails if an
+// operation allocates more than its budget, so that a change that slows the
+// hot path down has to raise the budget deliberately.
+const (
+	getReleaseAllocs = 15
+	queryAllocs      = 25
+)
+
+func TestAllocs(t *testing.T) {
+	pool := benchPool(t)
+	allocs := testing.AllocsPerRun(100, func() {
+		conn, err := pool.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Release()
+	})
+	assert.LessOrEqual(t, allocs, float64(getReleaseAllocs), "Get and Release allocate more than their budget")
+
+	conn, err := pool.Get()
+	if !assert.NoError(t, err) {
+		return
+	}
+	allocs = testing.AllocsPerRun(100, func() {
+		if _, _, err := conn.Query("SELECT id, name, created FROM users WHERE id = 1"); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.LessOrEqual(t, allocs, float64(queryAllocs), "Query allocates more than its budget")
+}
+
+func BenchmarkPool_GetRelease(b *testing.B) {
+	b.ReportAllocs()
+	pool := benchPool(b)
+	for i := 0; i < b.N; i++ {
+		conn, err := pool.Get()
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn.Release()
+	}
+}
+
+func BenchmarkConn_Query(b *testing.B) {
+	b.ReportAllocs()
+	pool := benchPool(b)
+	conn, err := pool.Get()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Release()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := conn.Query("SELECT id, name, created FROM users WHERE id = 1"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPool_sshDial_refused(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if !assert.NoError(t, err) {
+		return
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer listener.Close()
+
+	// The bastion refuses every forward
+	var logins int32
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, channels, requests, err := ssh.NewServerConn(netConn, serverConfig)
+				if err != nil {
+					return
+				}
+				atomic.AddInt32(&logins, 1)
+				go ssh.DiscardRequests(requests)
+				for channel := range channels {
+					channel.Reject(ssh.Prohibited, "forwarding is disabled")
+				}
+			}()
+		}
+	}()
+
+	pool, err := New(Config{SSH: &SSHConfig{Address: listener.Addr().String(), Username: "test", HostKeyCallback: ssh.FixedHostKey(signer.PublicKey())}},
+		WithAddress("tcp", "db:3306"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer pool.Close()
+	for i := 0; i < 2; i++ {
+		_, err = pool.sshDial("tcp", "db:3306", time.Second)
+		var openErr *ssh.OpenChannelError
+		assert.True(t, errors.As(err, &openErr))
 	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&logins), "A refused forward shouldn't reconnect to the bastion")
 }
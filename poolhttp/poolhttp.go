@@ -0,0 +1,55 @@
+// Package poolhttp provides helpers for using a MyMySQL connection pool from
+// HTTP handlers.
+package poolhttp
+
+import (
+	"context"
+	"github.com/mooncake0525/mymysql-pool"
+	"net/http"
+)
+
+type contextKey int
+
+const connKey contextKey = iota
+
+// Middleware checks a connection out of db for each request and releases it
+// once next has returned.  Handlers retrieve the connection with
+// ConnFromContext.  The connection is bound to the request's context, so if the
+// client disconnects, any query still running on its behalf is killed.  If no
+// connection can be checked out, the request fails with 503 Service
+// Unavailable and next isn't called.  A tenant ID stored in the request's
+// context by Tenant is applied to the connection.
+func Middleware(db *pool.Pool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := pool.NewResponder(db, r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		defer conn.Release()
+
+		ctx := context.WithValue(conn.Annotate(r.Context()), connKey, conn.Conn)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Tenant stores the tenant ID that tenant extracts from each request in the
+// request's context, where Middleware picks it up and applies it to the
+// request's connection (see pool.WithTenant).  It must therefore run before
+// Middleware.  Requests for which tenant returns an empty string are passed on
+// unchanged.
+func Tenant(tenant func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := tenant(r); len(id) > 0 {
+			r = r.WithContext(pool.WithTenant(r.Context(), id))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ConnFromContext returns the connection that Middleware checked out for the
+// request with the given context, or nil if there isn't one.
+func ConnFromContext(ctx context.Context) *pool.Conn {
+	conn, _ := ctx.Value(connKey).(*pool.Conn)
+	return conn
+}
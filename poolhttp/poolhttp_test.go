@@ -0,0 +1,55 @@
+package poolhttp
+
+import (
+	"context"
+	"github.com/mooncake0525/mymysql-pool"
+	"github.com/stretchr/testify/assert"
+	"github.com/ziutek/mymysql/mysql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware_unavailable(t *testing.T) {
+	db, err := pool.New(pool.WithMaxConns(1), pool.WithAcquireTimeout(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = db.Adopt(connectedConn{})
+	assert.NoError(t, err)
+	handler := Middleware(db, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler called without a connection")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestTenant(t *testing.T) {
+	var tenant string
+	handler := Tenant(func(r *http.Request) string {
+		return r.Header.Get("X-Tenant")
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, _ = pool.TenantFromContext(r.Context())
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Tenant", "acme")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "acme", tenant)
+}
+
+func TestConnFromContext(t *testing.T) {
+	assert.Nil(t, ConnFromContext(context.Background()))
+}
+
+// connectedConn is a driver connection that is taken to be connected, which
+// the pool can adopt without a server.
+type connectedConn struct {
+	mysql.Conn
+}
+
+func (connectedConn) IsConnected() bool {
+	return true
+}
@@ -0,0 +1,113 @@
+// Package poolprom exports the statistics of a MyMySQL connection pool as
+// Prometheus metrics.  It is kept apart from the pool package so that
+// applications that don't use Prometheus don't depend on its client library.
+package poolprom
+
+import (
+	"github.com/mooncake0525/mymysql-pool"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+const namespace = "mymysql_pool"
+
+// A Collector is a prometheus.Collector that reports the size, activity and
+// latencies of a pool.  Each metric is labelled with the pool's name, so the
+// collectors of several pools can be registered side by side:
+//
+//	prometheus.MustRegister(poolprom.NewCollector(db))
+type Collector struct {
+	pool *pool.Pool
+
+	open           *prometheus.Desc
+	idle           *prometheus.Desc
+	inUse          *prometheus.Desc
+	maxInUse       *prometheus.Desc
+	gets           *prometheus.Desc
+	waits          *prometheus.Desc
+	waitSeconds    *prometheus.Desc
+	timeouts       *prometheus.Desc
+	opened         *prometheus.Desc
+	closed         *prometheus.Desc
+	protocolErrors *prometheus.Desc
+	queryDuration  *prometheus.Desc
+	dialDuration   *prometheus.Desc
+}
+
+// NewCollector creates a collector for the given pool.
+func NewCollector(db *pool.Pool) *Collector {
+	labels := prometheus.Labels{"pool": db.Name()}
+	desc := func(name, help string, variableLabels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, variableLabels, labels)
+	}
+	return &Collector{
+		pool:           db,
+		open:           desc("open_connections", "Number of open connections."),
+		idle:           desc("idle_connections", "Number of idle connections."),
+		inUse:          desc("in_use_connections", "Number of connections checked out of the pool."),
+		maxInUse:       desc("max_in_use_connections", "Most connections checked out of the pool at once."),
+		gets:           desc("gets_total", "Requests for a connection."),
+		waits:          desc("waits_total", "Requests for a connection that had to wait for one."),
+		waitSeconds:    desc("wait_seconds_total", "Time spent waiting for a connection."),
+		timeouts:       desc("timeouts_total", "Requests for a connection that timed out."),
+		opened:         desc("connections_opened_total", "Connections opened."),
+		closed:         desc("connections_closed_total", "Connections closed, by reason.", "reason"),
+		protocolErrors: desc("protocol_errors_total", "Connections closed because their protocol stream was out of sync."),
+		queryDuration:  desc("query_duration_seconds", "Latency of successful queries."),
+		dialDuration:   desc("dial_duration_seconds", "Latency of successful dials, by endpoint.", "endpoint"),
+	}
+}
+
+// Describe sends the descriptors of the collector's metrics to ch.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		c.open, c.idle, c.inUse, c.maxInUse, c.gets, c.waits, c.waitSeconds, c.timeouts,
+		c.opened, c.closed, c.protocolErrors, c.queryDuration, c.dialDuration,
+	} {
+		ch <- desc
+	}
+}
+
+// Collect sends the pool's current metrics to ch.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.pool.Stats()
+	total, idle := c.pool.Size()
+
+	gauge := func(desc *prometheus.Desc, value int) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value))
+	}
+	counter := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+	}
+	gauge(c.open, total)
+	gauge(c.idle, idle)
+	gauge(c.inUse, stats.InUse)
+	gauge(c.maxInUse, stats.MaxInUse)
+	counter(c.gets, float64(stats.Gets))
+	counter(c.waits, float64(stats.Waits))
+	counter(c.waitSeconds, stats.WaitDuration.Seconds())
+	counter(c.timeouts, float64(stats.Timeouts))
+	counter(c.opened, float64(stats.Opened))
+	for reason, n := range stats.Destroys {
+		counter(c.closed, float64(n), reason.String())
+	}
+	counter(c.protocolErrors, float64(stats.ProtocolErrors))
+
+	ch <- histogram(c.queryDuration, pool.QueryLatencyBuckets[:], stats.QueryLatency[:], stats.QueryDuration)
+	for endpoint, dial := range c.pool.DialStats() {
+		ch <- histogram(c.dialDuration, pool.DialLatencyBuckets[:], dial.Latency[:], dial.Duration, endpoint)
+	}
+}
+
+// histogram converts the pool's latency counts, one per bucket plus a final
+// one for anything slower, into a Prometheus histogram.
+func histogram(desc *prometheus.Desc, bounds []time.Duration, counts []uint64, sum time.Duration, labels ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(bounds))
+	var cumulative uint64
+	for i, bound := range bounds {
+		cumulative += counts[i]
+		buckets[bound.Seconds()] = cumulative
+	}
+	cumulative += counts[len(bounds)]
+	return prometheus.MustNewConstHistogram(desc, cumulative, sum.Seconds(), buckets, labels...)
+}
@@ -0,0 +1,76 @@
+package poolprom
+
+import (
+	"context"
+	"github.com/mooncake0525/mymysql-pool"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/ziutek/mymysql/mysql"
+	"testing"
+	"time"
+)
+
+func TestCollector(t *testing.T) {
+	db, err := pool.New(pool.WithName("reports"), pool.WithMaxConns(1))
+	if !assert.NoError(t, err) {
+		return
+	}
+	// Fill the pool so that Get must wait
+	_, err = db.Adopt(connectedConn{})
+	assert.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	_, err = db.GetContext(ctx)
+	assert.Error(t, err)
+
+	registry := prometheus.NewPedanticRegistry()
+	if !assert.NoError(t, registry.Register(NewCollector(db))) {
+		return
+	}
+	families, err := registry.Gather()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics := map[string]float64{}
+	for _, family := range families {
+		metric := family.GetMetric()[0]
+		assert.Equal(t, "reports", metric.GetLabel()[0].GetValue())
+		switch {
+		case metric.Counter != nil:
+			metrics[family.GetName()] = metric.GetCounter().GetValue()
+		case metric.Gauge != nil:
+			metrics[family.GetName()] = metric.GetGauge().GetValue()
+		case metric.Histogram != nil:
+			metrics[family.GetName()] = float64(metric.GetHistogram().GetSampleCount())
+		}
+	}
+	assert.Equal(t, float64(1), metrics["mymysql_pool_gets_total"])
+	assert.Equal(t, float64(1), metrics["mymysql_pool_waits_total"])
+	assert.Equal(t, float64(1), metrics["mymysql_pool_open_connections"])
+	assert.Equal(t, float64(0), metrics["mymysql_pool_query_duration_seconds"])
+}
+
+func TestHistogram(t *testing.T) {
+	desc := prometheus.NewDesc("test", "Test.", nil, nil)
+	bounds := []time.Duration{time.Millisecond, time.Second}
+	metric := histogram(desc, bounds, []uint64{2, 1, 3}, 10*time.Second)
+
+	var out dto.Metric
+	assert.NoError(t, metric.Write(&out))
+	h := out.GetHistogram()
+	assert.Equal(t, uint64(6), h.GetSampleCount())
+	assert.Equal(t, float64(10), h.GetSampleSum())
+	assert.Equal(t, uint64(2), h.GetBucket()[0].GetCumulativeCount())
+	assert.Equal(t, uint64(3), h.GetBucket()[1].GetCumulativeCount())
+}
+
+// connectedConn is a driver connection that is taken to be connected, which
+// the pool can adopt without a server.
+type connectedConn struct {
+	mysql.Conn
+}
+
+func (connectedConn) IsConnected() bool {
+	return true
+}
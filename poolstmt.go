@@ -0,0 +1,70 @@
+package pool
+
+import (
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// A PoolStmt is a prepared statement that belongs to a pool rather than to one
+// of its connections, so that callers don't have to keep a connection and the
+// statements prepared on it together.  Each execution checks out a
+// connection, preferring one on which the statement has already been prepared
+// (see Pool.GetFor), prepares the statement on it if need be, executes it and
+// releases the connection again.  A PoolStmt may be used by several
+// goroutines at once.
+type PoolStmt struct {
+	pool *Pool
+	sql  string
+}
+
+// Prepare returns a pool-level prepared statement for the given SQL.  The
+// statement is prepared straight away on one of the pool's connections, so
+// that mistakes in the SQL are reported here rather than when it is first
+// executed.
+func (pool *Pool) Prepare(sql string) (*PoolStmt, error) {
+	stmt := &PoolStmt{pool, sql}
+	if err := stmt.withStmt(func(*Stmt) error { return nil }); err != nil {
+		return nil, err
+	}
+	return stmt, nil
+}
+
+// Exec executes the statement on one of the pool's connections like
+// Stmt.Exec.  As the connection has been released by the time Exec returns,
+// only the result's metadata, such as its fields, may be used.
+func (stmt *PoolStmt) Exec(params ...interface{}) (rows []mysql.Row, result mysql.Result, err error) {
+	err = stmt.withStmt(func(s *Stmt) (e error) {
+		rows, result, e = s.Exec(params...)
+		return
+	})
+	return
+}
+
+// ExecFirst executes the statement on one of the pool's connections like
+// Stmt.ExecFirst, returning only the first row in the result set.
+func (stmt *PoolStmt) ExecFirst(params ...interface{}) (row mysql.Row, result mysql.Result, err error) {
+	err = stmt.withStmt(func(s *Stmt) (e error) {
+		row, result, e = s.ExecFirst(params...)
+		return
+	})
+	return
+}
+
+// String returns the statement's SQL.
+func (stmt *PoolStmt) String() string {
+	return stmt.sql
+}
+
+// withStmt calls fn with the statement prepared on a connection checked out of
+// the pool, which is released once fn returns.
+func (stmt *PoolStmt) withStmt(fn func(*Stmt) error) error {
+	conn, err := stmt.pool.GetFor(stmt.sql)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+	s, err := conn.Prepare(stmt.sql)
+	if err != nil {
+		return err
+	}
+	return fn(s.(*Stmt))
+}
@@ -0,0 +1,83 @@
+package pool
+
+// Curated defaults for common workloads, used by NewOLTP, NewBatch and
+// NewReporting.
+var (
+	// Many short queries: a large pool, tight timeouts, early warning of slow
+	// queries and a steady trickle of reconnects.
+	oltpProfile = Config{
+		MaxConnections:       50,
+		MaxConnectionAge:     3600,
+		ConnectTimeout:       2,
+		RequestTimeout:       5,
+		SoftRequestTimeout:   1,
+		RefreshInterval:      300,
+		KeepConnectionsAlive: true,
+		TCPKeepAlive:         60,
+	}
+
+	// Few long-running statements: a small pool and generous timeouts, with
+	// connections kept for as long as they are needed.
+	batchProfile = Config{
+		MaxConnections:       8,
+		ConnectTimeout:       10,
+		RequestTimeout:       3600,
+		KeepConnectionsAlive: true,
+		TCPKeepAlive:         60,
+	}
+
+	// Large, slow reads: minutes-long timeouts, reporting of queries that run
+	// for more than a minute and a cap on the size of results held in memory.
+	reportingProfile = Config{
+		MaxConnections:       10,
+		MaxConnectionAge:     3600,
+		ConnectTimeout:       5,
+		RequestTimeout:       300,
+		SoftRequestTimeout:   60,
+		MaxResultRows:        1000000,
+		KeepConnectionsAlive: true,
+		TCPKeepAlive:         60,
+	}
+)
+
+// NewOLTP creates a pool for transactional workloads made up of many short
+// queries.  Any limits and timeouts left unset in base are filled in with
+// defaults suited to such workloads, and connections are kept alive.
+func NewOLTP(base Config) (*Pool, error) {
+	return New(withDefaults(base, oltpProfile))
+}
+
+// NewBatch creates a pool for batch jobs that run a few long statements.  Any
+// limits and timeouts left unset in base are filled in with defaults suited to
+// such workloads, and connections are kept alive.
+func NewBatch(base Config) (*Pool, error) {
+	return New(withDefaults(base, batchProfile))
+}
+
+// NewReporting creates a pool for reporting and analytics queries that read
+// large amounts of data.  Any limits and timeouts left unset in base are
+// filled in with defaults suited to such workloads, and connections are kept
+// alive.
+func NewReporting(base Config) (*Pool, error) {
+	return New(withDefaults(base, reportingProfile))
+}
+
+// withDefaults fills in the limits and timeouts that are unset in config with
+// those of a profile.
+func withDefaults(config, profile Config) Config {
+	fill := func(field *uint, value uint) {
+		if *field == 0 {
+			*field = value
+		}
+	}
+	fill(&config.MaxConnections, profile.MaxConnections)
+	fill(&config.MaxConnectionAge, profile.MaxConnectionAge)
+	fill(&config.ConnectTimeout, profile.ConnectTimeout)
+	fill(&config.RequestTimeout, profile.RequestTimeout)
+	fill(&config.SoftRequestTimeout, profile.SoftRequestTimeout)
+	fill(&config.RefreshInterval, profile.RefreshInterval)
+	fill(&config.MaxResultRows, profile.MaxResultRows)
+	fill(&config.TCPKeepAlive, profile.TCPKeepAlive)
+	config.KeepConnectionsAlive = config.KeepConnectionsAlive || profile.KeepConnectionsAlive
+	return config
+}
@@ -0,0 +1,98 @@
+package pool
+
+import (
+	"github.com/ziutek/mymysql/mysql"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Progress describes how far a long-running statement, such as an ALTER TABLE
+// or a large INSERT ... SELECT, has got, as reported by the server.
+type Progress struct {
+	Stage     string
+	Completed uint64
+	Estimated uint64
+	Elapsed   time.Duration
+}
+
+// Fraction returns the completed fraction of the current stage's work, between
+// 0 and 1, or 0 if the server hasn't estimated the amount of work.
+func (p Progress) Fraction() float64 {
+	if p.Estimated == 0 {
+		return 0
+	}
+	if p.Completed >= p.Estimated {
+		return 1
+	}
+	return float64(p.Completed) / float64(p.Estimated)
+}
+
+// WatchProgress reports the progress of the statements run on the connection
+// by polling performance_schema every interval from a separate connection and
+// passing the current stage to fn.  If fn returns false, the running statement
+// is killed, which lets batch tools enforce soft limits.  Call stop once the
+// statement has finished.  The server only reports progress if the stage
+// instruments and the events_stages_current consumer are enabled:
+//
+//	UPDATE performance_schema.setup_instruments SET ENABLED = 'YES', TIMED = 'YES' WHERE NAME LIKE 'stage/%';
+//	UPDATE performance_schema.setup_consumers SET ENABLED = 'YES' WHERE NAME LIKE 'events_stages_%';
+func (conn *Conn) WatchProgress(interval time.Duration, fn func(Progress) bool) (stop func(), err error) {
+	if err := conn.checkInUse(); err != nil {
+		return nil, err
+	}
+	watcher := conn.sideConn()
+	if err := watcher.Connect(); err != nil {
+		return nil, err
+	}
+
+	threadID := conn.Conn.ThreadId()
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		defer watcher.Close()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			progress, ok := stageProgress(watcher, threadID)
+			if ok && !fn(progress) {
+				watcher.Query("KILL QUERY %d", threadID)
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+		})
+	}, nil
+}
+
+// stageProgress looks up the current stage of the statement running in the
+// given server thread.  It returns false if there is none or it can't be read.
+func stageProgress(watcher mysql.Conn, threadID uint32) (Progress, bool) {
+	row, _, err := watcher.QueryFirst(
+		"SELECT s.EVENT_NAME, s.WORK_COMPLETED, s.WORK_ESTIMATED, s.TIMER_WAIT"+
+			" FROM performance_schema.events_stages_current s"+
+			" JOIN performance_schema.threads t ON t.THREAD_ID = s.THREAD_ID"+
+			" WHERE t.PROCESSLIST_ID = %d", threadID)
+	if err != nil || row == nil {
+		return Progress{}, false
+	}
+	return Progress{
+		Stage:     strings.TrimPrefix(row.Str(0), "stage/"),
+		Completed: row.Uint64(1),
+		Estimated: row.Uint64(2),
+		// TIMER_WAIT is measured in picoseconds
+		Elapsed: time.Duration(row.Uint64(3) / 1000),
+	}, true
+}
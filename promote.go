@@ -0,0 +1,95 @@
+package pool
+
+import (
+	"time"
+)
+
+// Default number of health checks in a row the primary must fail before a
+// replica is promoted automatically
+const defaultPromoteAfter = 3
+
+// Promote makes one of the cluster's replicas its primary, so that writes go
+// to it from now on, for failing over when the primary has been lost or is
+// being taken out of service.  The replica no longer serves reads as a
+// replica.  The old primary's pool is closed, which closes its connections,
+// including any still in use.  Promote only rewires the cluster's routing: the
+// server must be made writable by the cluster's own tooling or by the
+// OnPromote callback, which is called once the routing has changed.  It fails
+// with ErrNotReplica if replica isn't one of the cluster's replicas.
+func (cluster *ClusterPool) Promote(replica *Pool) error {
+	cluster.mutex.Lock()
+	index := -1
+	for i, r := range cluster.replicas {
+		if r == replica {
+			index = i
+		}
+	}
+	if index < 0 {
+		cluster.mutex.Unlock()
+		return ErrNotReplica
+	}
+	old := cluster.primary
+	replicas := make([]*Pool, 0, len(cluster.replicas)-1)
+	replicas = append(replicas, cluster.replicas[:index]...)
+	cluster.replicas = append(replicas, cluster.replicas[index+1:]...)
+	cluster.primary = replica
+	cluster.mutex.Unlock()
+
+	replica.logWarn("Promoted to primary in place of %s", old.Name())
+	old.Close()
+	if cluster.onPromote != nil {
+		cluster.onPromote(old, replica)
+	}
+	return nil
+}
+
+// watchPrimary promotes the first healthy replica when the primary's health
+// checks fail, checking at the given interval until the cluster is closed.
+func (cluster *ClusterPool) watchPrimary(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cluster.promoteIfDown()
+		case <-cluster.stop:
+			return
+		}
+	}
+}
+
+// promoteIfDown promotes the first healthy replica once the primary has failed
+// the cluster's threshold of health checks in a row, provided that the server
+// can't be reached over a new connection either.
+func (cluster *ClusterPool) promoteIfDown() {
+	primary := cluster.Primary()
+	health := primary.Health()
+	if health.CheckedAt.Equal(cluster.primaryCheckedAt) {
+		// No new check since the last look
+		return
+	}
+	cluster.primaryCheckedAt = health.CheckedAt
+	if health.Healthy {
+		cluster.primaryFailures = 0
+		return
+	}
+	if cluster.primaryFailures++; cluster.primaryFailures < cluster.promoteAfter {
+		return
+	}
+	switch primary.checkServer(primary.config.HealthCheck.Query) {
+	case nil:
+		primary.logWarn("Primary failed %d health checks in a row but is reachable, not promoting a replica", cluster.primaryFailures)
+		return
+	case ErrBudgetExhausted:
+		// The server couldn't be checked, so try again after the next failure
+		return
+	}
+	for _, replica := range cluster.Replicas() {
+		if replica.Healthy() {
+			primary.logError("Primary is down, promoting %s", replica.Name())
+			cluster.Promote(replica)
+			cluster.primaryFailures = 0
+			return
+		}
+	}
+}
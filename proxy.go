@@ -0,0 +1,106 @@
+package pool
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// proxyDial opens a connection to the database server through the proxy given
+// by Config.Proxy.  SOCKS5 proxies and HTTP proxies that support the CONNECT
+// method are supported.
+func (pool *Pool) proxyDial(proto, raddr string, timeout time.Duration) (net.Conn, error) {
+	if proto != "tcp" {
+		return nil, fmt.Errorf("Can't dial %s address through a proxy", proto)
+	}
+
+	switch pool.proxyURL.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if user := pool.proxyURL.User; user != nil {
+			password, _ := user.Password()
+			auth = &proxy.Auth{User: user.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", pool.proxyURL.Host, auth, &net.Dialer{Timeout: timeout})
+		if err != nil {
+			return nil, err
+		}
+		return dialer.Dial(proto, raddr)
+
+	default:
+		return httpConnect(pool.proxyURL, raddr, timeout)
+	}
+}
+
+// parseProxyURL parses and checks the proxy URL given in the configuration.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "socks5", "socks5h", "http":
+		return proxyURL, nil
+	}
+	return nil, fmt.Errorf("Unsupported proxy scheme %q", proxyURL.Scheme)
+}
+
+// httpConnect opens a tunnel to raddr through an HTTP proxy using the CONNECT
+// method.
+func httpConnect(proxyURL *url.URL, raddr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: raddr},
+		Host:   raddr,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy refused connection to %s: %s", raddr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{conn, reader}, nil
+}
+
+// A bufferedConn is a network connection whose reads are served from a buffer
+// that may already hold data received from the other end.  The MySQL server
+// speaks first, so its greeting can arrive along with the proxy's response.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
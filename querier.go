@@ -0,0 +1,88 @@
+package pool
+
+import (
+	"github.com/ziutek/mymysql/mysql"
+)
+
+// A Querier runs queries and statements.  It is implemented by both *Conn and
+// *Transaction, so repository code that accepts a Querier works the same way
+// inside and outside a transaction:
+//
+//	func renameUser(q pool.Querier, id int, name string) error {
+//		stmt, err := q.Prepare("UPDATE users SET name = ? WHERE id = ?")
+//		if err != nil {
+//			return err
+//		}
+//		_, err = stmt.Run(name, id)
+//		return err
+//	}
+type Querier interface {
+	Query(sql string, params ...interface{}) ([]mysql.Row, mysql.Result, error)
+	QueryFirst(sql string, params ...interface{}) (mysql.Row, mysql.Result, error)
+	QueryLast(sql string, params ...interface{}) (mysql.Row, mysql.Result, error)
+	Start(sql string, params ...interface{}) (mysql.Result, error)
+	Exec(sql string, params ...interface{}) (mysql.Result, error)
+	Prepare(sql string) (mysql.Stmt, error)
+}
+
+var (
+	_ Querier = (*Conn)(nil)
+	_ Querier = (*Transaction)(nil)
+)
+
+// Exec executes a statement that returns no rows, such as an INSERT or UPDATE,
+// and returns its result, from which the number of affected rows and the last
+// insert ID can be read.  As with Query, any parameters are substituted into
+// the SQL with fmt.Sprintf.
+func (conn *Conn) Exec(sql string, params ...interface{}) (mysql.Result, error) {
+	_, result, err := conn.Query(sql, params...)
+	return result, err
+}
+
+// Query checks out a connection, executes a query on it like Conn.Query and
+// releases it again, so that simple call sites can't leak connections.  The
+// result set has already been read, so only the result's metadata, such as its
+// fields, may be used.  Transient failures are retried according to
+// Config.RetryPolicy.
+func (pool *Pool) Query(sql string, params ...interface{}) (rows []mysql.Row, result mysql.Result, err error) {
+	err = pool.withConn(func(conn *Conn) (e error) {
+		rows, result, e = conn.Query(sql, params...)
+		return
+	})
+	return
+}
+
+// QueryFirst checks out a connection, executes a query on it like
+// Conn.QueryFirst and releases it again.
+func (pool *Pool) QueryFirst(sql string, params ...interface{}) (row mysql.Row, result mysql.Result, err error) {
+	err = pool.withConn(func(conn *Conn) (e error) {
+		row, result, e = conn.QueryFirst(sql, params...)
+		return
+	})
+	return
+}
+
+// Exec checks out a connection, executes a statement on it like Conn.Exec and
+// releases it again.  The number of affected rows and the last insert ID can
+// be read from the result.
+func (pool *Pool) Exec(sql string, params ...interface{}) (result mysql.Result, err error) {
+	err = pool.withConn(func(conn *Conn) (e error) {
+		result, e = conn.Exec(sql, params...)
+		return
+	})
+	return
+}
+
+// withConn calls fn with a connection checked out of the pool, which is
+// released once fn returns.  Transient failures are retried on another
+// checkout according to the pool's retry policy.
+func (pool *Pool) withConn(fn func(*Conn) error) error {
+	return pool.withRetry(func() error {
+		conn, err := pool.Get()
+		if err != nil {
+			return err
+		}
+		defer conn.Release()
+		return fn(conn)
+	})
+}
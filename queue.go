@@ -0,0 +1,88 @@
+package pool
+
+// Callers of Get that find every connection in use join a queue, and
+// connections that become available are handed to them directly, longest
+// waiting first, rather than being put back in the pool for whichever caller
+// reaches it first.  A connection only goes back in the pool when nobody is
+// waiting, so callers that arrive later can't overtake those already waiting.
+
+// handOff passes an idle connection to the caller that has been waiting
+// longest for one, or puts it back in the pool if nobody is waiting.  It
+// returns false if there was no room for it in the pool, in which case the
+// caller must destroy it.  The caller must hold the pool's mutex.
+func (pool *Pool) handOff(conn *Conn) bool {
+	if len(pool.waiters) > 0 {
+		w := pool.waiters[0]
+		pool.waiters[0] = nil
+		pool.waiters = pool.waiters[1:]
+		w.ready <- conn
+		return true
+	}
+	if len(pool.idleConnections) >= int(pool.config.MaxConnections) {
+		return false
+	}
+	pool.idleConnections = append(pool.idleConnections, conn)
+	return true
+}
+
+// popIdle removes the connection that has been idle longest from the pool and
+// returns it, or returns nil if there are no idle connections.  The caller
+// must hold the pool's mutex.
+func (pool *Pool) popIdle() *Conn {
+	if len(pool.idleConnections) == 0 {
+		return nil
+	}
+	conn := pool.idleConnections[0]
+	pool.removeIdle(0)
+	return conn
+}
+
+// removeIdle removes the idle connection at index i from the pool.  The caller
+// must hold the pool's mutex.
+func (pool *Pool) removeIdle(i int) {
+	idle := pool.idleConnections
+	copy(idle[i:], idle[i+1:])
+	idle[len(idle)-1] = nil
+	pool.idleConnections = idle[:len(idle)-1]
+}
+
+// putIdle hands over a connection that has become idle like handOff, and
+// destroys it if there was no room for it.
+func (pool *Pool) putIdle(conn *Conn) {
+	pool.mutex.Lock()
+	ok := pool.handOff(conn)
+	pool.mutex.Unlock()
+	if !ok {
+		conn.destroy(DestroyedIdle)
+	}
+}
+
+// enqueue adds a waiter to the queue, at the front if it had already reached
+// the front once but the connection it was handed couldn't be used.  The
+// caller must hold the pool's mutex and must have found no idle connection.
+func (pool *Pool) enqueue(w *waiter, front bool) {
+	if front {
+		pool.waiters = append([]*waiter{w}, pool.waiters...)
+	} else {
+		pool.waiters = append(pool.waiters, w)
+	}
+}
+
+// dequeue removes a waiter that has given up from the queue.  If it was
+// handed a connection just as it gave up, the connection is passed on.
+func (pool *Pool) dequeue(w *waiter) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for i, queued := range pool.waiters {
+		if queued == w {
+			pool.waiters = append(pool.waiters[:i], pool.waiters[i+1:]...)
+			return
+		}
+	}
+	select {
+	case conn := <-w.ready:
+		// The pool has room for every open connection
+		pool.handOff(conn)
+	default:
+	}
+}
@@ -0,0 +1,137 @@
+package pool
+
+import (
+	"sort"
+	"sync"
+)
+
+// The pools registered with Register or RegisterPool, by name
+var (
+	registryMutex sync.Mutex
+	registry      = map[string]*Pool{}
+)
+
+// RegisterPool makes a pool available under a name through GetPool, so that
+// libraries and frameworks can share an application's pools without having
+// them passed to every constructor.  A pool stays registered until it is
+// unregistered or closed.  It fails with ErrPoolRegistered if another pool is
+// already registered under the name, and with ErrPoolClosed if the pool has
+// been closed.
+func RegisterPool(name string, pool *Pool) error {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, ok := registry[name]; ok {
+		return ErrPoolRegistered
+	}
+	// Checked while holding the registry's lock, so that Close can't miss
+	// the new entry
+	if pool.closed() {
+		return ErrPoolClosed
+	}
+	registry[name] = pool
+	return nil
+}
+
+// Register creates a pool with the given configuration or options, like New,
+// and registers it under a name with RegisterPool, so that an application can
+// configure its pools in one place and look them up anywhere else:
+//
+//	pool.Register("readonly", readonlyConfig)
+//	...
+//	rows, _, err := pool.Lookup("readonly").Query("SELECT ...")
+//
+// The pool is given the name as its Config.Name unless the configuration sets
+// one.  If the name is taken, the new pool is closed again and
+// ErrPoolRegistered is returned.
+func Register(name string, opts ...Option) (*Pool, error) {
+	var config Config
+	for _, opt := range opts {
+		opt.apply(&config)
+	}
+	if len(config.Name) == 0 {
+		config.Name = name
+	}
+	pool, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := RegisterPool(name, pool); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return pool, nil
+}
+
+// Lookup returns the pool registered under a name, or nil if there is none.
+// Unlike GetPool it can be used inline where the pool is known to have been
+// registered at startup.
+func Lookup(name string) *Pool {
+	pool, _ := GetPool(name)
+	return pool
+}
+
+// GetPool returns the pool registered under a name, or ErrUnknownPool if
+// there is none.
+func GetPool(name string) (*Pool, error) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	pool, ok := registry[name]
+	if !ok {
+		return nil, ErrUnknownPool
+	}
+	return pool, nil
+}
+
+// UnregisterPool removes the pool registered under a name, if any, and returns
+// it.  The pool is left open.
+func UnregisterPool(name string) *Pool {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	pool := registry[name]
+	delete(registry, name)
+	return pool
+}
+
+// RegisteredPools returns the names under which pools are registered, in
+// alphabetical order.
+func RegisteredPools() []string {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CloseRegisteredPools closes all the registered pools, for use when the
+// application shuts down, and returns the first error.  Closing a pool
+// unregisters it.
+func CloseRegisteredPools() (err error) {
+	registryMutex.Lock()
+	pools := make([]*Pool, 0, len(registry))
+	for _, pool := range registry {
+		pools = append(pools, pool)
+	}
+	registryMutex.Unlock()
+
+	for _, pool := range pools {
+		if closeErr := pool.Close(); err == nil && closeErr != ErrPoolClosed {
+			err = closeErr
+		}
+	}
+	return
+}
+
+// unregister removes a pool from the registry under every name it is
+// registered under.
+func (pool *Pool) unregister() {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	for name, registered := range registry {
+		if registered == pool {
+			delete(registry, name)
+		}
+	}
+}
@@ -1,72 +1,328 @@
 package pool
 
 import (
+	"context"
 	"github.com/ziutek/mymysql/mysql"
+	"io"
+	"sync"
+	"time"
 )
 
+// rowPool recycles row buffers used by GetPooledRow and End.
+var rowPool = sync.Pool{
+	New: func() interface{} {
+		return new(PooledRow)
+	},
+}
+
+// A PooledRow is a row whose buffer is recycled once it has been released.
+type PooledRow struct {
+	mysql.Row
+}
+
+// getPooledRow returns a row buffer with room for n values.  The row is never
+// nil, even if n is zero, as the driver rejects a nil row even for results
+// without any columns.
+func getPooledRow(n int) *PooledRow {
+	row := rowPool.Get().(*PooledRow)
+	if row.Row == nil || cap(row.Row) < n {
+		row.Row = make(mysql.Row, n)
+	}
+	row.Row = row.Row[:n]
+	return row
+}
+
+// Release returns the row's buffer to be reused.  Neither the row nor any
+// values taken from it may be used after it has been released.
+func (row *PooledRow) Release() {
+	for i := range row.Row {
+		row.Row[i] = nil
+	}
+	rowPool.Put(row)
+}
+
 // A Result is the result of a query executed on a connection in a database pool.
+// Reading it counts against the request timeout of the query that produced it,
+// and is cancelled along with the context the query was run with.
 type Result struct {
 	mysql.Result
-	conn *Conn
+	conn  *Conn
+	sql   string
+	start time.Time
+	ctx   context.Context
+}
+
+// fetch reads from the result within what remains of the request timeout.
+// Results that aren't tied to a request, such as those of a pipeline, which
+// have already been read, are read without a time limit.
+func (r *Result) fetch(f func() error) error {
+	if r.start.IsZero() {
+		return r.conn.destroyOnError(f)
+	}
+	read := func() error {
+		return r.conn.withDeadline(r.sql, r.start, func() error {
+			return r.conn.destroyOnError(f)
+		})
+	}
+	if r.ctx != nil && r.ctx != r.conn.ctx {
+		return r.conn.withContext(r.ctx, read)
+	}
+	return read()
 }
 
 // NextResult returns the next result set produced by a multi-statement query or
 // stored procedure.
 func (r *Result) NextResult() (result mysql.Result, err error) {
-	r.conn.destroyOnError(func() error {
-		result, err = r.Result.NextResult()
-		return err
+	err = r.fetch(func() (e error) {
+		result, e = r.Result.NextResult()
+		return
 	})
-	if result != nil {
-		result = &Result{result, r.conn}
+	if err == nil {
+		if result == nil {
+			r.endOfSet()
+		} else {
+			next := &Result{result, r.conn, r.sql, r.start, r.ctx}
+			next.trackUnread()
+			result = next
+		}
 	}
 	return
 }
 
 // GetRow returns the next row in the result set.
 func (r *Result) GetRow() (row mysql.Row, err error) {
-	r.conn.destroyOnError(func() error {
-		row, err = r.Result.GetRow()
-		return err
+	err = r.fetch(func() (e error) {
+		if row, e = r.Result.GetRow(); e == nil {
+			r.conn.mask(r.Result.Fields(), row)
+		}
+		return
+	})
+	if err == nil && row == nil {
+		r.endOfSet()
+	}
+	return
+}
+
+// GetPooledRow returns the next row in the result set like GetRow, but reads it
+// into a buffer taken from a shared pool.  Release the row once it is no longer
+// needed so that its buffer can be reused, which saves an allocation per row on
+// hot read paths.  At the end of the result set, nil is returned.
+func (r *Result) GetPooledRow() (row *PooledRow, err error) {
+	err = r.fetch(func() (e error) {
+		row = getPooledRow(len(r.Result.Fields()))
+		if e = r.Result.ScanRow(row.Row); e != nil {
+			row.Release()
+			row = nil
+			if e == io.EOF {
+				e = nil
+			}
+		} else {
+			r.conn.mask(r.Result.Fields(), row.Row)
+		}
+		return
 	})
+	if err == nil && row == nil {
+		r.endOfSet()
+	}
 	return
 }
 
+// Scan reads the next row in the result set directly into the variables pointed
+// to by dest, one per column.  The row is read into a pooled buffer and each
+// value is converted straight into its destination, which avoids allocating on
+// hot paths.  Supported destinations are pointers to int, int64, uint, uint64,
+// float64, bool, string, []byte, time.Time, time.Duration, mysql.Date and
+// interface{}.  At the end of the result set, io.EOF is returned.
+func (r *Result) Scan(dest ...interface{}) error {
+	fields := r.Result.Fields()
+	if len(dest) != len(fields) {
+		return ErrScanColumnCount
+	}
+
+	// After an error other than io.EOF the buffer isn't recycled, as the read
+	// may have timed out and still be writing to it
+	row := getPooledRow(len(fields))
+	if err := r.fetch(func() error {
+		return r.Result.ScanRow(row.Row)
+	}); err != nil {
+		if err == io.EOF {
+			row.Release()
+			r.endOfSet()
+		}
+		return err
+	}
+	defer row.Release()
+
+	r.conn.mask(fields, row.Row)
+	for i, d := range dest {
+		if err := scanValue(row.Row, i, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetRows returns all the rows in the result set.
 func (r *Result) GetRows() (rows []mysql.Row, err error) {
-	r.conn.destroyOnError(func() error {
-		rows, err = r.Result.GetRows()
-		return err
+	err = r.fetch(func() (e error) {
+		rows, e = r.conn.getRows(r.Result)
+		return
 	})
+	if err == nil {
+		r.endOfSet()
+	}
 	return
 }
 
 // GetFirstRow returns the first row in the result set.
 func (r *Result) GetFirstRow() (row mysql.Row, err error) {
-	r.conn.destroyOnError(func() error {
-		row, err = r.Result.GetFirstRow()
-		return err
+	err = r.fetch(func() (e error) {
+		if row, e = r.Result.GetFirstRow(); e == nil {
+			r.conn.mask(r.Result.Fields(), row)
+		}
+		return
 	})
+	if err == nil {
+		r.endOfSet()
+	}
 	return
 }
 
 // GetLastRow returns the last row in the result set.
 func (r *Result) GetLastRow() (row mysql.Row, err error) {
-	r.conn.destroyOnError(func() error {
-		row, err = r.Result.GetLastRow()
-		return err
+	err = r.fetch(func() (e error) {
+		if row, e = r.Result.GetLastRow(); e == nil {
+			r.conn.mask(r.Result.Fields(), row)
+		}
+		return
 	})
+	if err == nil {
+		r.endOfSet()
+	}
 	return
 }
 
-// End discards all unread rows in the result.
+// End discards all unread rows in the result.  The rows are read into a single
+// pooled buffer.
 func (r *Result) End() error {
-	return r.conn.destroyOnError(r.Result.End)
+	err := r.fetch(func() error {
+		row := getPooledRow(len(r.Result.Fields()))
+		defer row.Release()
+		for {
+			if err := r.Result.ScanRow(row.Row); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+	})
+	if err == nil {
+		r.endOfSet()
+	}
+	return err
+}
+
+// MapRows reads the remaining rows in the result set one at a time and passes
+// each to fn, so that a large result can be processed in bounded memory
+// rather than read in full with GetRows.  The rows share a pooled buffer, so
+// a row and the values taken from it are only valid until fn returns; copy
+// anything that needs to be kept.  If fn returns an error, the rest of the
+// result set is discarded and the error is returned.
+func (r *Result) MapRows(fn func(mysql.Row) error) error {
+	row := getPooledRow(len(r.Result.Fields()))
+	defer row.Release()
+	for {
+		if err := r.ScanRow(row.Row); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := fn(row.Row); err != nil {
+			if endErr := r.End(); endErr != nil {
+				return endErr
+			}
+			return err
+		}
+	}
+}
+
+// ReduceRows folds the remaining rows in the result set into an accumulator,
+// starting with acc and calling fn with the accumulator and each row in turn.
+// The final accumulator is returned.  As with MapRows, a row is only valid
+// until fn returns.
+func (r *Result) ReduceRows(fn func(acc interface{}, row mysql.Row) (interface{}, error), acc interface{}) (interface{}, error) {
+	err := r.MapRows(func(row mysql.Row) (err error) {
+		acc, err = fn(acc, row)
+		return
+	})
+	return acc, err
 }
 
 // ScanRow reads a row directly from the network connection.
 func (r *Result) ScanRow(row mysql.Row) error {
-	return r.conn.destroyOnError(func() error {
-		return r.Result.ScanRow(row)
+	err := r.fetch(func() error {
+		err := r.Result.ScanRow(row)
+		if err == nil {
+			r.conn.mask(r.Result.Fields(), row)
+		}
+		return err
 	})
+	if err == io.EOF {
+		r.endOfSet()
+	}
+	return err
+}
+
+// getRows reads all the remaining rows in a result set, masking them as
+// configured.  If the pool limits the size of results and the limit is
+// exceeded, the rest of the result set is discarded and ErrResultTooLarge is
+// returned.
+func (conn *Conn) getRows(result mysql.Result) (rows []mysql.Row, err error) {
+	if rows, err = conn.readRows(result); err == nil {
+		conn.mask(result.Fields(), rows...)
+	}
+	return
+}
+
+// readRows reads all the remaining rows in a result set within the pool's
+// result size limits.
+func (conn *Conn) readRows(result mysql.Result) (rows []mysql.Row, err error) {
+	maxRows, maxBytes := conn.pool.config.MaxResultRows, conn.pool.config.MaxResultBytes
+	if maxRows == 0 && maxBytes == 0 {
+		return mysql.GetRows(result)
+	}
+
+	var size uint
+	for {
+		row, err := result.GetRow()
+		if err != nil || row == nil {
+			return rows, err
+		}
+		size += rowSize(row)
+		if (maxRows > 0 && uint(len(rows)) >= maxRows) || (maxBytes > 0 && size > maxBytes) {
+			if err := result.End(); err != nil {
+				return nil, err
+			}
+			return nil, ErrResultTooLarge
+		}
+		rows = append(rows, row)
+	}
+}
+
+// rowSize estimates the number of bytes of memory used by the values in a row.
+func rowSize(row mysql.Row) (size uint) {
+	for _, value := range row {
+		switch v := value.(type) {
+		case nil:
+		case []byte:
+			size += uint(len(v))
+		case string:
+			size += uint(len(v))
+		default:
+			size += 8
+		}
+	}
+	return
 }
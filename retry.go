@@ -0,0 +1,147 @@
+package pool
+
+import (
+	"errors"
+	"github.com/ziutek/mymysql/mysql"
+	"time"
+)
+
+const (
+	defaultRetryAttempts = 3
+	defaultRetryBackoff  = 100 * time.Millisecond
+)
+
+// Error codes retried by default: deadlocks and lock wait timeouts
+var defaultRetryCodes = []uint16{1213, 1205}
+
+// A RetryPolicy tells the pool which failures of Pool.Query, QueryFirst, Exec
+// and WithTransaction are transient, and how to retry them.  Each retry runs
+// the whole operation again on a newly checked out connection and counts
+// against the pool's retry budget (see Config.RetryRate).
+type RetryPolicy struct {
+	// MaxAttempts is the number of times an operation is attempted in all,
+	// 3 by default.
+	MaxAttempts uint
+
+	// Backoff is the time to wait before the first retry, 100 milliseconds by
+	// default.  It doubles with each further retry, up to MaxBackoff if that
+	// is set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Codes are the MySQL error codes that are retried, by default 1213
+	// (deadlock found) and 1205 (lock wait timeout exceeded).
+	Codes []uint16
+}
+
+// retryable reports whether err is a server error the policy retries.
+func (policy *RetryPolicy) retryable(err error) bool {
+	var mysqlErr *mysql.Error
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	codes := policy.Codes
+	if codes == nil {
+		codes = defaultRetryCodes
+	}
+	for _, code := range codes {
+		if mysqlErr.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the time to wait before the given retry, counting from 1.
+func (policy *RetryPolicy) backoff(retry uint) time.Duration {
+	backoff := policy.Backoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	for i := uint(1); i < retry; i++ {
+		backoff *= 2
+		if policy.MaxBackoff > 0 && backoff >= policy.MaxBackoff {
+			return policy.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+// withRetry calls fn, and calls it again according to the pool's retry policy
+// for as long as it fails with a transient error.
+func (pool *Pool) withRetry(fn func() error) error {
+	policy := pool.config.RetryPolicy
+	if policy == nil {
+		return fn()
+	}
+	attempts := policy.MaxAttempts
+	if attempts == 0 {
+		attempts = defaultRetryAttempts
+	}
+	for attempt := uint(1); ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= attempts || !policy.retryable(err) || !pool.AllowRetry() {
+			return err
+		}
+		pool.logDebug("Retrying after transient error (attempt %d of %d): %v", attempt, attempts, err)
+		time.Sleep(policy.backoff(attempt))
+	}
+}
+
+// RetryStats describes the state of the pool's retry budget.  Tokens is the
+// number of retries the budget currently allows, and Allowed and Denied count
+// the retries it has let through and turned down.
+type RetryStats struct {
+	Tokens  float64
+	Allowed uint64
+	Denied  uint64
+}
+
+// AllowRetry reports whether the pool's retry budget (see Config.RetryRate)
+// allows another retry, and if so, spends one.  The pool consults it before
+// retrying an operation itself, and applications can use it to make their own
+// retries back off along with the pool's during an incident.
+func (pool *Pool) AllowRetry() bool {
+	pool.statsMutex.Lock()
+	defer pool.statsMutex.Unlock()
+	if pool.config.RetryRate > 0 {
+		pool.refillRetries()
+		if pool.retryStats.Tokens < 1 {
+			pool.retryStats.Denied++
+			return false
+		}
+		pool.retryStats.Tokens--
+	}
+	pool.retryStats.Allowed++
+	return true
+}
+
+// RetryStats returns the current state of the pool's retry budget.
+func (pool *Pool) RetryStats() RetryStats {
+	pool.statsMutex.Lock()
+	defer pool.statsMutex.Unlock()
+	if pool.config.RetryRate > 0 {
+		pool.refillRetries()
+	}
+	return pool.retryStats
+}
+
+// refillRetries adds the tokens earned since the retry budget was last
+// refilled.  The caller must hold the pool's stats mutex.
+func (pool *Pool) refillRetries() {
+	now := time.Now()
+	earned := now.Sub(pool.retriesRefilled).Seconds() * pool.config.RetryRate
+	pool.retryStats.Tokens += earned
+	if burst := pool.retryBurst(); pool.retryStats.Tokens > burst {
+		pool.retryStats.Tokens = burst
+	}
+	pool.retriesRefilled = now
+}
+
+// retryBurst returns the maximum number of tokens in the retry budget.
+func (pool *Pool) retryBurst() float64 {
+	if pool.config.RetryBurst == 0 {
+		return 1
+	}
+	return float64(pool.config.RetryBurst)
+}
@@ -0,0 +1,149 @@
+package pool
+
+import (
+	"context"
+	"github.com/ziutek/mymysql/mysql"
+	"io"
+)
+
+// Rows iterates over the rows of a result set, reading them from the server
+// one at a time as Next is called:
+//
+//	rows, err := conn.QueryRows("SELECT id, name FROM users")
+//	if err != nil {
+//		return err
+//	}
+//	defer rows.Close()
+//	for rows.Next() {
+//		var id int
+//		var name string
+//		if err := rows.Scan(&id, &name); err != nil {
+//			return err
+//		}
+//	}
+//	return rows.Err()
+//
+// Reading each row counts against the request timeout of the query, so a
+// server that stalls in the middle of a result set fails Next with
+// ErrRequestTimeout rather than blocking it forever, and if the query was run
+// with a context, Next fails once the context is done.  The rows share a
+// pooled buffer, so the current row is only valid until Next is called again.
+type Rows struct {
+	result *Result
+	row    *PooledRow
+	err    error
+	closed bool
+}
+
+// QueryRows executes a query on a connection and returns an iterator over the
+// rows it produces.  The rows must be read to the end or closed before the
+// connection is used again.
+func (conn *Conn) QueryRows(sql string, params ...interface{}) (*Rows, error) {
+	result, err := conn.Start(sql, params...)
+	if err != nil {
+		return nil, err
+	}
+	return result.(*Result).Rows(), nil
+}
+
+// QueryRowsContext executes a query on a connection like QueryRows.  Reading
+// the rows is aborted once ctx is done.
+func (conn *Conn) QueryRowsContext(ctx context.Context, sql string, params ...interface{}) (*Rows, error) {
+	result, err := conn.StartContext(ctx, sql, params...)
+	if err != nil {
+		return nil, err
+	}
+	return result.(*Result).Rows(), nil
+}
+
+// Rows returns an iterator over the rows of the result set that haven't been
+// read yet.
+func (r *Result) Rows() *Rows {
+	return &Rows{result: r}
+}
+
+// Fields returns the columns of the result set.
+func (rows *Rows) Fields() []*mysql.Field {
+	return rows.result.Fields()
+}
+
+// Next reads the next row, and reports whether there was one.  It returns false
+// at the end of the result set and when reading fails, which Err tells apart.
+func (rows *Rows) Next() bool {
+	if rows.closed || rows.err != nil {
+		return false
+	}
+	if rows.row == nil {
+		rows.row = getPooledRow(len(rows.result.Fields()))
+	}
+	if err := rows.result.ScanRow(rows.row.Row); err != nil {
+		if err == io.EOF {
+			rows.release()
+		} else {
+			// The read may have timed out and still be writing to the buffer,
+			// so it isn't recycled
+			rows.row = nil
+			rows.err = err
+		}
+		rows.closed = true
+		return false
+	}
+	return true
+}
+
+// Row returns the current row, which is only valid until Next is called
+// again.
+func (rows *Rows) Row() mysql.Row {
+	if rows.row == nil {
+		return nil
+	}
+	return rows.row.Row
+}
+
+// Scan converts the values of the current row into the variables pointed to by
+// dest, one per column, as Result.Scan does.  It fails with ErrNoCurrentRow if
+// Next hasn't returned a row to scan.
+func (rows *Rows) Scan(dest ...interface{}) error {
+	if rows.closed || rows.row == nil {
+		return ErrNoCurrentRow
+	}
+	if len(dest) != len(rows.row.Row) {
+		return ErrScanColumnCount
+	}
+	for i, d := range dest {
+		if err := scanValue(rows.row.Row, i, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Err returns the error that ended the iteration, or nil if the rows were read
+// to the end.
+func (rows *Rows) Err() error {
+	return rows.err
+}
+
+// Close discards the rows that haven't been read, so that the connection can
+// be used again.  It may be called more than once, and after the rows have
+// been read to the end.
+func (rows *Rows) Close() error {
+	if rows.closed {
+		return nil
+	}
+	rows.closed = true
+	rows.release()
+	if err := rows.result.End(); err != nil {
+		rows.err = err
+		return err
+	}
+	return nil
+}
+
+// release returns the row buffer to be reused.
+func (rows *Rows) release() {
+	if rows.row != nil {
+		rows.row.Release()
+		rows.row = nil
+	}
+}
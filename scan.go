@@ -0,0 +1,45 @@
+package pool
+
+import (
+	"fmt"
+	"github.com/ziutek/mymysql/mysql"
+	"time"
+)
+
+// scanValue converts the nn-th value in a row into the variable pointed to by
+// dest.  Byte slices are copied into the destination's existing buffer so that
+// it can be reused from row to row.
+func scanValue(row mysql.Row, nn int, dest interface{}) (err error) {
+	switch d := dest.(type) {
+	case *int:
+		*d, err = row.IntErr(nn)
+	case *int64:
+		*d, err = row.Int64Err(nn)
+	case *uint:
+		*d, err = row.UintErr(nn)
+	case *uint64:
+		*d, err = row.Uint64Err(nn)
+	case *float64:
+		*d, err = row.FloatErr(nn)
+	case *bool:
+		*d, err = row.BoolErr(nn)
+	case *string:
+		*d = row.Str(nn)
+	case *[]byte:
+		*d = append((*d)[:0], row.Bin(nn)...)
+	case *time.Time:
+		*d, err = row.LocaltimeErr(nn)
+	case *time.Duration:
+		*d, err = row.DurationErr(nn)
+	case *mysql.Date:
+		*d, err = row.DateErr(nn)
+	case *interface{}:
+		*d = row[nn]
+	default:
+		return fmt.Errorf("Can't scan column %d into %T", nn, dest)
+	}
+	if err != nil {
+		return fmt.Errorf("Can't scan column %d into %T: %s", nn, dest, err)
+	}
+	return nil
+}
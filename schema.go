@@ -0,0 +1,132 @@
+package pool
+
+import (
+	"strings"
+	"time"
+)
+
+// A Schema describes the tables in the pool's database, as loaded from
+// information_schema.
+type Schema struct {
+	Tables   map[string]*Table
+	LoadedAt time.Time
+}
+
+// A Table describes a table's columns, in order, and the columns of its
+// primary key, in key order.  PrimaryKey is empty if the table has no
+// primary key.
+type Table struct {
+	Name       string
+	Columns    []Column
+	PrimaryKey []string
+}
+
+// A Column describes a table column.  Type is the full column type, such as
+// "varchar(100)" or "int unsigned", and DataType the bare type name.  Key is
+// "PRI", "UNI" or "MUL" if the column is (the first column of) an index, as
+// reported by MySQL, which also says "PRI" for a unique key that stands in for
+// a missing primary key.
+type Column struct {
+	Name     string
+	Type     string
+	DataType string
+	Nullable bool
+	Key      string
+}
+
+// Column returns the column with the given name, or nil if there is none.
+func (table *Table) Column(name string) *Column {
+	for i := range table.Columns {
+		if strings.EqualFold(table.Columns[i].Name, name) {
+			return &table.Columns[i]
+		}
+	}
+	return nil
+}
+
+// Schema returns the metadata of the tables in the pool's database.  It is
+// loaded when first needed and cached for Config.SchemaTTL seconds, or until
+// InvalidateSchema is called if no TTL is set, so that code that needs
+// metadata doesn't query information_schema over and over.  The pool doesn't
+// use the schema itself; it is there for application code, such as query
+// builders and scanners, that works from table metadata.  The returned Schema
+// must not be modified.
+func (pool *Pool) Schema() (*Schema, error) {
+	pool.schemaMutex.Lock()
+	defer pool.schemaMutex.Unlock()
+
+	ttl := time.Duration(pool.config.SchemaTTL) * time.Second
+	if pool.schema != nil && (ttl == 0 || time.Since(pool.schema.LoadedAt) < ttl) {
+		return pool.schema, nil
+	}
+	schema, err := pool.loadSchema()
+	if err != nil {
+		return nil, err
+	}
+	pool.schema = schema
+	return schema, nil
+}
+
+// InvalidateSchema discards the cached schema, for instance after a migration,
+// so that the next call to Schema reloads it.
+func (pool *Pool) InvalidateSchema() {
+	pool.schemaMutex.Lock()
+	defer pool.schemaMutex.Unlock()
+	pool.schema = nil
+}
+
+// loadSchema reads the metadata of the tables in the pool's database.
+func (pool *Pool) loadSchema() (*Schema, error) {
+	conn, err := pool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Release()
+
+	database := "DATABASE()"
+	if name := pool.endpoint().Database; len(name) > 0 {
+		database = conn.sqlString(name)
+	}
+	rows, _, err := conn.Query(
+		"SELECT TABLE_NAME, COLUMN_NAME, COLUMN_TYPE, DATA_TYPE, IS_NULLABLE, COLUMN_KEY"+
+			" FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = %s"+
+			" ORDER BY TABLE_NAME, ORDINAL_POSITION", database)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := &Schema{Tables: map[string]*Table{}, LoadedAt: time.Now()}
+	for _, row := range rows {
+		name := row.Str(0)
+		table := schema.Tables[name]
+		if table == nil {
+			table = &Table{Name: name}
+			schema.Tables[name] = table
+		}
+		column := Column{
+			Name:     row.Str(1),
+			Type:     row.Str(2),
+			DataType: row.Str(3),
+			Nullable: row.Str(4) == "YES",
+			Key:      row.Str(5),
+		}
+		table.Columns = append(table.Columns, column)
+	}
+
+	// COLUMN_KEY can't be used for the primary key, as it lists the columns
+	// in table order rather than key order, and says PRI for a unique key
+	// that MySQL treats as the primary key when a table has none
+	rows, _, err = conn.Query(
+		"SELECT TABLE_NAME, COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE"+
+			" WHERE TABLE_SCHEMA = %s AND CONSTRAINT_NAME = 'PRIMARY'"+
+			" ORDER BY TABLE_NAME, ORDINAL_POSITION", database)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if table := schema.Tables[row.Str(0)]; table != nil {
+			table.PrimaryKey = append(table.PrimaryKey, row.Str(1))
+		}
+	}
+	return schema, nil
+}
@@ -0,0 +1,136 @@
+package pool
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A ScriptStatement is one of the statements of an SQL script, without its
+// delimiter.  Line is the line of the script on which it starts, counting
+// from 1.
+type ScriptStatement struct {
+	SQL  string
+	Line int
+}
+
+// A ScriptError is returned by ExecScript when a statement in a script fails.
+// It holds the statement and the error the server returned for it.
+type ScriptError struct {
+	Statement ScriptStatement
+	Err       error
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("Statement at line %d of script failed: %s", e.Statement.Line, e.Err)
+}
+
+// Unwrap returns the error the statement failed with.
+func (e *ScriptError) Unwrap() error {
+	return e.Err
+}
+
+// SplitScript splits an SQL script, such as a schema file or the output of
+// mysqldump, into its statements the way the mysql command-line client does.
+// Statements end with a semicolon, or with the delimiter set by a DELIMITER
+// command, which is how scripts define stored programs whose bodies contain
+// semicolons.  Delimiters inside quoted strings, identifiers and comments are
+// ignored.  Comments between statements are dropped, while comments within a
+// statement, including MySQL's executable comments, are kept.
+func SplitScript(script string) []ScriptStatement {
+	var statements []ScriptStatement
+	delimiter := ";"
+	start, content := 0, false
+	line, counted := 1, 0
+	finish := func(end int) {
+		if content {
+			statements = append(statements, ScriptStatement{strings.TrimSpace(script[start:end]), line})
+		}
+		content = false
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case isSpace(c):
+		case c == '#' || (strings.HasPrefix(script[i:], "--") && (i+2 == len(script) || isSpace(script[i+2]))):
+			for i < len(script) && script[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(script[i:], "/*") && !strings.HasPrefix(script[i:], "/*!"):
+			end := strings.Index(script[i+2:], "*/")
+			if end < 0 {
+				i = len(script)
+			} else {
+				i += end + 3
+			}
+		case !content && isDelimiterCommand(script[i:]):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			if fields := strings.Fields(script[i+len("delimiter") : i+end]); len(fields) > 0 {
+				delimiter = fields[0]
+			}
+			i += end
+		case strings.HasPrefix(script[i:], delimiter):
+			finish(i)
+			i += len(delimiter) - 1
+		default:
+			if !content {
+				line += strings.Count(script[counted:i], "\n")
+				start, counted, content = i, i, true
+			}
+			switch {
+			case c == '\'' || c == '"' || c == '`':
+				// Backslashes only escape characters in string literals
+				for i++; i < len(script) && script[i] != c; i++ {
+					if script[i] == '\\' && c != '`' {
+						i++
+					}
+				}
+			case strings.HasPrefix(script[i:], "/*!"):
+				end := strings.Index(script[i+3:], "*/")
+				if end < 0 {
+					i = len(script)
+				} else {
+					i += end + 4
+				}
+			}
+		}
+	}
+	finish(len(script))
+	return statements
+}
+
+// isDelimiterCommand reports whether s starts with a DELIMITER command.
+func isDelimiterCommand(s string) bool {
+	n := len("delimiter")
+	return len(s) > n && strings.EqualFold(s[:n], "delimiter") && (s[n] == ' ' || s[n] == '\t')
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// ExecScript executes an SQL script, such as a schema file, on the connection.
+// The script is split into statements with SplitScript, which are executed one
+// at a time, each within the pool's request timeout and subject to its
+// statement guard.  Any rows the statements return are discarded.  Execution
+// stops at the first statement that fails, and a ScriptError is returned
+// identifying it; the statements before it are not undone, so scripts that
+// must apply all or nothing should run inside a transaction where the server
+// allows it.
+func (conn *Conn) ExecScript(sql string) error {
+	for _, statement := range SplitScript(sql) {
+		result, err := conn.Start(statement.SQL)
+		for err == nil && result != nil {
+			if err = result.End(); err == nil {
+				result, err = result.NextResult()
+			}
+		}
+		if err != nil {
+			return &ScriptError{statement, err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package pool
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Self-test thresholds
+const (
+	// SelfTestMaxClockSkew is the largest difference between the
+	// application's clock and the server's that SelfTest accepts.
+	SelfTestMaxClockSkew = time.Second
+
+	// SelfTestMinPacket is the smallest max_allowed_packet that SelfTest
+	// accepts unless Config.MinAllowedPacket says otherwise.  It is the
+	// default of MySQL 5.7, so only a server configured below the stock
+	// setting fails the check.
+	SelfTestMinPacket = 4 * 1024 * 1024
+)
+
+// A SelfTestCheck is the outcome of one of the checks made by SelfTest.
+// Detail describes what was found, and Err holds the reason a check failed.
+// A check that couldn't be run because an earlier one failed is marked
+// Skipped.
+type SelfTestCheck struct {
+	Name    string
+	OK      bool
+	Skipped bool
+	Detail  string
+	Err     error
+}
+
+// A SelfTestReport holds the outcome of each of the checks made by SelfTest,
+// in the order they were made.
+type SelfTestReport struct {
+	Checks   []SelfTestCheck
+	Duration time.Duration
+}
+
+// OK reports whether every check passed.
+func (r *SelfTestReport) OK() bool {
+	for _, check := range r.Checks {
+		if !check.OK {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the report with one line per check, for deploy logs.
+func (r *SelfTestReport) String() string {
+	var buf bytes.Buffer
+	for _, check := range r.Checks {
+		status := "ok"
+		switch {
+		case check.Skipped:
+			status = "skipped"
+		case !check.OK:
+			status = "FAILED"
+		}
+		fmt.Fprintf(&buf, "%-12s %-7s %s", check.Name, status, check.Detail)
+		if check.Err != nil {
+			fmt.Fprintf(&buf, ": %s", check.Err)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.String()
+}
+
+// SelfTest checks that the pool can work with its server, for deploy-time
+// smoke tests.  It checks in turn that
+//
+//   - a connection can be checked out ("connect"),
+//   - the configured charset and collation are in effect ("charset"),
+//   - the user has privileges on the configured database ("permissions"),
+//     as listed by SHOW GRANTS,
+//   - the application's and the server's clocks agree to within
+//     SelfTestMaxClockSkew ("clock"), and
+//   - max_allowed_packet is at least Config.MinAllowedPacket, or
+//     SelfTestMinPacket if that isn't set ("packet").
+//
+// If no connection can be checked out, the remaining checks are skipped.  The
+// checks don't change any data.
+func (pool *Pool) SelfTest() *SelfTestReport {
+	start := time.Now()
+	report := &SelfTestReport{}
+	add := func(name, detail string, ok bool, err error) {
+		report.Checks = append(report.Checks, SelfTestCheck{Name: name, OK: ok && err == nil, Detail: detail, Err: err})
+	}
+	checks := []struct {
+		name string
+		run  func(*Conn) (string, bool, error)
+	}{
+		{"charset", pool.checkCharset},
+		{"permissions", pool.checkPermissions},
+		{"clock", pool.checkClock},
+		{"packet", pool.checkPacket},
+	}
+
+	conn, err := pool.Get()
+	if err != nil {
+		add("connect", "", false, err)
+		for _, check := range checks {
+			report.Checks = append(report.Checks, SelfTestCheck{Name: check.name, Skipped: true})
+		}
+		report.Duration = time.Since(start)
+		return report
+	}
+	defer conn.Release()
+	add("connect", fmt.Sprintf("%s %s", pool.endpoint().Protocol, conn.address), true, nil)
+	for _, check := range checks {
+		detail, ok, err := check.run(conn)
+		add(check.name, detail, ok, err)
+	}
+	report.Duration = time.Since(start)
+	return report
+}
+
+// checkCharset checks that the connection uses the configured charset and
+// collation.
+func (pool *Pool) checkCharset(conn *Conn) (string, bool, error) {
+	row, _, err := conn.QueryFirst("SELECT @@character_set_connection, @@collation_connection")
+	if err != nil {
+		return "", false, err
+	}
+	charset, collation := row.Str(0), row.Str(1)
+	detail := fmt.Sprintf("%s, %s", charset, collation)
+	if len(pool.config.Charset) > 0 && !strings.EqualFold(charset, pool.config.Charset) {
+		return detail, false, fmt.Errorf("Expected charset %s", pool.config.Charset)
+	}
+	if len(pool.config.Collation) > 0 && !strings.EqualFold(collation, pool.config.Collation) {
+		return detail, false, fmt.Errorf("Expected collation %s", pool.config.Collation)
+	}
+	return detail, true, nil
+}
+
+// checkPermissions checks that the user has been granted privileges other than
+// USAGE on the configured database, or on all databases.
+func (pool *Pool) checkPermissions(conn *Conn) (string, bool, error) {
+	database := pool.endpoint().Database
+	if len(database) == 0 {
+		return "no database configured", true, nil
+	}
+	rows, _, err := conn.Query("SHOW GRANTS")
+	if err != nil {
+		return "", false, err
+	}
+	var privileges []string
+	for _, row := range rows {
+		if grant := grantPrivileges(row.Str(0), database); len(grant) > 0 {
+			privileges = append(privileges, grant)
+		}
+	}
+	if len(privileges) == 0 {
+		return "", false, fmt.Errorf("No privileges on %s", database)
+	}
+	return strings.Join(privileges, "; "), true, nil
+}
+
+// grantPrivileges returns the privileges granted by a line of SHOW GRANTS
+// output on the given database or on all databases, or "" if the line grants
+// none.
+func grantPrivileges(grant, database string) string {
+	on := strings.Index(grant, " ON ")
+	to := strings.Index(grant, " TO ")
+	if !strings.HasPrefix(grant, "GRANT ") || on < 0 || to < on {
+		return ""
+	}
+	privileges := grant[len("GRANT "):on]
+	target := grant[on+len(" ON ") : to]
+	if privileges == "USAGE" {
+		return ""
+	}
+	name := strings.NewReplacer("\\_", "_", "\\%", "%").Replace(strings.TrimSuffix(target, ".*"))
+	if target != "*.*" && strings.Trim(name, "`") != database {
+		return ""
+	}
+	return privileges + " ON " + target
+}
+
+// checkClock compares the server's clock with the application's, allowing for
+// the time the query takes.
+func (pool *Pool) checkClock(conn *Conn) (string, bool, error) {
+	before := time.Now()
+	row, _, err := conn.QueryFirst("SELECT UNIX_TIMESTAMP(NOW(6))")
+	if err != nil {
+		return "", false, err
+	}
+	after := time.Now()
+	seconds := row.Float(0)
+	server := time.Unix(0, int64(seconds*float64(time.Second)))
+	skew := server.Sub(before.Add(after.Sub(before) / 2))
+	detail := fmt.Sprintf("server clock is off by %s", skew.Round(time.Millisecond))
+	if skew > SelfTestMaxClockSkew || skew < -SelfTestMaxClockSkew {
+		return detail, false, fmt.Errorf("Clocks differ by more than %s", SelfTestMaxClockSkew)
+	}
+	return detail, true, nil
+}
+
+// checkPacket checks that the server accepts large enough packets.
+func (pool *Pool) checkPacket(conn *Conn) (string, bool, error) {
+	row, _, err := conn.QueryFirst("SELECT @@max_allowed_packet")
+	if err != nil {
+		return "", false, err
+	}
+	size := row.Int64(0)
+	detail := fmt.Sprintf("max_allowed_packet is %d bytes", size)
+	min := int64(pool.config.MinAllowedPacket)
+	if min == 0 {
+		min = SelfTestMinPacket
+	}
+	if size < min {
+		return detail, false, fmt.Errorf("Expected at least %d bytes", min)
+	}
+	return detail, true, nil
+}
@@ -0,0 +1,44 @@
+package pool
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// A session tracks the writes made within a logical context, such as the
+// handling of one user's request, so that the reads that follow them can be
+// sent where the writes are visible.
+type session struct {
+	lastWrite int64 // Unix nanoseconds, accessed atomically
+}
+
+// WithSession returns a copy of ctx that carries a new session.  When a write
+// is routed through a ClusterPool with a context carrying the session, the
+// reads routed with it for the following ClusterConfig.ReadYourWritesWindow
+// seconds go to the primary instead of to a replica, so that they see the
+// write even if the replicas lag behind.  The window is counted from when the
+// connection the write was routed to is released, so that it covers the
+// reads after a long transaction too.  Contexts derived from the returned
+// one share the session.
+func WithSession(ctx context.Context) context.Context {
+	return context.WithValue(ctx, sessionKey, &session{})
+}
+
+// sessionFromContext returns the session carried by ctx, or nil.
+func sessionFromContext(ctx context.Context) *session {
+	s, _ := ctx.Value(sessionKey).(*session)
+	return s
+}
+
+// wrote notes that a write has just been made in the session.
+func (s *session) wrote() {
+	atomic.StoreInt64(&s.lastWrite, time.Now().UnixNano())
+}
+
+// wroteWithin reports whether a write has been made in the session within the
+// given window.
+func (s *session) wroteWithin(window time.Duration) bool {
+	lastWrite := atomic.LoadInt64(&s.lastWrite)
+	return lastWrite != 0 && time.Since(time.Unix(0, lastWrite)) < window
+}
@@ -0,0 +1,89 @@
+package pool
+
+import (
+	"github.com/ziutek/mymysql/mysql"
+	"sync/atomic"
+	"time"
+)
+
+// serverTimeSQL reads how long the server spent executing the most recent
+// statement on the connection, in picoseconds, from performance_schema.
+const serverTimeSQL = "SELECT TIMER_WAIT FROM performance_schema.events_statements_history " +
+	"WHERE THREAD_ID = (SELECT THREAD_ID FROM performance_schema.threads WHERE PROCESSLIST_ID = CONNECTION_ID()) " +
+	"ORDER BY EVENT_ID DESC LIMIT 1"
+
+// A SlowQuery describes a query reported to Config.OnSlowQuery.  Elapsed is
+// the time the client observed, from sending the query to having read its
+// result.  ServerTime is the time the server spent executing it, which is only
+// known, as HasServerTime reports, if the server's performance_schema is
+// enabled and readable by the pool's user.
+type SlowQuery struct {
+	SQL           string
+	Elapsed       time.Duration
+	ServerTime    time.Duration
+	HasServerTime bool
+}
+
+// NetworkTime returns the part of the time the client observed that the
+// server didn't spend executing the query, which was taken up by the network
+// and by the client itself.  It is zero if the server's time isn't known.
+func (q *SlowQuery) NetworkTime() time.Duration {
+	if !q.HasServerTime || q.ServerTime > q.Elapsed {
+		return 0
+	}
+	return q.Elapsed - q.ServerTime
+}
+
+// reportSlowQuery reports a query that began at the given time and whose
+// result has been read in full to OnSlowQuery if it took longer than the
+// pool's soft request timeout.
+func (conn *Conn) reportSlowQuery(sql string, start time.Time) {
+	pool := conn.pool
+	if pool.config.OnSlowQuery == nil || pool.softTimeout == 0 {
+		return
+	}
+	elapsed := time.Since(start)
+	if elapsed < pool.softTimeout {
+		return
+	}
+	slow := &SlowQuery{SQL: sql, Elapsed: elapsed}
+	if atomic.LoadInt32(&pool.noServerTime) == 0 {
+		slow.ServerTime, slow.HasServerTime = conn.serverTime()
+	}
+	pool.config.OnSlowQuery(conn.Context(), slow)
+}
+
+// serverTime returns the time the server spent executing the most recent
+// statement on the connection, if the server can tell.  If the server refuses
+// to, because performance_schema is disabled or the pool's user may not read
+// it, the pool stops asking.  Other failures, such as the lookup being
+// interrupted, only cost this query its server time, and a connection broken
+// by one is destroyed like after any other request.
+func (conn *Conn) serverTime() (time.Duration, bool) {
+	pool := conn.pool
+	var row mysql.Row
+	err := conn.withDeadline(serverTimeSQL, time.Now(), func() error {
+		return conn.destroyOnError(func() (e error) {
+			row, _, e = conn.Conn.QueryFirst(serverTimeSQL)
+			return
+		})
+	})
+	if err != nil {
+		if mysqlErr, ok := err.(*mysql.Error); ok {
+			switch mysqlErr.Code {
+			case
+				1044, // Access denied to database
+				1142, // Command denied to user for table
+				1146, // Table doesn't exist
+				1227: // Access denied; you need a privilege
+				pool.logDebug("Server execution times are unavailable: %v", err)
+				atomic.StoreInt32(&pool.noServerTime, 1)
+			}
+		}
+		return 0, false
+	}
+	if len(row) == 0 {
+		return 0, false
+	}
+	return time.Duration(row.Uint64(0) / 1000), true
+}
@@ -0,0 +1,191 @@
+package pool
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/ziutek/mymysql/native"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A Connector opens a network connection to the database instance with the
+// given name.  The context carries the pool's connect timeout.  Cloud
+// connector libraries can be plugged in with a small wrapper; the Dial method
+// of cloud.google.com/go/cloudsqlconn, for instance, also takes options:
+//
+//	dialer, err := cloudsqlconn.NewDialer(ctx)
+//	...
+//	config.Connector = func(ctx context.Context, instance string) (net.Conn, error) {
+//		return dialer.Dial(ctx, instance)
+//	}
+type Connector func(ctx context.Context, instance string) (net.Conn, error)
+
+// dial opens the network connection underlying a database connection.  It
+// records the dial in the pool's statistics, applies the pool's socket options
+// and, if read or write timeouts are configured, enforces them on every read
+// and write.
+func (pool *Pool) dial(proto, laddr, raddr string, timeout time.Duration) (net.Conn, error) {
+	var netConn net.Conn
+	var err error
+	start := time.Now()
+	if pool.config.Connector != nil {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		netConn, err = pool.config.Connector(ctx, raddr)
+	} else if pool.config.SSH != nil {
+		netConn, err = pool.sshDial(proto, raddr, timeout)
+	} else if pool.proxyURL != nil {
+		netConn, err = pool.proxyDial(proto, raddr, timeout)
+	} else {
+		netConn, err = native.DefaultDialer(proto, laddr, raddr, timeout)
+	}
+	pool.traceDial(raddr, start, netConn, err)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := netConn.(*net.TCPConn); ok {
+		if err := pool.applySocketOptions(tcp); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+	}
+	if tlsConfig := pool.endpoint().TLS; tlsConfig != nil {
+		if netConn, err = startTLS(netConn, tlsConfig, raddr, timeout); err != nil {
+			return nil, err
+		}
+	}
+	if pool.readTimeout > 0 || pool.writeTimeout > 0 {
+		netConn = &deadlineConn{netConn, pool.readTimeout, pool.writeTimeout}
+	}
+	return netConn, nil
+}
+
+// startTLS wraps a network connection to the given address in TLS and
+// completes the handshake within the timeout, closing the connection if it
+// fails.
+func startTLS(netConn net.Conn, config *tls.Config, raddr string, timeout time.Duration) (net.Conn, error) {
+	if len(config.ServerName) == 0 {
+		config = config.Clone()
+		config.ServerName = raddr
+		if host, _, err := net.SplitHostPort(raddr); err == nil {
+			config.ServerName = host
+		}
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	tlsConn := tls.Client(netConn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dial opens the network connection underlying the connection, counting the
+// bytes sent and received over it in the connection's statistics.
+func (conn *Conn) dial(proto, laddr, raddr string, timeout time.Duration) (net.Conn, error) {
+	netConn, err := conn.pool.dial(proto, laddr, raddr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	counting := &countingConn{netConn, &conn.stats}
+	conn.netConn.Store(counting)
+	return counting, nil
+}
+
+// closeSocket closes the network connection underlying the connection, which
+// unlike Close is safe while another goroutine is using it: its current or next
+// operation fails, and the connection is then destroyed.  It reports whether
+// there was a socket to close, which there isn't if the connection wasn't
+// dialed by the pool.
+func (conn *Conn) closeSocket() bool {
+	netConn, ok := conn.netConn.Load().(*countingConn)
+	if ok {
+		netConn.Close()
+	}
+	return ok
+}
+
+// applySocketOptions applies the pool's TCP settings to a socket.
+func (pool *Pool) applySocketOptions(tcp *net.TCPConn) error {
+	config := pool.config
+	if config.TCPKeepAlive > 0 {
+		if err := tcp.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcp.SetKeepAlivePeriod(time.Duration(config.TCPKeepAlive) * time.Second); err != nil {
+			return err
+		}
+	}
+	if config.TCPDelay {
+		if err := tcp.SetNoDelay(false); err != nil {
+			return err
+		}
+	}
+	if config.ReadBufferSize > 0 {
+		if err := tcp.SetReadBuffer(config.ReadBufferSize); err != nil {
+			return err
+		}
+	}
+	if config.WriteBufferSize > 0 {
+		if err := tcp.SetWriteBuffer(config.WriteBufferSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A deadlineConn is a network connection on which every read and write must
+// complete within a fixed amount of time, so that a half-dead connection fails
+// quickly instead of blocking until the request timeout.
+type deadlineConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if c.readTimeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// A countingConn is a network connection that counts the bytes passing through
+// it.
+type countingConn struct {
+	net.Conn
+	stats *ConnStats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.stats.BytesReceived, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.stats.BytesSent, uint64(n))
+	return n, err
+}
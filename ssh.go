@@ -0,0 +1,132 @@
+package pool
+
+import (
+	"context"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"time"
+)
+
+// SSHConfig configures an SSH bastion through which connections to the
+// database server are tunnelled.
+type SSHConfig struct {
+	// Address of the SSH server, as host:port
+	Address string
+
+	// Username to log in as, and either a PEM-encoded private key or a
+	// password to authenticate with
+	Username   string
+	PrivateKey []byte
+	Password   string
+
+	// HostKeyCallback verifies the server's host key, e.g. ssh.FixedHostKey
+	// or a callback from golang.org/x/crypto/ssh/knownhosts.  It is required.
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+// clientConfig builds the configuration used to connect to the SSH server.
+func (config *SSHConfig) clientConfig(timeout time.Duration) (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+	if len(config.PrivateKey) > 0 {
+		signer, err := ssh.ParsePrivateKey(config.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if len(config.Password) > 0 {
+		auth = append(auth, ssh.Password(config.Password))
+	}
+
+	return &ssh.ClientConfig{
+		User:            config.Username,
+		Auth:            auth,
+		HostKeyCallback: config.HostKeyCallback,
+		Timeout:         timeout,
+	}, nil
+}
+
+// sshDial opens a connection to the database server through the SSH bastion.
+// A single SSH connection is shared by every connection in the pool; it is
+// established when first needed and re-established if it has died.  A forward
+// that the bastion refuses or that doesn't open within the timeout only fails
+// that dial, as the SSH connection, and the other connections tunnelled
+// through it, may be fine.
+func (pool *Pool) sshDial(proto, raddr string, timeout time.Duration) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := pool.sshConnect(timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		netConn, err := client.DialContext(ctx, proto, raddr)
+		if err == nil || attempt > 0 || !pool.AllowRetry() {
+			return netConn, err
+		}
+		if _, ok := err.(*ssh.OpenChannelError); ok || sshAlive(client, timeout) {
+			return nil, err
+		}
+
+		// The SSH connection has died; reconnect and try once more
+		pool.sshMutex.Lock()
+		if pool.sshClient == client {
+			pool.sshClient = nil
+		}
+		pool.sshMutex.Unlock()
+		client.Close()
+	}
+}
+
+// sshConnect returns the pool's SSH connection, establishing it if need be.
+func (pool *Pool) sshConnect(timeout time.Duration) (*ssh.Client, error) {
+	pool.sshMutex.Lock()
+	defer pool.sshMutex.Unlock()
+	if pool.sshClient == nil {
+		clientConfig, err := pool.config.SSH.clientConfig(timeout)
+		if err != nil {
+			return nil, err
+		}
+		if pool.sshClient, err = ssh.Dial("tcp", pool.config.SSH.Address, clientConfig); err != nil {
+			return nil, err
+		}
+	}
+	return pool.sshClient, nil
+}
+
+// sshAlive reports whether an SSH connection still works, by sending it a
+// keepalive request and waiting at most the given time for the reply.
+func sshAlive(client *ssh.Client, timeout time.Duration) bool {
+	alive := make(chan bool, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		alive <- err == nil
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case ok := <-alive:
+		return ok
+	case <-expired:
+		return false
+	}
+}
+
+// closeSSH closes the connection to the SSH bastion, if there is one.
+func (pool *Pool) closeSSH() {
+	pool.sshMutex.Lock()
+	defer pool.sshMutex.Unlock()
+	if pool.sshClient != nil {
+		pool.sshClient.Close()
+		pool.sshClient = nil
+	}
+}
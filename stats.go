@@ -0,0 +1,354 @@
+package pool
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// A StmtPhase identifies one phase in the execution of a prepared statement.
+type StmtPhase int
+
+// Prepared statement phases
+const (
+	StmtPrepare StmtPhase = iota
+	StmtExecute
+	StmtFetch
+)
+
+func (phase StmtPhase) String() string {
+	switch phase {
+	case StmtPrepare:
+		return "prepare"
+	case StmtExecute:
+		return "execute"
+	case StmtFetch:
+		return "fetch"
+	}
+	return "unknown"
+}
+
+// PhaseStats holds the accumulated timing of one prepared statement phase.
+type PhaseStats struct {
+	Count    uint64
+	Errors   uint64
+	Duration time.Duration
+}
+
+// StmtStats breaks down the time spent on prepared statements by phase, making
+// it possible to tell whether (re-)preparation, execution or reading results is
+// the bottleneck.
+type StmtStats struct {
+	Prepare PhaseStats
+	Execute PhaseStats
+	Fetch   PhaseStats
+}
+
+// StmtStats returns the prepared statement timing accumulated by the pool.
+func (pool *Pool) StmtStats() StmtStats {
+	pool.statsMutex.Lock()
+	defer pool.statsMutex.Unlock()
+	return pool.stmtStats
+}
+
+// traceStmt records the completion of a prepared statement phase that began at
+// the given time, and passes it on to the OnStmtPhase callback if there is one.
+func (pool *Pool) traceStmt(ctx context.Context, phase StmtPhase, sql string, start time.Time, err error) {
+	elapsed := time.Since(start)
+
+	pool.statsMutex.Lock()
+	var stats *PhaseStats
+	switch phase {
+	case StmtPrepare:
+		stats = &pool.stmtStats.Prepare
+	case StmtExecute:
+		stats = &pool.stmtStats.Execute
+	default:
+		stats = &pool.stmtStats.Fetch
+	}
+	stats.Count++
+	stats.Duration += elapsed
+	if err != nil {
+		stats.Errors++
+	}
+	pool.statsMutex.Unlock()
+
+	if pool.config.OnStmtPhase != nil {
+		pool.config.OnStmtPhase(ctx, phase, sql, elapsed, err)
+	}
+}
+
+// DialLatencyBuckets are the upper bounds of the buckets in the dial latency
+// histograms.  Dials slower than the last bound are counted in an extra,
+// final bucket.
+var DialLatencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// DialStats holds the connection establishment statistics for one endpoint.
+// Latency counts the successful dials in each of DialLatencyBuckets.
+type DialStats struct {
+	Attempts uint64
+	Failures uint64
+	Duration time.Duration
+	Latency  [len(DialLatencyBuckets) + 1]uint64
+}
+
+// DialStats returns connection establishment statistics keyed by the address
+// that was dialled, as resolved by the dialer, so that a degraded network path
+// to one node of a cluster stands out.  Failures for which no address was
+// resolved are recorded under the configured address.
+func (pool *Pool) DialStats() map[string]DialStats {
+	pool.statsMutex.Lock()
+	defer pool.statsMutex.Unlock()
+	stats := make(map[string]DialStats, len(pool.dialStats))
+	for endpoint, s := range pool.dialStats {
+		stats[endpoint] = *s
+	}
+	return stats
+}
+
+// traceDial records the outcome of a dial of raddr that began at the given time.
+func (pool *Pool) traceDial(raddr string, start time.Time, netConn net.Conn, err error) {
+	elapsed := time.Since(start)
+	endpoint := raddr
+	if err == nil {
+		if addr := netConn.RemoteAddr(); addr != nil {
+			endpoint = addr.String()
+		}
+	} else if opErr, ok := err.(*net.OpError); ok && opErr.Addr != nil {
+		endpoint = opErr.Addr.String()
+	}
+
+	pool.statsMutex.Lock()
+	defer pool.statsMutex.Unlock()
+	stats := pool.dialStats[endpoint]
+	if stats == nil {
+		stats = new(DialStats)
+		pool.dialStats[endpoint] = stats
+	}
+	stats.Attempts++
+	if err != nil {
+		stats.Failures++
+		return
+	}
+	stats.Duration += elapsed
+	bucket := 0
+	for bucket < len(DialLatencyBuckets) && elapsed > DialLatencyBuckets[bucket] {
+		bucket++
+	}
+	stats.Latency[bucket]++
+}
+
+// ConnStats holds the work done by connections over their lifetime.  The byte
+// counts cover all traffic on the network connection, including the protocol
+// overhead.
+type ConnStats struct {
+	Borrows       uint64
+	Requests      uint64
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// add adds the counters in other to stats.
+func (stats *ConnStats) add(other ConnStats) {
+	stats.Borrows += other.Borrows
+	stats.Requests += other.Requests
+	stats.BytesSent += other.BytesSent
+	stats.BytesReceived += other.BytesReceived
+}
+
+// Stats returns the number of times the connection has been checked out of the
+// pool, the number of requests it has sent to the server and the amount of
+// data it has sent and received.
+func (conn *Conn) Stats() ConnStats {
+	return ConnStats{
+		Borrows:       atomic.LoadUint64(&conn.stats.Borrows),
+		Requests:      atomic.LoadUint64(&conn.stats.Requests),
+		BytesSent:     atomic.LoadUint64(&conn.stats.BytesSent),
+		BytesReceived: atomic.LoadUint64(&conn.stats.BytesReceived),
+	}
+}
+
+// startRequest counts a new request on the connection, adds its SQL to the
+// connection's history and returns the time at which it started.
+func (conn *Conn) startRequest(sql string) time.Time {
+	atomic.AddUint64(&conn.stats.Requests, 1)
+	conn.recordHistory(sql)
+	return time.Now()
+}
+
+// ConnStats returns the combined lifetime statistics of every connection the
+// pool has ever opened.  The statistics of closed connections are kept, so
+// the totals don't drop when the pool shrinks or connections are recycled.
+func (pool *Pool) ConnStats() ConnStats {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.statsMutex.Lock()
+	stats := pool.retiredStats
+	pool.statsMutex.Unlock()
+	for conn := range pool.openConnections {
+		stats.add(conn.Stats())
+	}
+	return stats
+}
+
+// retireStats folds the statistics of a connection that is being removed from
+// the pool into the pool's totals.  The caller must hold the pool's mutex.
+func (pool *Pool) retireStats(conn *Conn) {
+	pool.statsMutex.Lock()
+	defer pool.statsMutex.Unlock()
+	pool.retiredStats.add(conn.Stats())
+}
+
+// A DestroyReason explains why a connection was closed.
+type DestroyReason int
+
+// Reasons for closing connections
+const (
+	DestroyedByCaller  DestroyReason = iota // Destroy was called
+	DestroyedOnError                        // the connection failed or a health check on it did
+	DestroyedExpired                        // the connection reached its maximum age or was recycled
+	DestroyedIdle                           // the pool had more idle connections than it needed
+	DestroyedOnRelease                      // connections aren't kept alive once released
+	DestroyedOnClose                        // the pool was closed
+	DestroyedBroken                         // the caller marked the connection broken
+)
+
+func (reason DestroyReason) String() string {
+	switch reason {
+	case DestroyedByCaller:
+		return "caller"
+	case DestroyedOnError:
+		return "error"
+	case DestroyedExpired:
+		return "expired"
+	case DestroyedIdle:
+		return "idle"
+	case DestroyedOnRelease:
+		return "release"
+	case DestroyedOnClose:
+		return "close"
+	case DestroyedBroken:
+		return "broken"
+	}
+	return "unknown"
+}
+
+// Stats summarizes the activity of a pool since it was created, for capacity
+// planning.  Gets counts the requests for a connection, Waits those that had to
+// wait for one to be released, for WaitDuration in total, and Timeouts those
+// that gave up waiting.  Opened and Closed count the connections opened and
+// closed, and Destroys breaks the latter down by reason; IdleEvictions is the
+// number closed because they were idle, ExpiredOnCheckout the number that Get
+// found had expired and discarded, Detached the number handed over to callers
+// with Conn.Detach, and Leaks the number reported as leaked (see
+// Config.LeakWarningThreshold).  InUse is the number of connections
+// currently checked out and MaxInUse the most that have been at once.
+// QueryLatency counts the successful queries run with Query, Start, Stmt.Exec
+// and the like in each of QueryLatencyBuckets, by the time they took to
+// return, and QueryDuration is their total.  The remaining fields hold the
+// statistics also returned by ProtocolErrors, RetryStats, StmtStats and
+// ConnStats.  Stats can be saved as JSON and combined with Merge, or loaded
+// back into a pool with ImportStats.
+type Stats struct {
+	Gets              uint64
+	Waits             uint64
+	WaitDuration      time.Duration
+	Timeouts          uint64
+	Opened            uint64
+	Closed            uint64
+	Destroys          map[DestroyReason]uint64
+	IdleEvictions     uint64
+	ExpiredOnCheckout uint64
+	Detached          uint64
+	Leaks             uint64
+	InUse             int
+	MaxInUse          int
+	QueryLatency      [len(QueryLatencyBuckets) + 1]uint64
+	QueryDuration     time.Duration
+	ProtocolErrors    uint64
+	Retry             RetryStats
+	Stmt              StmtStats
+	Conn              ConnStats
+}
+
+// QueryLatencyBuckets are the upper bounds of the buckets in the query latency
+// histogram.  Queries slower than the last bound are counted in an extra,
+// final bucket.
+var QueryLatencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+}
+
+// Stats returns a snapshot of the pool's statistics.
+func (pool *Pool) Stats() Stats {
+	conns := pool.ConnStats()
+	pool.statsMutex.Lock()
+	stats := pool.stats
+	stats.Destroys = make(map[DestroyReason]uint64, len(pool.stats.Destroys))
+	for reason, n := range pool.stats.Destroys {
+		stats.Destroys[reason] = n
+	}
+	if pool.config.RetryRate > 0 {
+		pool.refillRetries()
+	}
+	stats.Retry = pool.retryStats
+	stats.Stmt = pool.stmtStats
+	pool.statsMutex.Unlock()
+
+	stats.IdleEvictions = stats.Destroys[DestroyedIdle]
+	stats.ProtocolErrors = pool.ProtocolErrors()
+	stats.Conn = conns
+	return stats
+}
+
+// updateStats applies f to the pool's statistics.
+func (pool *Pool) updateStats(f func(*Stats)) {
+	pool.statsMutex.Lock()
+	defer pool.statsMutex.Unlock()
+	f(&pool.stats)
+}
+
+// countInUse records a connection being checked out of the pool, or returned
+// to it if checkout is false.
+func (pool *Pool) countInUse(checkout bool) {
+	pool.updateStats(func(stats *Stats) {
+		if !checkout {
+			stats.InUse--
+			return
+		}
+		stats.InUse++
+		if stats.InUse > stats.MaxInUse {
+			stats.MaxInUse = stats.InUse
+		}
+	})
+}
+
+// observeQuery records the latency of a query that began at the given time.
+func (pool *Pool) observeQuery(start time.Time) {
+	elapsed := time.Since(start)
+	bucket := 0
+	for bucket < len(QueryLatencyBuckets) && elapsed > QueryLatencyBuckets[bucket] {
+		bucket++
+	}
+	pool.updateStats(func(stats *Stats) {
+		stats.QueryLatency[bucket]++
+		stats.QueryDuration += elapsed
+	})
+}
@@ -2,38 +2,63 @@ package pool
 
 import (
 	"github.com/ziutek/mymysql/mysql"
+	"time"
 )
 
 // A Stmt is a prepared statement associated with a connection in a database pool.
 type Stmt struct {
 	mysql.Stmt
-	conn *Conn
-	sql  string
+	conn     *Conn
+	sql      string
+	lastUsed uint64 // the connection's stmtClock when the statement was last prepared or executed
 }
 
 // Delete destroys a prepared statement.
+// The execution time is limited according to the pool's request timeout.
 func (stmt *Stmt) Delete() error {
-	return stmt.conn.destroyOnError(func() error {
-		err := stmt.Stmt.Delete()
-		if err == nil {
-			delete(stmt.conn.statements, stmt.sql)
-		}
-		return err
+	return stmt.conn.withTimeout(stmt.sql, func() error {
+		return stmt.conn.destroyOnError(func() error {
+			err := stmt.Stmt.Delete()
+			if err == nil {
+				delete(stmt.conn.statements, stmt.sql)
+			}
+			return err
+		})
 	})
 }
 
-// Exec executes a prepared statement.
+// Run executes a prepared statement without reading its result.
+// The execution time, including the time spent reading the result, is limited
+// according to the pool's request timeout.
+func (stmt *Stmt) Run(params ...interface{}) (result mysql.Result, err error) {
+	return stmt.exec(params, nil)
+}
+
+// Reset resets the state of a prepared statement on the server.
 // The execution time is limited according to the pool's request timeout.
-func (stmt *Stmt) Exec(params ...interface{}) (rows []mysql.Row, result mysql.Result, err error) {
-	stmt.conn.withTimeout(func() error {
+func (stmt *Stmt) Reset() error {
+	return stmt.conn.withTimeout(stmt.sql, func() error {
+		return stmt.conn.destroyOnError(stmt.Stmt.Reset)
+	})
+}
+
+// SendLongData sends a long parameter value to the server in chunks.
+// The execution time is limited according to the pool's request timeout.
+func (stmt *Stmt) SendLongData(pnum int, data interface{}, pktSize int) error {
+	return stmt.conn.withTimeout(stmt.sql, func() error {
 		return stmt.conn.destroyOnError(func() error {
-			rows, result, err = stmt.Stmt.Exec(params...)
-			return err
+			return stmt.Stmt.SendLongData(pnum, data, pktSize)
 		})
 	})
-	if err == nil {
-		result = &Result{result, stmt.conn}
-	}
+}
+
+// Exec executes a prepared statement.
+// The execution time is limited according to the pool's request timeout.
+func (stmt *Stmt) Exec(params ...interface{}) (rows []mysql.Row, result mysql.Result, err error) {
+	result, err = stmt.exec(params, func(res mysql.Result) (n int, e error) {
+		rows, e = stmt.conn.getRows(res)
+		return len(rows), e
+	})
 	return
 }
 
@@ -41,15 +66,12 @@ func (stmt *Stmt) Exec(params ...interface{}) (rows []mysql.Row, result mysql.Re
 // result set.  The execution time is limited according to the pool's request
 // timeout.
 func (stmt *Stmt) ExecFirst(params ...interface{}) (row mysql.Row, result mysql.Result, err error) {
-	stmt.conn.withTimeout(func() error {
-		return stmt.conn.destroyOnError(func() error {
-			row, result, err = stmt.Stmt.ExecFirst(params...)
-			return err
-		})
+	result, err = stmt.exec(params, func(res mysql.Result) (n int, e error) {
+		if row, e = mysql.GetFirstRow(res); e == nil {
+			stmt.conn.mask(res.Fields(), row)
+		}
+		return rowCount(row), e
 	})
-	if err == nil {
-		result = &Result{result, stmt.conn}
-	}
 	return
 }
 
@@ -57,18 +79,64 @@ func (stmt *Stmt) ExecFirst(params ...interface{}) (row mysql.Row, result mysql.
 // result set.  The execution time is limited according to the pool's request
 // timeout.
 func (stmt *Stmt) ExecLast(params ...interface{}) (row mysql.Row, result mysql.Result, err error) {
-	stmt.conn.withTimeout(func() error {
-		return stmt.conn.destroyOnError(func() error {
-			row, result, err = stmt.Stmt.ExecLast(params...)
-			return err
+	result, err = stmt.exec(params, func(res mysql.Result) (n int, e error) {
+		if row, e = mysql.GetLastRow(res); e == nil {
+			stmt.conn.mask(res.Fields(), row)
+		}
+		return rowCount(row), e
+	})
+	return
+}
+
+// exec runs the statement and then, unless fetch is nil, reads its result with
+// fetch, which returns the number of rows it read.  The execute and fetch
+// phases are timed separately.
+func (stmt *Stmt) exec(params []interface{}, fetch func(mysql.Result) (int, error)) (result mysql.Result, err error) {
+	if err = stmt.conn.dryRun(stmt.sql); err != nil {
+		return
+	}
+	stmt.touch()
+	pool := stmt.conn.pool
+	ctx := stmt.conn.Context()
+	started := stmt.conn.startRequest(stmt.sql)
+	name, rows := "Stmt.Run", -1
+	if fetch != nil {
+		name = "Stmt.Exec"
+	}
+	err = stmt.conn.withDeadline(stmt.sql, started, func() error {
+		return stmt.conn.destroyOnError(func() (e error) {
+			start := time.Now()
+			result, e = stmt.Stmt.Run(params...)
+			pool.traceStmt(ctx, StmtExecute, stmt.sql, start, e)
+			if e != nil || fetch == nil {
+				return
+			}
+			start = time.Now()
+			rows, e = fetch(result)
+			pool.traceStmt(ctx, StmtFetch, stmt.sql, start, e)
+			return
 		})
 	})
+	stmt.conn.traceOp(pool, name, stmt.sql, started, rows, err)
 	if err == nil {
-		result = &Result{result, stmt.conn}
+		pool.observeQuery(started)
+		r := &Result{result, stmt.conn, stmt.sql, started, stmt.conn.ctx}
+		if fetch == nil {
+			r.trackUnread()
+		} else {
+			stmt.conn.reportSlowQuery(stmt.sql, started)
+		}
+		result = r
 	}
 	return
 }
 
+// touch marks the statement as the connection's most recently used one.
+func (stmt *Stmt) touch() {
+	stmt.conn.stmtClock++
+	stmt.lastUsed = stmt.conn.stmtClock
+}
+
 // String returns the SQL used to generate a prepared statement.
 func (stmt *Stmt) String() string {
 	return stmt.sql
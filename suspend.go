@@ -0,0 +1,80 @@
+package pool
+
+import (
+	"sync"
+	"time"
+)
+
+// Interval at which a pool that keeps connections alive looks for signs that
+// the process was suspended
+const suspendCheckInterval = 5 * time.Second
+
+// Amount by which the wall clock must have run ahead of the monotonic clock for
+// the process to be taken to have been suspended
+const suspendThreshold = 5 * time.Second
+
+// watchSuspend validates the pool's idle connections whenever the process
+// resumes from being suspended, as when a laptop goes to sleep or a virtual
+// machine is migrated, until the pool is closed.  The monotonic clock stops
+// while the process is suspended but the wall clock doesn't, so a suspension
+// shows up as the wall clock jumping ahead.  Meanwhile the server or a
+// firewall is likely to have dropped the idle connections, and without this
+// each of them would be found dead only when Get hands it out.
+func (pool *Pool) watchSuspend() {
+	ticker := time.NewTicker(suspendCheckInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			now := time.Now()
+			if suspended := suspendedFor(last, now); suspended > suspendThreshold {
+				pool.logInfo("Process was suspended for %s, validating idle connections", suspended.Round(time.Second))
+				pool.validateIdle()
+			}
+			last = now
+		case <-pool.stop:
+			return
+		}
+	}
+}
+
+// suspendedFor returns how far the wall clock ran ahead of the monotonic clock
+// between two readings of the time.
+func suspendedFor(last, now time.Time) time.Duration {
+	return now.Round(0).Sub(last.Round(0)) - now.Sub(last)
+}
+
+// validateIdle pings all of the pool's idle connections at once and closes
+// those that fail.  Connections that expired while the process was suspended
+// are closed without being pinged.  Get doesn't hand out any of the
+// connections until they have all been checked.
+func (pool *Pool) validateIdle() {
+	idle := pool.takeIdle()
+	ok := make([]bool, len(idle))
+	var wg sync.WaitGroup
+	for i, conn := range idle {
+		if conn.expired() {
+			conn.destroy(DestroyedExpired)
+			continue
+		}
+		wg.Add(1)
+		go func(i int, conn *Conn) {
+			defer wg.Done()
+			ok[i] = conn.healthCheck("") == nil
+		}(i, conn)
+	}
+	wg.Wait()
+
+	live := idle[:0]
+	for i, conn := range idle {
+		if ok[i] {
+			live = append(live, conn)
+		}
+	}
+	pool.returnIdle(live)
+	if closed := len(idle) - len(live); closed > 0 {
+		pool.logInfo("Closed %d of %d idle connections after the process resumed", closed, len(idle))
+	}
+	pool.wakeKeeper()
+}
@@ -0,0 +1,38 @@
+package pool
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// tempTableCount numbers the temporary tables created by WithTempTable.
+var tempTableCount uint64 // accessed atomically
+
+// WithTempTable creates a temporary table with a unique name and the given
+// definition, such as "(id INT PRIMARY KEY, total DECIMAL(10,2))" or
+// "ENGINE=MEMORY AS SELECT ...", calls fn with its name and drops the table
+// again, whether fn succeeds or not.  Temporary tables belong to the session,
+// so without the drop the table would be left behind for the next borrower of
+// the connection; if it can't be dropped, the connection is destroyed
+// instead.  fn must use this connection to access the table.  fn's error is
+// returned, or if it succeeded, any error dropping the table.
+func (conn *Conn) WithTempTable(schema string, fn func(table string) error) (err error) {
+	table := "tmp_" + strconv.FormatUint(conn.borrowID, 10) + "_" +
+		strconv.FormatUint(atomic.AddUint64(&tempTableCount, 1), 10)
+	if _, _, err = conn.Query("CREATE TEMPORARY TABLE " + table + " " + schema); err != nil {
+		return err
+	}
+	defer func() {
+		if conn.checkInUse() != nil {
+			// Closing the connection has dropped the table
+			return
+		}
+		if _, _, dropErr := conn.Query("DROP TEMPORARY TABLE IF EXISTS " + table); dropErr != nil {
+			conn.destroy(DestroyedOnError)
+			if err == nil {
+				err = dropErr
+			}
+		}
+	}()
+	return fn(table)
+}
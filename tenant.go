@@ -0,0 +1,63 @@
+package pool
+
+import (
+	"context"
+)
+
+// defaultTenantVariable is the session variable that holds the tenant ID when
+// Config.TenantVariable isn't set.
+const defaultTenantVariable = "tenant_id"
+
+// WithTenant returns a copy of ctx that carries a tenant ID.  Connections bound
+// to the context, such as those of Pool.Go and NewResponder, store the ID in a
+// session variable for as long as they are checked out, so that views and
+// triggers can implement row-level security keyed on it.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// TenantFromContext returns the tenant ID stored in ctx by WithTenant, if any.
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey).(string)
+	return tenant, ok
+}
+
+// SetTenant stores a tenant ID in the connection's tenant session variable
+// (@tenant_id unless configured otherwise).  The variable is reset to NULL when
+// the connection is released.
+func (conn *Conn) SetTenant(tenant string) error {
+	if _, _, err := conn.Query("SET @%s = %s", conn.tenantVariable(), conn.sqlString(tenant)); err != nil {
+		return err
+	}
+	conn.tenant = true
+	return nil
+}
+
+// resetTenant clears the tenant session variable if it has been set, so that
+// the next user of the connection can't act on behalf of the previous tenant.
+func (conn *Conn) resetTenant() error {
+	if !conn.tenant {
+		return nil
+	}
+	conn.tenant = false
+	_, _, err := conn.Query("SET @%s = NULL", conn.tenantVariable())
+	return err
+}
+
+// tenantVariable returns the name of the tenant session variable.
+func (conn *Conn) tenantVariable() string {
+	if len(conn.pool.config.TenantVariable) > 0 {
+		return conn.pool.config.TenantVariable
+	}
+	return defaultTenantVariable
+}
+
+// bind binds the connection to ctx until it is released, and applies the
+// tenant ID carried by ctx, if any.
+func (conn *Conn) bind(ctx context.Context) error {
+	conn.ctx = ctx
+	if tenant, ok := TenantFromContext(ctx); ok {
+		return conn.SetTenant(tenant)
+	}
+	return nil
+}
@@ -0,0 +1,522 @@
+// Package testsupport provides a minimal MySQL server that runs in the test's
+// own process, so that code using the pool can be tested without a real
+// server.  It speaks enough of the client/server protocol for the native
+// driver to connect, run statements and read their results, and it can be
+// told to misbehave in the ways a network or a server does.
+package testsupport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/ziutek/mymysql/mysql"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Commands of the client/server protocol that the server understands
+const (
+	comQuit   = 0x01
+	comInitDB = 0x02
+	comQuery  = 0x03
+	comPing   = 0x0e
+)
+
+const (
+	statusAutocommit = 0x0002
+	charsetUTF8      = 33
+	typeVarString    = 0xfd
+
+	// Capabilities the server announces in its handshake
+	capabilities = 0x0001 | // CLIENT_LONG_PASSWORD
+		0x0004 | // CLIENT_LONG_FLAG
+		0x0008 | // CLIENT_CONNECT_WITH_DB
+		0x0200 | // CLIENT_PROTOCOL_41
+		0x2000 | // CLIENT_TRANSACTIONS
+		0x8000 // CLIENT_SECURE_CONNECTION
+)
+
+// Errors the server reports, with the codes a real server uses for them
+var (
+	ErrInterrupted    = &mysql.Error{Code: 1317, Msg: []byte("Query execution was interrupted")}
+	ErrUnknownCommand = &mysql.Error{Code: 1047, Msg: []byte("Unknown command")}
+)
+
+var killPattern = regexp.MustCompile(`(?i)^\s*KILL\s+(QUERY\s+|CONNECTION\s+)?(\d+)\s*$`)
+
+// A Response is what the server answers a statement with.  If Err is set, the
+// statement fails with that error.  Otherwise, if Columns is set, the
+// statement returns a result set of Rows, whose values are sent as text, with
+// nil for NULL.  If neither is set, the statement succeeds without a result
+// set, reporting AffectedRows and InsertID.  The server waits for Delay before
+// answering, and for RowDelay before sending each row, as a server that stalls
+// in the middle of a large result does, unless the statement is killed with
+// KILL QUERY in the meantime, in which case it fails with ErrInterrupted.
+type Response struct {
+	Columns      []string
+	Rows         [][]interface{}
+	AffectedRows uint64
+	InsertID     uint64
+	Err          *mysql.Error
+	Delay        time.Duration
+	RowDelay     time.Duration
+}
+
+// A Fault is a way for the server to fail a command, as set up with Inject.
+type Fault int
+
+const (
+	// Drop closes the connection instead of answering.
+	Drop Fault = iota + 1
+	// Hang never answers, until the client closes the connection or it is
+	// dropped.
+	Hang
+	// Corrupt answers with a packet whose sequence number is wrong.
+	Corrupt
+)
+
+// A Server is a minimal MySQL server listening on a local TCP port.  Any user
+// may log in with any password, and statements the server has no response for
+// succeed without a result set.  Its methods may be called while clients are
+// connected.
+type Server struct {
+	listener net.Listener
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	mutex     sync.Mutex
+	responses map[string]*Response
+	handler   func(sql string) *Response
+	faults    []Fault
+	refuse    int
+	queries   []string
+	conns     map[uint32]*serverConn
+	lastID    uint32
+	accepted  int
+}
+
+// NewServer starts a server on a free port of the loopback interface.
+func NewServer() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener:  listener,
+		done:      make(chan struct{}),
+		responses: make(map[string]*Response),
+		conns:     make(map[uint32]*serverConn),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on, for use with the "tcp"
+// protocol.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and closes the connections of its clients.
+func (s *Server) Close() error {
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+	err := s.listener.Close()
+	s.DropConnections()
+	s.wg.Wait()
+	return err
+}
+
+// Handle sets the response to the given statement, which must match the
+// statement the client sends exactly.
+func (s *Server) Handle(sql string, response *Response) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.responses[sql] = response
+}
+
+// HandleFunc sets a function that returns the response to the statements that
+// have none set with Handle.  If it returns nil, the statement succeeds
+// without a result set.
+func (s *Server) HandleFunc(handler func(sql string) *Response) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handler = handler
+}
+
+// Inject makes the server run into the given fault on the next n commands it
+// receives, whichever connections they come over.  Handshakes aren't
+// affected; see RefuseConnections.
+func (s *Server) Inject(fault Fault, n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i := 0; i < n; i++ {
+		s.faults = append(s.faults, fault)
+	}
+}
+
+// RefuseConnections makes the server close the next n connections it accepts
+// without sending a handshake, as one that is starting up or overloaded does.
+func (s *Server) RefuseConnections(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.refuse = n
+}
+
+// DropConnections closes the connections of all clients, as restarting the
+// server would.  The server keeps accepting new ones.
+func (s *Server) DropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+}
+
+// Connections returns the number of clients connected, and the number of
+// connections the server has accepted altogether.
+func (s *Server) Connections() (open, accepted int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.conns), s.accepted
+}
+
+// Queries returns the statements the server has received, in order.
+func (s *Server) Queries() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+// serve accepts connections until the server is closed.
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.accepted++
+		if s.refuse > 0 {
+			s.refuse--
+			s.mutex.Unlock()
+			nc.Close()
+			continue
+		}
+		s.lastID++
+		c := &serverConn{
+			Conn:   nc,
+			server: s,
+			rd:     bufio.NewReader(nc),
+			id:     s.lastID,
+			kill:   make(chan struct{}, 1),
+		}
+		s.conns[c.id] = c
+		s.mutex.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			c.serve()
+			c.Close()
+			s.mutex.Lock()
+			delete(s.conns, c.id)
+			s.mutex.Unlock()
+		}()
+	}
+}
+
+// nextFault returns the fault to run into on the next command, if any.
+func (s *Server) nextFault() Fault {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.faults) == 0 {
+		return 0
+	}
+	fault := s.faults[0]
+	s.faults = s.faults[1:]
+	return fault
+}
+
+// respond records a statement and returns the response to it.  The handler
+// runs without the server's lock, so that it may call the server's methods.
+func (s *Server) respond(sql string) *Response {
+	s.mutex.Lock()
+	s.queries = append(s.queries, sql)
+	response, handler := s.responses[sql], s.handler
+	s.mutex.Unlock()
+	if response == nil && handler != nil {
+		response = handler(sql)
+	}
+	if response == nil {
+		return &Response{}
+	}
+	return response
+}
+
+// kill interrupts the statement running on the given connection, or closes
+// the connection, as the KILL statement does.
+func (s *Server) kill(id uint32, query bool) *mysql.Error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c, ok := s.conns[id]
+	if !ok {
+		return &mysql.Error{Code: 1094, Msg: []byte(fmt.Sprintf("Unknown thread id: %d", id))}
+	}
+	if !query {
+		c.Close()
+		return nil
+	}
+	select {
+	case c.kill <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// A serverConn is a client's connection to the server.
+type serverConn struct {
+	net.Conn
+	server *Server
+	rd     *bufio.Reader
+	seq    byte
+	id     uint32
+	kill   chan struct{}
+}
+
+// serve runs the handshake and then the client's commands, until the
+// connection is closed.
+func (c *serverConn) serve() {
+	if err := c.handshake(); err != nil {
+		return
+	}
+	for {
+		c.seq = 0
+		packet, err := c.readPacket()
+		if err != nil || len(packet) == 0 || packet[0] == comQuit {
+			return
+		}
+		// A statement killed before it started mustn't be interrupted
+		select {
+		case <-c.kill:
+		default:
+		}
+		switch c.server.nextFault() {
+		case Drop:
+			return
+		case Hang:
+			io.Copy(io.Discard, c.rd)
+			return
+		case Corrupt:
+			c.seq += 2
+			c.writeOK(0, 0)
+			continue
+		}
+		if err := c.command(packet[0], string(packet[1:])); err != nil {
+			return
+		}
+	}
+}
+
+// handshake greets the client and accepts its credentials, whatever they are.
+func (c *serverConn) handshake() error {
+	scramble := []byte("abcdefghijklmnopqrst")
+	var p []byte
+	p = append(p, 10)
+	p = append(p, "5.7.0-testsupport\x00"...)
+	p = binary.LittleEndian.AppendUint32(p, c.id)
+	p = append(p, scramble[:8]...)
+	p = append(p, 0)
+	p = binary.LittleEndian.AppendUint16(p, capabilities)
+	p = append(p, charsetUTF8)
+	p = binary.LittleEndian.AppendUint16(p, statusAutocommit)
+	p = binary.LittleEndian.AppendUint16(p, 0)
+	p = append(p, byte(len(scramble)+1))
+	p = append(p, make([]byte, 10)...)
+	p = append(p, scramble[8:]...)
+	p = append(p, 0)
+	if err := c.writePacket(p); err != nil {
+		return err
+	}
+	if _, err := c.readPacket(); err != nil {
+		return err
+	}
+	return c.writeOK(0, 0)
+}
+
+// command runs one of the client's commands.
+func (c *serverConn) command(command byte, arg string) error {
+	switch command {
+	case comPing, comInitDB:
+		return c.writeOK(0, 0)
+	case comQuery:
+		if m := killPattern.FindStringSubmatch(arg); m != nil {
+			c.server.respond(arg)
+			id, _ := strconv.ParseUint(m[2], 10, 32)
+			if err := c.server.kill(uint32(id), strings.EqualFold(strings.TrimSpace(m[1]), "QUERY")); err != nil {
+				return c.writeError(err)
+			}
+			return c.writeOK(0, 0)
+		}
+		return c.query(c.server.respond(arg))
+	default:
+		return c.writeError(ErrUnknownCommand)
+	}
+}
+
+// query answers a statement with the given response.
+func (c *serverConn) query(response *Response) error {
+	if ok, err := c.wait(response.Delay); !ok {
+		return err
+	}
+	if response.Err != nil {
+		return c.writeError(response.Err)
+	}
+	if len(response.Columns) == 0 {
+		return c.writeOK(response.AffectedRows, response.InsertID)
+	}
+
+	if err := c.writePacket(appendLength(nil, uint64(len(response.Columns)))); err != nil {
+		return err
+	}
+	for _, name := range response.Columns {
+		var p []byte
+		p = appendString(p, "def")
+		p = appendString(p, "") // database
+		p = appendString(p, "") // table
+		p = appendString(p, "") // original table
+		p = appendString(p, name)
+		p = appendString(p, name)
+		p = append(p, 0x0c)
+		p = binary.LittleEndian.AppendUint16(p, charsetUTF8)
+		p = binary.LittleEndian.AppendUint32(p, 255)
+		p = append(p, typeVarString)
+		p = binary.LittleEndian.AppendUint16(p, 0) // flags
+		p = append(p, 0, 0, 0)                     // decimals and filler
+		if err := c.writePacket(p); err != nil {
+			return err
+		}
+	}
+	if err := c.writeEOF(); err != nil {
+		return err
+	}
+	for _, row := range response.Rows {
+		if ok, err := c.wait(response.RowDelay); !ok {
+			return err
+		}
+		var p []byte
+		for _, value := range row {
+			switch v := value.(type) {
+			case nil:
+				p = append(p, 0xfb)
+			case []byte:
+				p = appendString(p, string(v))
+			default:
+				p = appendString(p, fmt.Sprint(v))
+			}
+		}
+		if err := c.writePacket(p); err != nil {
+			return err
+		}
+	}
+	return c.writeEOF()
+}
+
+// wait waits for the given time before the server goes on answering a
+// statement, and reports whether it should.  If the statement is killed
+// meanwhile, the client is sent ErrInterrupted instead.
+func (c *serverConn) wait(d time.Duration) (bool, error) {
+	if d <= 0 {
+		return true, nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true, nil
+	case <-c.kill:
+		return false, c.writeError(ErrInterrupted)
+	case <-c.server.done:
+		return false, io.EOF
+	}
+}
+
+func (c *serverConn) writeOK(affectedRows, insertID uint64) error {
+	p := []byte{0}
+	p = appendLength(p, affectedRows)
+	p = appendLength(p, insertID)
+	p = binary.LittleEndian.AppendUint16(p, statusAutocommit)
+	p = binary.LittleEndian.AppendUint16(p, 0) // warnings
+	return c.writePacket(p)
+}
+
+func (c *serverConn) writeEOF() error {
+	p := []byte{0xfe}
+	p = binary.LittleEndian.AppendUint16(p, 0) // warnings
+	p = binary.LittleEndian.AppendUint16(p, statusAutocommit)
+	return c.writePacket(p)
+}
+
+func (c *serverConn) writeError(err *mysql.Error) error {
+	p := []byte{0xff}
+	p = binary.LittleEndian.AppendUint16(p, err.Code)
+	p = append(p, "#HY000"...)
+	p = append(p, err.Msg...)
+	return c.writePacket(p)
+}
+
+// readPacket reads a packet from the client, which must be small enough to fit
+// into one.
+func (c *serverConn) readPacket() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(c.rd, header[:]); err != nil {
+		return nil, err
+	}
+	size := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	c.seq = header[3] + 1
+	packet := make([]byte, size)
+	if _, err := io.ReadFull(c.rd, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// writePacket sends a packet to the client, which must be small enough to fit
+// into one.
+func (c *serverConn) writePacket(payload []byte) error {
+	size := len(payload)
+	header := []byte{byte(size), byte(size >> 8), byte(size >> 16), c.seq}
+	c.seq++
+	_, err := c.Write(append(header, payload...))
+	return err
+}
+
+// appendLength appends a length-encoded integer.
+func appendLength(p []byte, n uint64) []byte {
+	switch {
+	case n < 251:
+		return append(p, byte(n))
+	case n < 1<<16:
+		return binary.LittleEndian.AppendUint16(append(p, 0xfc), uint16(n))
+	case n < 1<<24:
+		return append(p, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		return binary.LittleEndian.AppendUint64(append(p, 0xfe), n)
+	}
+}
+
+// appendString appends a length-encoded string.
+func appendString(p []byte, s string) []byte {
+	return append(appendLength(p, uint64(len(s))), s...)
+}
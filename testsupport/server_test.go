@@ -0,0 +1,96 @@
+package testsupport
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/ziutek/mymysql/mysql"
+	_ "github.com/ziutek/mymysql/native"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	s, err := NewServer()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	s.Handle("SELECT id, name FROM users", &Response{
+		Columns: []string{"id", "name"},
+		Rows:    [][]interface{}{{1, "ann"}, {2, nil}},
+	})
+	s.Handle("DELETE FROM users", &Response{AffectedRows: 2})
+	s.Handle("DROP TABLE users", &Response{Err: &mysql.Error{Code: 1142, Msg: []byte("DROP command denied")}})
+
+	db := mysql.New("tcp", "", s.Addr(), "user", "secret", "test")
+	db.SetTimeout(time.Second)
+	if !assert.NoError(t, db.Connect()) {
+		return
+	}
+	defer db.Close()
+	assert.NoError(t, db.Ping())
+
+	rows, res, err := db.Query("SELECT id, name FROM users")
+	if assert.NoError(t, err) && assert.Len(t, rows, 2) {
+		assert.Equal(t, 1, rows[0].Int(res.Map("id")))
+		assert.Equal(t, "ann", rows[0].Str(res.Map("name")))
+		assert.Nil(t, rows[1][res.Map("name")])
+	}
+	_, res, err = db.Query("DELETE FROM users")
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint64(2), res.AffectedRows())
+	}
+	_, _, err = db.Query("DROP TABLE users")
+	if assert.IsType(t, &mysql.Error{}, err) {
+		assert.Equal(t, uint16(1142), err.(*mysql.Error).Code)
+	}
+	assert.Equal(t, []string{"SELECT id, name FROM users", "DELETE FROM users", "DROP TABLE users"}, s.Queries())
+
+	// A slow statement is interrupted by KILL QUERY from another connection
+	s.Handle("SELECT SLEEP(10)", &Response{Delay: 10 * time.Second})
+	killer := db.Clone()
+	if !assert.NoError(t, killer.Connect()) {
+		return
+	}
+	defer killer.Close()
+	killed := make(chan error, 1)
+	time.AfterFunc(50*time.Millisecond, func() {
+		_, _, err := killer.Query("KILL QUERY %d", db.ThreadId())
+		killed <- err
+	})
+	start := time.Now()
+	_, _, err = db.Query("SELECT SLEEP(10)")
+	assert.Equal(t, ErrInterrupted.Code, err.(*mysql.Error).Code)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.NoError(t, <-killed)
+	assert.NoError(t, db.Ping(), "The connection should remain usable")
+
+	s.Inject(Drop, 1)
+	assert.Error(t, db.Ping())
+
+	s.Inject(Corrupt, 1)
+	assert.NoError(t, db.Reconnect())
+	assert.Error(t, db.Ping())
+
+	open, accepted := s.Connections()
+	assert.Equal(t, 3, accepted)
+	assert.True(t, open <= 2)
+
+	s.RefuseConnections(1)
+	assert.Error(t, db.Reconnect())
+	assert.NoError(t, db.Reconnect())
+
+	// A hung server doesn't answer until its connections are dropped
+	s.Inject(Hang, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- db.Ping()
+	}()
+	select {
+	case err := <-done:
+		t.Errorf("Ping returned %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	s.DropConnections()
+	assert.Error(t, <-done)
+	assert.Error(t, killer.Ping())
+}
@@ -0,0 +1,63 @@
+package pool
+
+import (
+	"context"
+	"github.com/ziutek/mymysql/mysql"
+	"time"
+)
+
+// An Operation describes a request made through the pool, as reported to
+// Config.OnOperation once it has completed.
+type Operation struct {
+	// Name identifies the method, such as "Pool.Get", "Conn.Query",
+	// "Stmt.Exec" or "Transaction.Commit".
+	Name string
+
+	// SQL is the statement sent to the server, before any parameters were
+	// substituted into it.  It is empty for Pool.Get.
+	SQL string
+
+	Start    time.Time
+	Duration time.Duration
+
+	// Rows is the number of rows the operation read, or -1 if it returned
+	// nothing to read or left the result for the caller to read.
+	Rows int
+
+	// Wait is the time Pool.Get spent waiting for a connection to become
+	// available.
+	Wait time.Duration
+
+	Err error
+}
+
+// traceOp reports a completed operation to the OnOperation callback, if there
+// is one.
+func (pool *Pool) traceOp(ctx context.Context, op Operation) {
+	if pool.config.OnOperation == nil {
+		return
+	}
+	op.Duration = time.Since(op.Start)
+	pool.config.OnOperation(ctx, op)
+}
+
+// traceOp reports a completed operation on the connection through the given
+// pool, passing it the context the connection is bound to.  The caller reads
+// the pool before the operation starts, as an operation that fails in a way
+// that destroys the connection detaches it from the pool.
+func (conn *Conn) traceOp(pool *Pool, name, sql string, start time.Time, rows int, err error) {
+	if pool == nil {
+		// The connection had already left its pool
+		return
+	}
+	pool.traceOp(conn.Context(), Operation{Name: name, SQL: sql, Start: start, Rows: rows, Err: err})
+}
+
+// rowCount returns the number of rows in a result that was read for a single
+// row.
+func rowCount(row mysql.Row) int {
+	if row == nil {
+		return 0
+	}
+	return 1
+}
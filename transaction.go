@@ -2,39 +2,129 @@ package pool
 
 import (
 	"github.com/ziutek/mymysql/mysql"
+	"sync/atomic"
 )
 
 // A Transaction is provides a means of executing multiple statements as a
 // single, atomic operation.
 type Transaction struct {
 	*Conn
-	trans mysql.Transaction
+	trans mysql.Transaction // nil for the dry-run transaction
 }
 
-// Commit commits the transaction.
+// Commit commits the transaction.  In dry-run mode, it rolls the transaction
+// back instead.
 func (t *Transaction) Commit() error {
-	return t.Conn.withTimeout(func() error {
+	if t.trans == nil {
+		return t.Conn.endDryRun()
+	}
+	pool := t.Conn.pool
+	start := t.Conn.startRequest("COMMIT")
+	err := t.Conn.withDeadline("COMMIT", start, func() error {
 		return t.Conn.destroyOnError(func() error {
 			return t.trans.Commit()
 		})
 	})
+	t.Conn.traceOp(pool, "Transaction.Commit", "COMMIT", start, -1, err)
+	return err
 }
 
 // Rollback rolls back the transaction.
 func (t *Transaction) Rollback() error {
-	return t.Conn.withTimeout(func() error {
+	if t.trans == nil {
+		return t.Conn.endDryRun()
+	}
+	pool := t.Conn.pool
+	start := t.Conn.startRequest("ROLLBACK")
+	err := t.Conn.withDeadline("ROLLBACK", start, func() error {
 		return t.Conn.destroyOnError(func() error {
 			return t.trans.Rollback()
 		})
 	})
+	t.Conn.traceOp(pool, "Transaction.Rollback", "ROLLBACK", start, -1, err)
+	return err
 }
 
-// Do binds a statement to the transaction.
+// Do binds a statement to the transaction.  Statements prepared through the
+// pool are unwrapped before being handed to the driver, which only accepts its
+// own statement type.
 func (t *Transaction) Do(stmt mysql.Stmt) mysql.Stmt {
+	if t.trans == nil {
+		return stmt
+	}
+	if s, ok := stmt.(*Stmt); ok {
+		t.trans.Do(s.Stmt)
+		return s
+	}
 	return t.trans.Do(stmt)
 }
 
 // IsValid returns true if the transaction is connected to an open connection.
 func (t *Transaction) IsValid() bool {
+	if t.trans == nil {
+		return t.Conn.IsConnected()
+	}
 	return t.trans.IsValid()
 }
+
+// WithTransaction checks out a connection, begins a transaction on it and
+// calls fn with the transaction.  If fn returns nil, the transaction is
+// committed; if it returns an error or panics, the transaction is rolled back
+// and the error or panic is passed on.  The connection is then released, or
+// destroyed if the transaction couldn't be rolled back, so that it never goes
+// back to the pool with the transaction still open.  The error from Commit is
+// returned if the commit fails.
+//
+// If the transaction fails with an error that Config.RetryPolicy deems
+// transient, such as a deadlock, it is rolled back and run again from the
+// start, calling fn again, so fn must not have effects outside the
+// transaction that can't be repeated.
+func (pool *Pool) WithTransaction(fn func(tx *Transaction) error) error {
+	return pool.withRetry(func() error {
+		return pool.withTransaction(fn)
+	})
+}
+
+// withTransaction runs fn in a transaction once, for WithTransaction.
+func (pool *Pool) withTransaction(fn func(tx *Transaction) error) (err error) {
+	conn, err := pool.Get()
+	if err != nil {
+		return err
+	}
+	trans, err := conn.Begin()
+	if err != nil {
+		conn.Release()
+		return err
+	}
+	tx := trans.(*Transaction)
+
+	finished := false
+	defer func() {
+		if !finished {
+			// fn panicked
+			tx.rollback()
+		}
+	}()
+	err = fn(tx)
+	finished = true
+	if err != nil {
+		tx.rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		tx.rollback()
+		return err
+	}
+	conn.Release()
+	return nil
+}
+
+// rollback rolls back a transaction started by WithTransaction and releases
+// its connection, or destroys the connection if the rollback fails.
+func (t *Transaction) rollback() {
+	if t.Rollback() != nil && atomic.LoadInt32(&t.Conn.state) != stateDestroyed {
+		t.Conn.Destroy()
+		return
+	}
+	t.Conn.Release()
+}
@@ -0,0 +1,82 @@
+package pool
+
+import (
+	"context"
+	"github.com/ziutek/mymysql/mysql"
+	"time"
+)
+
+// An unreadResult is a result set that was started on a connection but hasn't
+// been read to the end.  Until it has, the connection can't be used for
+// anything else.
+type unreadResult struct {
+	result   *Result
+	since    time.Time
+	reported bool // only accessed by the background check
+}
+
+// trackUnread records the result as the connection's unread result set, unless
+// there is nothing to read from it.
+func (r *Result) trackUnread() {
+	if r.Result.StatusOnly() && !r.Result.MoreResults() {
+		return
+	}
+	r.conn.unread.Store(&unreadResult{result: r, since: time.Now()})
+}
+
+// endOfSet notes that the current result set has been read to the end, which
+// frees the connection unless more result sets follow.
+func (r *Result) endOfSet() {
+	if unread, _ := r.conn.unread.Load().(*unreadResult); unread != nil && unread.result == r && !r.Result.MoreResults() {
+		r.conn.unread.Store((*unreadResult)(nil))
+	}
+}
+
+// drainUnread reads and discards the rest of any result set left unread on the
+// connection, and of the result sets following it, so that the connection can
+// be reused.  Draining is limited by the pool's request timeout.
+func (conn *Conn) drainUnread() error {
+	unread, _ := conn.unread.Load().(*unreadResult)
+	if unread == nil {
+		return nil
+	}
+	conn.unread.Store((*unreadResult)(nil))
+	return conn.withDeadline("DRAIN", time.Now(), func() error {
+		return conn.destroyOnError(func() (err error) {
+			for res := unread.result.Result; res != nil; {
+				// The current result set may already have been read to the end
+				if err = res.End(); err != nil && err != mysql.ErrReadAfterEOR {
+					return err
+				}
+				if res, err = res.NextResult(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// reportUnread passes the result sets that have been left unread on
+// connections in use for longer than maxUnread to the OnUnreadResult callback.
+// Each is only reported once.
+func (pool *Pool) reportUnread(maxUnread time.Duration) {
+	var stale []*unreadResult
+	pool.mutex.Lock()
+	for conn := range pool.openConnections {
+		unread, _ := conn.unread.Load().(*unreadResult)
+		if unread != nil && !unread.reported && conn.checkInUse() == nil && time.Since(unread.since) > maxUnread {
+			unread.reported = true
+			stale = append(stale, unread)
+		}
+	}
+	pool.mutex.Unlock()
+
+	for _, unread := range stale {
+		ctx := unread.result.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		pool.config.OnUnreadResult(ctx, unread.result.sql, time.Since(unread.since))
+	}
+}
@@ -0,0 +1,134 @@
+package pool
+
+import (
+	"github.com/ziutek/mymysql/mysql"
+	"reflect"
+	"strings"
+)
+
+// An UpdateBuilder builds an UPDATE statement from the fields that are set,
+// for PATCH-style endpoints where any subset of a row's columns may change:
+//
+//	_, err := pool.Update("users").
+//		Set("name", req.Name).   // *string, skipped if nil
+//		Set("email", req.Email). // *string, skipped if nil
+//		Where("id = ?", id).
+//		Exec(conn)
+//
+// Values are escaped and quoted like those of QueryInBatches, so no SQL is
+// built by hand.
+type UpdateBuilder struct {
+	table   string
+	columns []string
+	values  []interface{}
+	where   []string
+	args    [][]interface{}
+}
+
+// Update returns a builder for an UPDATE statement on the given table.
+func Update(table string) *UpdateBuilder {
+	return &UpdateBuilder{table: table}
+}
+
+// Set sets a column to a value, unless the value is nil, a nil pointer or the
+// zero value of its type.  Other pointers are dereferenced, so a pointer to a
+// zero value sets the column to that value.  Values are formatted by kind, so
+// named string types are escaped like strings, and values that can't be
+// formatted as SQL literals, such as structs, make Exec fail.
+func (b *UpdateBuilder) Set(column string, value interface{}) *UpdateBuilder {
+	if value == nil {
+		return b
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return b
+		}
+		value = v.Elem().Interface()
+	} else if v.IsZero() {
+		return b
+	}
+	b.columns = append(b.columns, column)
+	b.values = append(b.values, value)
+	return b
+}
+
+// Where adds a condition that the rows to update must meet, in which each ?
+// is replaced by the next of args as an SQL literal.  The conditions of
+// several calls must all be met.
+func (b *UpdateBuilder) Where(condition string, args ...interface{}) *UpdateBuilder {
+	b.where = append(b.where, condition)
+	b.args = append(b.args, args)
+	return b
+}
+
+// Empty reports whether no columns have been set.
+func (b *UpdateBuilder) Empty() bool {
+	return len(b.columns) == 0
+}
+
+// SQL returns the statement, with its values escaped for the given
+// connection.  It fails with ErrNothingToUpdate if no columns have been set,
+// with ErrUpdateWithoutWhere if there are no conditions, as updating every row
+// of a table is seldom what a PATCH means, and with ErrPlaceholderCount if a
+// condition's placeholders don't match its arguments.
+func (b *UpdateBuilder) SQL(conn *Conn) (string, error) {
+	if b.Empty() {
+		return "", ErrNothingToUpdate
+	}
+	if len(b.where) == 0 {
+		return "", ErrUpdateWithoutWhere
+	}
+	var sql strings.Builder
+	sql.WriteString("UPDATE " + quoteIdent(b.table) + " SET ")
+	for i, column := range b.columns {
+		if i > 0 {
+			sql.WriteString(", ")
+		}
+		literal, err := conn.sqlLiteral(b.values[i])
+		if err != nil {
+			return "", err
+		}
+		sql.WriteString(quoteIdent(column) + " = " + literal)
+	}
+	sql.WriteString(" WHERE ")
+	for i, condition := range b.where {
+		if i > 0 {
+			sql.WriteString(" AND ")
+		}
+		parts := strings.Split(condition, "?")
+		if len(parts) != len(b.args[i])+1 {
+			return "", ErrPlaceholderCount
+		}
+		sql.WriteString("(" + parts[0])
+		for j, arg := range b.args[i] {
+			literal, err := conn.sqlLiteral(arg)
+			if err != nil {
+				return "", err
+			}
+			sql.WriteString(literal + parts[j+1])
+		}
+		sql.WriteString(")")
+	}
+	return sql.String(), nil
+}
+
+// Exec executes the statement on a connection.  To execute it in a
+// transaction, pass the transaction's Conn.
+func (b *UpdateBuilder) Exec(conn *Conn) (mysql.Result, error) {
+	sql, err := b.SQL(conn)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Exec(sql)
+}
+
+// quoteIdent quotes a possibly qualified identifier, such as db.table, with
+// backticks.
+func quoteIdent(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = "`" + strings.ReplaceAll(part, "`", "``") + "`"
+	}
+	return strings.Join(parts, ".")
+}